@@ -2,28 +2,144 @@ package main
 
 import (
 	"flag"
+	"github.com/luguoxiang/kubernetes-traffic-monitor/pkg/config"
+	"github.com/luguoxiang/kubernetes-traffic-monitor/pkg/geoip"
 	"github.com/luguoxiang/kubernetes-traffic-monitor/pkg/kubernetes"
+	"github.com/luguoxiang/kubernetes-traffic-monitor/pkg/procfs"
 	"github.com/luguoxiang/kubernetes-traffic-monitor/pkg/traffic"
+	"github.com/prometheus/client_golang/prometheus"
+	"os"
+	"time"
+)
+
+var (
+	resyncPeriod = flag.Duration("resync-period", 10*time.Minute, "resync period of kubernetes informers")
+	configPath   = flag.String("config", "", "path of yaml config file")
 )
 
 func main() {
 	flag.Parse()
 
-	k8sManager, err := kubernetes.NewK8sResourceManager()
+	monitorConfig, err := config.LoadConfig(*configPath)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	k8sManager, err := kubernetes.NewK8sResourceManager(*resyncPeriod, &monitorConfig.Policy)
+	if err != nil {
+		panic(err.Error())
+	}
+	err = k8sManager.SetIngressControllerSelector(monitorConfig.Ingress.ControllerSelector)
 	if err != nil {
 		panic(err.Error())
 	}
 	stopper := make(chan struct{})
 
-	go k8sManager.WatchPods(stopper, k8sManager)
-	go k8sManager.WatchDeployments(stopper, k8sManager)
-	go k8sManager.WatchServices(stopper, k8sManager)
-	go k8sManager.WatchStatefulSets(stopper, k8sManager)
-	go k8sManager.WatchDaemonSets(stopper, k8sManager)
+	podHandlers := []kubernetes.PodEventHandler{k8sManager}
+	deploymentHandlers := []kubernetes.DeploymentEventHandler{k8sManager}
+	var prometheusSink *traffic.PrometheusSink
+	if monitorConfig.Sinks.Prometheus.Enabled {
+		prometheusSink, err = traffic.NewPrometheusSink(prometheus.DefaultRegisterer, &monitorConfig.Sinks.Prometheus)
+		if err != nil {
+			panic(err.Error())
+		}
+		//series of deleted workloads and pods are deleted
+		podHandlers = append(podHandlers, prometheusSink)
+		deploymentHandlers = append(deploymentHandlers, prometheusSink)
+	}
+	var otlpSink *traffic.OTLPSink
+	if monitorConfig.Sinks.OTLP.Enabled {
+		otlpSink, err = traffic.NewOTLPSink(&monitorConfig.Sinks.OTLP)
+		if err != nil {
+			panic(err.Error())
+		}
+		podHandlers = append(podHandlers, otlpSink)
+		deploymentHandlers = append(deploymentHandlers, otlpSink)
+	}
+
+	k8sManager.WatchNamespaces(k8sManager)
+	k8sManager.WatchNodes(k8sManager)
+	if monitorConfig.NodeScoped {
+		nodeName := os.Getenv("NODE_NAME")
+		if nodeName == "" {
+			panic("NODE_NAME is required by nodeScoped")
+		}
+		k8sManager.WatchNodePods(nodeName, podHandlers...)
+		k8sManager.WatchRemotePods(podHandlers...)
+	} else {
+		k8sManager.WatchPods(podHandlers...)
+	}
+	k8sManager.WatchDeployments(deploymentHandlers...)
+	k8sManager.WatchServices(k8sManager)
+	if monitorConfig.Ingress.ControllerSelector != "" {
+		//ingress paths are only used to attribute requests through an ingress controller
+		k8sManager.WatchIngresses(k8sManager)
+	}
+	k8sManager.WatchStatefulSets(deploymentHandlers...)
+	k8sManager.WatchDaemonSets(deploymentHandlers...)
+	k8sManager.WatchReplicaSets(deploymentHandlers...)
+	k8sManager.WatchJobs(deploymentHandlers...)
+	k8sManager.WatchReplicationControllers(deploymentHandlers...)
+
+	k8sManager.Start(stopper)
+	if !k8sManager.WaitForCacheSync(stopper) {
+		panic("Failed to sync kubernetes resources")
+	}
 
-	packetManager, err := traffic.NewPacketManager(k8sManager)
+	var socketResolver *procfs.SocketResolver
+	if monitorConfig.SocketAttribution {
+		socketResolver = procfs.NewSocketResolver(monitorConfig.ProcPath)
+		socketResolver.Start()
+	}
+	externalResolver, err := traffic.NewExternalResolver(&monitorConfig.External, k8sManager)
+	if err != nil {
+		panic(err.Error())
+	}
+	var geoResolver *geoip.Resolver
+	if monitorConfig.GeoIP.CountryDatabase != "" || monitorConfig.GeoIP.ASNDatabase != "" {
+		geoResolver, err = geoip.NewResolver(monitorConfig.GeoIP.CountryDatabase, monitorConfig.GeoIP.ASNDatabase)
+		if err != nil {
+			panic(err.Error())
+		}
+		defer geoResolver.Close()
+	}
+	packetManager, err := traffic.NewPacketManager(k8sManager, socketResolver, externalResolver, geoResolver)
+	if err != nil {
+		panic(err.Error())
+	}
+	pathTemplater, err := traffic.NewPathTemplater(&monitorConfig.Paths)
 	if err != nil {
 		panic(err.Error())
 	}
+	packetManager.SetPathTemplater(pathTemplater)
+	packetManager.SetServerObserver(monitorConfig.ServerObserver)
+	err = packetManager.SetTrustedProxies(monitorConfig.Ingress.TrustedProxies)
+	if err != nil {
+		panic(err.Error())
+	}
+	if prometheusSink != nil {
+		prometheusSink.Start()
+		packetManager.AddSink(prometheusSink)
+		traffic.ServePrometheus(":" + os.Getenv("VIZ_METRICS_PORT"))
+	}
+	if monitorConfig.Sinks.AccessLog.Enabled {
+		sink, err := traffic.NewAccessLogSink(&monitorConfig.Sinks.AccessLog)
+		if err != nil {
+			panic(err.Error())
+		}
+		packetManager.AddSink(sink)
+	}
+	if otlpSink != nil {
+		otlpSink.Start()
+		packetManager.AddSink(otlpSink)
+	}
+	if monitorConfig.Sinks.Zipkin.Enabled {
+		sink, err := traffic.NewZipkinSink(&monitorConfig.Sinks.Zipkin)
+		if err != nil {
+			panic(err.Error())
+		}
+		sink.Start()
+		packetManager.AddSink(sink)
+	}
 	packetManager.Run()
 }
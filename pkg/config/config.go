@@ -0,0 +1,269 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sigs.k8s.io/yaml"
+)
+
+// PolicyConfig decides which pods are monitored.
+// Annotation "traffic-monitor.io/enabled" on pod, workload or namespace overrides it, in that order
+type PolicyConfig struct {
+	//monitor only these namespaces, empty means all namespaces
+	IncludeNamespaces []string `json:"includeNamespaces"`
+	ExcludeNamespaces []string `json:"excludeNamespaces"`
+	//label selectors, e.g. "app in (a,b),tier!=db"
+	PodSelector       string `json:"podSelector"`
+	NamespaceSelector string `json:"namespaceSelector"`
+	//monitor host network pods, which share the node ip and are known by node ip and container port.
+	//Disabled by default, traffic of their ports is then reported as node/<name>.
+	//Annotation "traffic-monitor.io/enabled" of the pod, workload or namespace still enables it
+	HostNetwork bool `json:"hostNetwork"`
+}
+
+// ExternalNameConfig names an ip range outside the cluster, e.g. office vpn, partner ranges or cloud metadata
+type ExternalNameConfig struct {
+	//cidr or single ip
+	CIDR string `json:"cidr"`
+	Name string `json:"name"`
+}
+
+// ExternalConfig decides how peers outside the cluster are named.
+// Names are resolved by CIDR first, then by ExternalName services and dns answers observed by the agent
+type ExternalConfig struct {
+	Names []ExternalNameConfig `json:"names"`
+	//capture dns responses to learn names of external ips
+	ObserveDNS bool `json:"observeDNS"`
+	//limit of distinct names learned from dns, ips of more names are named "other", 0 means no limit
+	MaxDNSNames int `json:"maxDNSNames"`
+}
+
+// IngressConfig decides how requests through ingress controllers are attributed to ingresses
+type IngressConfig struct {
+	//label selector of ingress controller pods, empty disables ingress attribution
+	ControllerSelector string `json:"controllerSelector"`
+	//cidrs of load balancers or proxies in front of the cluster, whose forwarding headers and PROXY protocol
+	//preambles give the client ip. Ingress controller pods are always trusted
+	TrustedProxies []string `json:"trustedProxies"`
+}
+
+// GeoIPConfig enriches external client ips from MaxMind-format databases, labels of a missing database are empty
+type GeoIPConfig struct {
+	//e.g. GeoLite2-Country.mmdb or GeoLite2-City.mmdb, for client_country label
+	CountryDatabase string `json:"countryDatabase"`
+	//e.g. GeoLite2-ASN.mmdb, for client_asn label
+	ASNDatabase string `json:"asnDatabase"`
+}
+
+// PathRuleConfig templates paths of a destination workload which are not handled by the default templates,
+// e.g. match "^/files/.*" with template "/files/{path}"
+type PathRuleConfig struct {
+	//workload name of the destination, empty namespace matches the workload in all namespaces
+	Destination string `json:"destination"`
+	Namespace   string `json:"namespace"`
+	//regular expression, the matched part of the path is replaced by template, which may refer to groups as $1
+	Match    string `json:"match"`
+	Template string `json:"template"`
+}
+
+// PathConfig decides the path label of requests, query strings are always stripped.
+// Numeric ids, uuids and hex hashes in path segments become {id}, {uuid} and {hash} unless a rule matches
+type PathConfig struct {
+	Rules []PathRuleConfig `json:"rules"`
+	//distinct paths of each destination, more paths are reported as "other", 0 means unlimited
+	MaxPaths int `json:"maxPaths"`
+	//a path not requested for this long is forgotten and frees its place of maxPaths, 0 means never.
+	//It should not be shorter than seriesTTLSeconds of prometheus
+	TTLSeconds int `json:"ttlSeconds"`
+}
+
+// AccessLogConfig writes a line for each completed request
+type AccessLogConfig struct {
+	Enabled bool `json:"enabled"`
+	//json or logfmt
+	Format string `json:"format"`
+	//output file, empty means stdout
+	Path string `json:"path"`
+	//the file is rotated when it exceeds maxSizeMB, at most maxBackups rotated files are kept
+	MaxSizeMB  int `json:"maxSizeMB"`
+	MaxBackups int `json:"maxBackups"`
+	//fraction of requests written, 1 means all requests
+	SampleRate float64 `json:"sampleRate"`
+	//fields written in this order, empty means all fields
+	Fields []string `json:"fields"`
+}
+
+// OTLPConfig exports request metrics, and optionally a span for each request, to an OpenTelemetry collector
+type OTLPConfig struct {
+	Enabled bool `json:"enabled"`
+	//grpc or http
+	Protocol string `json:"protocol"`
+	//host:port for grpc, base url like http://collector:4318 for http
+	Endpoint string `json:"endpoint"`
+	//plaintext grpc connection, the scheme of the endpoint decides it for http
+	Insecure bool              `json:"insecure"`
+	Headers  map[string]string `json:"headers"`
+	//cumulative metrics and pending spans are exported at this interval
+	ExportIntervalSeconds int  `json:"exportIntervalSeconds"`
+	Spans                 bool `json:"spans"`
+	//distinct attribute sets of the metrics, requests of more series are not counted, 0 means unlimited
+	MaxSeries int `json:"maxSeries"`
+	//series not updated for the ttl are deleted after an export, 0 keeps them forever.
+	//Series of a workload or pod are also deleted when it is deleted
+	SeriesTTLSeconds int `json:"seriesTTLSeconds"`
+}
+
+// ZipkinConfig exports a span for each request with trace headers by zipkin v2 api. There is no jaeger exporter,
+// jaeger receives the spans by its zipkin compatible endpoint, or by otlp
+type ZipkinConfig struct {
+	Enabled bool `json:"enabled"`
+	//url of zipkin v2 api, e.g. http://zipkin:9411/api/v2/spans
+	Endpoint              string `json:"endpoint"`
+	ExportIntervalSeconds int    `json:"exportIntervalSeconds"`
+	//infer call trees of requests without trace headers, a tree is exported after its root completes for the delay
+	InferCallTrees        bool `json:"inferCallTrees"`
+	InferenceDelaySeconds int  `json:"inferenceDelaySeconds"`
+}
+
+// HistogramRuleConfig sets buckets of request duration histograms of a destination workload,
+// e.g. minutes for batch apis or microseconds for caches
+type HistogramRuleConfig struct {
+	//workload name of the destination, empty namespace matches the workload in all namespaces
+	Destination string `json:"destination"`
+	Namespace   string `json:"namespace"`
+	//upper bounds in seconds
+	Buckets []float64 `json:"buckets"`
+}
+
+// PrometheusLabelConfig switches labels of request metrics
+type PrometheusLabelConfig struct {
+	DestinationPort bool `json:"destinationPort"`
+	Method          bool `json:"method"`
+	//source_ns and destination_ns
+	Namespace bool `json:"namespace"`
+	//pod level labels source_pod and destination_pod
+	SourcePod      bool `json:"sourcePod"`
+	DestinationPod bool `json:"destinationPod"`
+	//destination_service and destination_service_ns of the cluster ip which the request is sent to
+	DestinationService bool `json:"destinationService"`
+	//node of the agent which captures the request, given by env NODE_NAME
+	Node bool `json:"node"`
+	//client_country and client_asn of external clients, which need geoip databases
+	ClientCountry bool `json:"clientCountry"`
+	ClientASN     bool `json:"clientASN"`
+}
+
+// PrometheusConfig decides how requests are exported as prometheus metrics
+type PrometheusConfig struct {
+	//metrics at /metrics of port given by env VIZ_METRICS_PORT
+	Enabled bool `json:"enabled"`
+	//upper bounds in seconds of request duration histograms, unless a rule of the destination workload matches
+	Buckets []float64             `json:"buckets"`
+	Rules   []HistogramRuleConfig `json:"rules"`
+	Labels  PrometheusLabelConfig `json:"labels"`
+	//native histograms are exposed besides the buckets if the factor is greater than 1, e.g. 1.1 for buckets
+	//growing by 10%, which are scraped by prometheus 2.40+ with native histograms enabled
+	NativeHistogramBucketFactor float64 `json:"nativeHistogramBucketFactor"`
+	//the resolution of a native histogram is reduced when it has more buckets, 0 means unlimited
+	NativeHistogramMaxBuckets uint32 `json:"nativeHistogramMaxBuckets"`
+	//distinct pairs of source_pod and destination_pod, pods of more pairs are reported as "other", 0 means unlimited
+	MaxPodSeries int `json:"maxPodSeries"`
+	//series not updated for the ttl are deleted, 0 keeps them forever.
+	//Series of a workload or pod are also deleted when it is deleted
+	SeriesTTLSeconds int `json:"seriesTTLSeconds"`
+}
+
+// SinkConfig decides where completed requests are sent
+type SinkConfig struct {
+	Prometheus PrometheusConfig `json:"prometheus"`
+	AccessLog  AccessLogConfig  `json:"accessLog"`
+	OTLP       OTLPConfig       `json:"otlp"`
+	Zipkin     ZipkinConfig     `json:"zipkin"`
+}
+
+type Config struct {
+	Policy   PolicyConfig   `json:"policy"`
+	External ExternalConfig `json:"external"`
+	Ingress  IngressConfig  `json:"ingress"`
+	GeoIP    GeoIPConfig    `json:"geoip"`
+	Paths    PathConfig     `json:"paths"`
+	Sinks    SinkConfig     `json:"sinks"`
+	//watch full pods only in this node, pods of other nodes are resolved from pod metadata and EndpointSlices
+	NodeScoped bool `json:"nodeScoped"`
+	//export the server node's copy of cross node pod to pod requests besides the client node's, with observer="server".
+	//It gives the server duration, access log lines and spans, requests are counted by the client node's copy only
+	ServerObserver bool `json:"serverObserver"`
+	//find the pod of a local socket by its process, which needs host network and host pid namespace
+	SocketAttribution bool   `json:"socketAttribution"`
+	ProcPath          string `json:"procPath"`
+}
+
+func NewConfig() *Config {
+	return &Config{
+		Policy: PolicyConfig{
+			ExcludeNamespaces: []string{"kube-system"},
+		},
+		External: ExternalConfig{
+			ObserveDNS:  true,
+			MaxDNSNames: 200,
+		},
+		Ingress: IngressConfig{
+			ControllerSelector: "app.kubernetes.io/name in (ingress-nginx,traefik)",
+		},
+		Paths: PathConfig{
+			MaxPaths:   100,
+			TTLSeconds: 3600,
+		},
+		Sinks: SinkConfig{
+			Prometheus: PrometheusConfig{
+				Enabled: true,
+				Buckets: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+				Labels: PrometheusLabelConfig{
+					DestinationPort: true,
+					Method:          true,
+					Namespace:       true,
+				},
+				NativeHistogramMaxBuckets: 160,
+				MaxPodSeries:              1000,
+				SeriesTTLSeconds:          3600,
+			},
+			AccessLog: AccessLogConfig{
+				Format:     "json",
+				MaxSizeMB:  100,
+				MaxBackups: 3,
+				SampleRate: 1,
+			},
+			OTLP: OTLPConfig{
+				Protocol:              "grpc",
+				Endpoint:              "localhost:4317",
+				Insecure:              true,
+				ExportIntervalSeconds: 30,
+				MaxSeries:             10000,
+				SeriesTTLSeconds:      3600,
+			},
+			Zipkin: ZipkinConfig{
+				Endpoint:              "http://localhost:9411/api/v2/spans",
+				ExportIntervalSeconds: 10,
+				InferenceDelaySeconds: 30,
+			},
+		},
+		ProcPath: "/proc",
+	}
+}
+
+// LoadConfig reads yaml config file, settings missing in the file keep default value
+func LoadConfig(path string) (*Config, error) {
+	result := NewConfig()
+	if path == "" {
+		return result, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read config %s: %s", path, err.Error())
+	}
+	err = yaml.Unmarshal(data, result)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse config %s: %s", path, err.Error())
+	}
+	return result, nil
+}
@@ -0,0 +1,131 @@
+package geoip
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/oschwald/maxminddb-golang"
+	"net"
+	"strconv"
+)
+
+// lookups of more ips are dropped when the cache is full
+const MAX_GEO_CACHE = 100000
+
+type GeoInfo struct {
+	//ISO 3166-1 country code, empty if unknown
+	Country string
+	//autonomous system number, empty if unknown
+	ASN string
+}
+
+type countryRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+type asnRecord struct {
+	AutonomousSystemNumber uint `maxminddb:"autonomous_system_number"`
+}
+
+// database is implemented by *maxminddb.Reader
+type database interface {
+	Lookup(ip net.IP, result interface{}) error
+	Close() error
+}
+
+// Resolver looks up country and ASN of ips from MaxMind-format databases, results are cached.
+// It is not safe for concurrent use
+type Resolver struct {
+	country database
+	asn     database
+	cache   map[string]*GeoInfo
+}
+
+func openDatabase(path string) (database, error) {
+	if path == "" {
+		return nil, nil
+	}
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open mmdb %s: %s", path, err.Error())
+	}
+	glog.Infof("Loaded %s database %s", reader.Metadata.DatabaseType, path)
+	return reader, nil
+}
+
+// NewResolver opens country and ASN databases, either path could be empty
+func NewResolver(countryPath string, asnPath string) (*Resolver, error) {
+	country, err := openDatabase(countryPath)
+	if err != nil {
+		return nil, err
+	}
+	asn, err := openDatabase(asnPath)
+	if err != nil {
+		if country != nil {
+			country.Close()
+		}
+		return nil, err
+	}
+	return newResolver(country, asn), nil
+}
+
+func newResolver(country database, asn database) *Resolver {
+	return &Resolver{
+		country: country,
+		asn:     asn,
+		cache:   make(map[string]*GeoInfo),
+	}
+}
+
+func (resolver *Resolver) lookup(netIp net.IP) *GeoInfo {
+	result := &GeoInfo{}
+	if resolver.country != nil {
+		var record countryRecord
+		if err := resolver.country.Lookup(netIp, &record); err != nil {
+			glog.Warningf("Failed to lookup country of %s: %s", netIp.String(), err.Error())
+		} else if record.Country.ISOCode != "" {
+			result.Country = record.Country.ISOCode
+		} else {
+			result.Country = record.RegisteredCountry.ISOCode
+		}
+	}
+	if resolver.asn != nil {
+		var record asnRecord
+		if err := resolver.asn.Lookup(netIp, &record); err != nil {
+			glog.Warningf("Failed to lookup asn of %s: %s", netIp.String(), err.Error())
+		} else if record.AutonomousSystemNumber > 0 {
+			result.ASN = strconv.FormatUint(uint64(record.AutonomousSystemNumber), 10)
+		}
+	}
+	return result
+}
+
+// Lookup returns country and ASN of an ip, nil if the ip is invalid
+func (resolver *Resolver) Lookup(ip string) *GeoInfo {
+	if result, ok := resolver.cache[ip]; ok {
+		return result
+	}
+	netIp := net.ParseIP(ip)
+	if netIp == nil {
+		return nil
+	}
+	result := resolver.lookup(netIp)
+	if len(resolver.cache) >= MAX_GEO_CACHE {
+		resolver.cache = make(map[string]*GeoInfo)
+	}
+	resolver.cache[ip] = result
+	return result
+}
+
+func (resolver *Resolver) Close() {
+	if resolver.country != nil {
+		resolver.country.Close()
+	}
+	if resolver.asn != nil {
+		resolver.asn.Close()
+	}
+}
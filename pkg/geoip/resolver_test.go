@@ -0,0 +1,59 @@
+package geoip
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+)
+
+type testDatabase struct {
+	countries map[string]string
+	asns      map[string]uint
+	lookups   int
+}
+
+func (db *testDatabase) Lookup(ip net.IP, result interface{}) error {
+	db.lookups++
+	switch record := result.(type) {
+	case *countryRecord:
+		record.RegisteredCountry.ISOCode = "ZZ"
+		record.Country.ISOCode = db.countries[ip.String()]
+	case *asnRecord:
+		record.AutonomousSystemNumber = db.asns[ip.String()]
+	}
+	return nil
+}
+
+func (db *testDatabase) Close() error {
+	return nil
+}
+
+func TestResolver(t *testing.T) {
+	_, err := NewResolver("/not/exist.mmdb", "")
+	assert.NotNil(t, err)
+
+	country := &testDatabase{countries: map[string]string{"1.2.3.4": "AU"}}
+	asn := &testDatabase{asns: map[string]uint{"1.2.3.4": 13335}}
+	resolver := newResolver(country, asn)
+
+	geo := resolver.Lookup("1.2.3.4")
+	assert.Equal(t, geo.Country, "AU")
+	assert.Equal(t, geo.ASN, "13335")
+
+	//registered country is used if country is unknown
+	geo = resolver.Lookup("5.6.7.8")
+	assert.Equal(t, geo.Country, "ZZ")
+	assert.Equal(t, geo.ASN, "")
+
+	assert.Nil(t, resolver.Lookup("invalid"))
+
+	//cached
+	resolver.Lookup("1.2.3.4")
+	assert.Equal(t, country.lookups, 2)
+	assert.Equal(t, asn.lookups, 2)
+
+	resolver = newResolver(nil, asn)
+	geo = resolver.Lookup("1.2.3.4")
+	assert.Equal(t, geo.Country, "")
+	assert.Equal(t, geo.ASN, "13335")
+}
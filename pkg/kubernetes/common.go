@@ -3,10 +3,18 @@ package kubernetes
 import (
 	"fmt"
 	"github.com/golang/glog"
+	"k8s.io/client-go/tools/cache"
+	"strings"
 )
 
 type ResourceType int
 
+const (
+	ANNOTATION_PREFIX          = "traffic-monitor.io/"
+	MONITOR_ENABLED_ANNOTATION = ANNOTATION_PREFIX + "enabled"
+	PROTOCOLS_ANNOTATION       = ANNOTATION_PREFIX + "protocols"
+)
+
 const (
 	SERVICE_TYPE    ResourceType = 1
 	DEPLOYMENT_TYPE ResourceType = 2
@@ -26,6 +34,12 @@ func (e ResourceType) String() string {
 	}
 }
 
+type labelKey struct {
+	namespace string
+	key       string
+	value     string
+}
+
 type ResourceInfoPointer interface {
 	GetSelector() map[string]string
 	Namespace() string
@@ -34,12 +48,34 @@ type ResourceInfoPointer interface {
 	String() string
 }
 
+// getMonitorAnnotations keeps only traffic-monitor annotations, so changes of other annotations are ignored
+func getMonitorAnnotations(annotations map[string]string) map[string]string {
+	var result map[string]string
+	for k, v := range annotations {
+		if strings.HasPrefix(k, ANNOTATION_PREFIX) {
+			if result == nil {
+				result = make(map[string]string)
+			}
+			result[k] = v
+		}
+	}
+	return result
+}
+
+// getDeletedObject unwraps the last known state of an object whose deletion was missed by the informer
+func getDeletedObject(obj interface{}) interface{} {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		return tombstone.Obj
+	}
+	return obj
+}
+
 func (manager *K8sResourceManager) addResource(resource ResourceInfoPointer) {
 	if glog.V(2) {
 		glog.Infof("add %s", resource.String())
 	}
 	for k, v := range resource.GetSelector() {
-		key := fmt.Sprintf("%s:%s:%s", resource.Namespace(), k, v)
+		key := labelKey{namespace: resource.Namespace(), key: k, value: v}
 
 		typeResourceMap := manager.labelTypeResourceMap[key]
 		if typeResourceMap == nil {
@@ -56,7 +92,7 @@ func (manager *K8sResourceManager) removeResource(resource ResourceInfoPointer)
 		glog.Infof("remove %s", resource.String())
 	}
 	for k, v := range resource.GetSelector() {
-		key := fmt.Sprintf("%s:%s:%s", resource.Namespace(), k, v)
+		key := labelKey{namespace: resource.Namespace(), key: k, value: v}
 
 		typeResourceMap := manager.labelTypeResourceMap[key]
 		if typeResourceMap == nil {
@@ -76,13 +112,11 @@ func (manager *K8sResourceManager) removeResource(resource ResourceInfoPointer)
 	}
 }
 
+// GetMatchedResources should only be called by event handlers, which hold the lock
 func (manager *K8sResourceManager) GetMatchedResources(resource ResourceInfoPointer, matchType ResourceType) []ResourceInfoPointer {
-	if !manager.IsLocked() {
-		panic("K8sResourceManager should be locked in GetMatchedResources()")
-	}
 	countMap := make(map[ResourceInfoPointer]*int)
 	for k, v := range resource.GetSelector() {
-		key := fmt.Sprintf("%s:%s:%s", resource.Namespace(), k, v)
+		key := labelKey{namespace: resource.Namespace(), key: k, value: v}
 		typeResourceMap := manager.labelTypeResourceMap[key]
 		if typeResourceMap == nil {
 			return nil
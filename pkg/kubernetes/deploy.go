@@ -2,23 +2,31 @@ package kubernetes
 
 import (
 	"fmt"
-	apps_v1beta1 "k8s.io/api/apps/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	"k8s.io/api/core/v1"
-	v1beta1 "k8s.io/api/extensions/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+// DeploymentInfo is a pod controller, could be a Deployment, DaemonSet, StatefulSet,
+// or any other kind found in pod's ownerReferences, e.g. Job, CronJob or argo Rollout
 type DeploymentInfo struct {
 	name        string
 	namespace   string
-	realType    string
+	kind        string
+	uid         string
+	owner       *metav1.OwnerReference
 	selector    map[string]string
 	Labels      map[string]string
+	Annotations map[string]string
 	Ports       []uint32
-	HostNetwork bool
+	//protocols from container port names
+	PortProtocols map[uint32]string
+	HostNetwork   bool
 }
 
 func (deployment *DeploymentInfo) String() string {
-	return fmt.Sprintf("%s %s@%s", deployment.realType, deployment.name, deployment.namespace)
+	return fmt.Sprintf("%s %s@%s", deployment.kind, deployment.name, deployment.namespace)
 }
 
 func (deployment *DeploymentInfo) GetSelector() map[string]string {
@@ -37,6 +45,14 @@ func (deployment *DeploymentInfo) Namespace() string {
 	return deployment.namespace
 }
 
+func (deployment *DeploymentInfo) Kind() string {
+	return deployment.kind
+}
+
+func (deployment *DeploymentInfo) UID() string {
+	return deployment.uid
+}
+
 func (deployment *DeploymentInfo) addPort(addedPort uint32) bool {
 	for _, port := range deployment.Ports {
 		if addedPort == port {
@@ -47,49 +63,67 @@ func (deployment *DeploymentInfo) addPort(addedPort uint32) bool {
 	return true
 }
 
-func NewDeploymentInfo(obj interface{}) *DeploymentInfo {
-	var result *DeploymentInfo
-	var template *v1.PodTemplateSpec
-
-	switch deployment := obj.(type) {
-	case *v1beta1.Deployment:
-		result = &DeploymentInfo{
-			name:      deployment.Name,
-			namespace: deployment.Namespace,
-			realType:  "Deployment",
-			Labels:    deployment.Labels,
-			selector:  deployment.Spec.Selector.MatchLabels,
-		}
-
-		template = &deployment.Spec.Template
-	case *v1beta1.DaemonSet:
-		result = &DeploymentInfo{
-			name:      deployment.Name,
-			namespace: deployment.Namespace,
-			realType:  "DaemonSet",
-			Labels:    deployment.Labels,
-			selector:  deployment.Spec.Selector.MatchLabels,
-		}
-		template = &deployment.Spec.Template
-	case *apps_v1beta1.StatefulSet:
-		result = &DeploymentInfo{
-			name:      deployment.Name,
-			namespace: deployment.Namespace,
-			realType:  "StatefulSet",
-			Labels:    deployment.Labels,
-			selector:  deployment.Spec.Selector.MatchLabels,
-		}
-		template = &deployment.Spec.Template
-	default:
-		panic(fmt.Sprintf("Unexpected type %T", obj))
-		return nil
+func newDeploymentInfo(kind string, meta *metav1.ObjectMeta, selector map[string]string, template *v1.PodTemplateSpec) *DeploymentInfo {
+	result := &DeploymentInfo{
+		name:        meta.Name,
+		namespace:   meta.Namespace,
+		kind:        kind,
+		uid:         string(meta.UID),
+		owner:       metav1.GetControllerOf(meta),
+		Labels:      meta.Labels,
+		Annotations: getMonitorAnnotations(meta.Annotations),
+		selector:    selector,
+	}
+	if template == nil {
+		return result
 	}
-
 	for _, container := range template.Spec.Containers {
 		for _, port := range container.Ports {
 			result.addPort(uint32(port.ContainerPort))
+			if protocol := getPortNameProtocol(port.Name); protocol != "" {
+				if result.PortProtocols == nil {
+					result.PortProtocols = make(map[uint32]string)
+				}
+				result.PortProtocols[uint32(port.ContainerPort)] = protocol
+			}
 		}
 	}
 	result.HostNetwork = template.Spec.HostNetwork
 	return result
 }
+
+// newOwnerDeploymentInfo creates DeploymentInfo for an owner which is not watched, ports are taken from its pod
+func newOwnerDeploymentInfo(pod *PodInfo, owner *metav1.OwnerReference) *DeploymentInfo {
+	return &DeploymentInfo{
+		name:          owner.Name,
+		namespace:     pod.namespace,
+		kind:          owner.Kind,
+		uid:           string(owner.UID),
+		Ports:         pod.Ports,
+		PortProtocols: pod.PortProtocols,
+		HostNetwork:   pod.HostNetwork,
+	}
+}
+
+func NewDeploymentInfo(obj interface{}) *DeploymentInfo {
+	switch deployment := obj.(type) {
+	case *appsv1.Deployment:
+		return newDeploymentInfo("Deployment", &deployment.ObjectMeta, deployment.Spec.Selector.MatchLabels, &deployment.Spec.Template)
+	case *appsv1.DaemonSet:
+		return newDeploymentInfo("DaemonSet", &deployment.ObjectMeta, deployment.Spec.Selector.MatchLabels, &deployment.Spec.Template)
+	case *appsv1.StatefulSet:
+		return newDeploymentInfo("StatefulSet", &deployment.ObjectMeta, deployment.Spec.Selector.MatchLabels, &deployment.Spec.Template)
+	case *appsv1.ReplicaSet:
+		return newDeploymentInfo("ReplicaSet", &deployment.ObjectMeta, deployment.Spec.Selector.MatchLabels, &deployment.Spec.Template)
+	case *batchv1.Job:
+		var selector map[string]string
+		if deployment.Spec.Selector != nil {
+			selector = deployment.Spec.Selector.MatchLabels
+		}
+		return newDeploymentInfo("Job", &deployment.ObjectMeta, selector, &deployment.Spec.Template)
+	case *v1.ReplicationController:
+		return newDeploymentInfo("ReplicationController", &deployment.ObjectMeta, deployment.Spec.Selector, deployment.Spec.Template)
+	default:
+		panic(fmt.Sprintf("Unexpected type %T", obj))
+	}
+}
@@ -1,13 +1,8 @@
 package kubernetes
 
 import (
-	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/client-go/tools/cache"
 	"reflect"
-	"time"
-
-	apps_v1beta1 "k8s.io/api/apps/v1beta1"
-	v1beta1 "k8s.io/api/extensions/v1beta1"
 )
 
 type DeploymentEventHandler interface {
@@ -21,14 +16,16 @@ func (manager *K8sResourceManager) DeploymentValid(deployment *DeploymentInfo) b
 	return true
 }
 func (manager *K8sResourceManager) DeploymentAdded(deployment *DeploymentInfo) {
-	manager.addResource(deployment)
+	manager.deploymentUIDMap[deployment.UID()] = deployment
+	manager.refreshOwnerEndpoints(deployment.UID())
 }
 func (manager *K8sResourceManager) DeploymentDeleted(deployment *DeploymentInfo) {
-	manager.removeResource(deployment)
+	delete(manager.deploymentUIDMap, deployment.UID())
+	manager.refreshOwnerEndpoints(deployment.UID())
 }
 func (manager *K8sResourceManager) DeploymentUpdated(oldDeployment, newDeployment *DeploymentInfo) {
-	manager.removeResource(oldDeployment)
-	manager.addResource(newDeployment)
+	manager.DeploymentDeleted(oldDeployment)
+	manager.DeploymentAdded(newDeployment)
 }
 
 func (manager *K8sResourceManager) getDeploymentEventHandler(handlers []DeploymentEventHandler) cache.ResourceEventHandlerFuncs {
@@ -47,7 +44,7 @@ func (manager *K8sResourceManager) getDeploymentEventHandler(handlers []Deployme
 
 		},
 		DeleteFunc: func(obj interface{}) {
-			deployment := NewDeploymentInfo(obj)
+			deployment := NewDeploymentInfo(getDeletedObject(obj))
 
 			manager.Lock()
 			defer manager.Unlock()
@@ -83,41 +80,32 @@ func (manager *K8sResourceManager) getDeploymentEventHandler(handlers []Deployme
 	}
 
 }
-func (manager *K8sResourceManager) WatchDeployments(stopper chan struct{}, handlers ...DeploymentEventHandler) {
-	watchlist := cache.NewListWatchFromClient(
-		manager.clientSet.ExtensionsV1beta1().RESTClient(), "deployments", "",
-		fields.Everything())
-	_, controller := cache.NewInformer(
-		watchlist,
-		&v1beta1.Deployment{},
-		time.Second*0,
-		manager.getDeploymentEventHandler(handlers),
-	)
-	controller.Run(stopper)
+func (manager *K8sResourceManager) WatchDeployments(handlers ...DeploymentEventHandler) {
+	manager.addEventHandler(manager.informerFactory.Apps().V1().Deployments().Informer(),
+		manager.getDeploymentEventHandler(handlers))
+}
+
+func (manager *K8sResourceManager) WatchStatefulSets(handlers ...DeploymentEventHandler) {
+	manager.addEventHandler(manager.informerFactory.Apps().V1().StatefulSets().Informer(),
+		manager.getDeploymentEventHandler(handlers))
+}
+
+func (manager *K8sResourceManager) WatchDaemonSets(handlers ...DeploymentEventHandler) {
+	manager.addEventHandler(manager.informerFactory.Apps().V1().DaemonSets().Informer(),
+		manager.getDeploymentEventHandler(handlers))
+}
+
+func (manager *K8sResourceManager) WatchReplicaSets(handlers ...DeploymentEventHandler) {
+	manager.addEventHandler(manager.informerFactory.Apps().V1().ReplicaSets().Informer(),
+		manager.getDeploymentEventHandler(handlers))
 }
 
-func (manager *K8sResourceManager) WatchStatefulSets(stopper chan struct{}, handlers ...DeploymentEventHandler) {
-	watchlist := cache.NewListWatchFromClient(
-		manager.clientSet.AppsV1beta1().RESTClient(), "statefulsets", "",
-		fields.Everything())
-	_, controller := cache.NewInformer(
-		watchlist,
-		&apps_v1beta1.StatefulSet{},
-		time.Second*0,
-		manager.getDeploymentEventHandler(handlers),
-	)
-	controller.Run(stopper)
+func (manager *K8sResourceManager) WatchJobs(handlers ...DeploymentEventHandler) {
+	manager.addEventHandler(manager.informerFactory.Batch().V1().Jobs().Informer(),
+		manager.getDeploymentEventHandler(handlers))
 }
 
-func (manager *K8sResourceManager) WatchDaemonSets(stopper chan struct{}, handlers ...DeploymentEventHandler) {
-	watchlist := cache.NewListWatchFromClient(
-		manager.clientSet.ExtensionsV1beta1().RESTClient(), "daemonsets", "",
-		fields.Everything())
-	_, controller := cache.NewInformer(
-		watchlist,
-		&v1beta1.DaemonSet{},
-		time.Second*0,
-		manager.getDeploymentEventHandler(handlers),
-	)
-	controller.Run(stopper)
+func (manager *K8sResourceManager) WatchReplicationControllers(handlers ...DeploymentEventHandler) {
+	manager.addEventHandler(manager.informerFactory.Core().V1().ReplicationControllers().Informer(),
+		manager.getDeploymentEventHandler(handlers))
 }
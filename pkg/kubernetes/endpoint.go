@@ -0,0 +1,468 @@
+package kubernetes
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"time"
+)
+
+const (
+	//how long an ip is remembered for its previous pods, packets and requests in flight are resolved within it
+	ENDPOINT_HISTORY_TTL = 60 * time.Second
+	MAX_ENDPOINT_HISTORY = 4
+)
+
+// nowNano is the clock of endpoint history, it should be the same clock as packet timestamps
+var nowNano = func() int64 {
+	return time.Now().UnixNano()
+}
+
+type resourceKey struct {
+	namespace string
+	name      string
+}
+
+func getResourceKey(resource ResourceInfoPointer) resourceKey {
+	return resourceKey{namespace: resource.Namespace(), name: resource.Name()}
+}
+
+// EndpointInfo is the precomputed lookup result of a pod ip, or of a node ip whose Pod is nil.
+// It is never modified once created, so packet handling can use it without holding the lock
+type EndpointInfo struct {
+	Pod        *PodInfo
+	Deployment *DeploymentInfo
+	Services   []*ServiceInfo
+	//protocol hints by container port
+	Protocols map[uint32]string
+	//traffic of the pod should not be monitored
+	Skip bool
+	//the pod is an ingress controller
+	IngressController bool
+	//uids on the owner chain, the endpoint is refreshed when one of them changes
+	owners []string
+}
+
+// HasPort checks if the endpoint listens on the port, a node listens on any port
+func (endpoint *EndpointInfo) HasPort(port uint32) bool {
+	if endpoint.Pod == nil {
+		return true
+	}
+	for _, deploymentPort := range endpoint.Deployment.Ports {
+		if deploymentPort == port {
+			return true
+		}
+	}
+	return false
+}
+
+// GetProtocol returns the protocol hint of a container port, empty if unknown
+func (endpoint *EndpointInfo) GetProtocol(port uint32) string {
+	return endpoint.Protocols[port]
+}
+
+func (endpoint *EndpointInfo) hasOwner(uid string) bool {
+	for _, owner := range endpoint.owners {
+		if owner == uid {
+			return true
+		}
+	}
+	return false
+}
+
+type endpointRecord struct {
+	endpoint  *EndpointInfo
+	validFrom int64
+	//0 if the pod still owns the ip
+	validUntil int64
+}
+
+// endpointHistory is the value of endpointIPMap, records are ordered from newest to oldest.
+// It is never modified once created, like EndpointInfo
+type endpointHistory struct {
+	records []endpointRecord
+}
+
+func (history *endpointHistory) current() *EndpointInfo {
+	if history == nil || len(history.records) == 0 || history.records[0].validUntil != 0 {
+		return nil
+	}
+	return history.records[0].endpoint
+}
+
+// at returns the endpoint which owned the ip at the given time.
+// A pod is only known after the informer notified it, so the current pod is returned if no record matches
+func (history *endpointHistory) at(timestampNano int64) *EndpointInfo {
+	if history == nil {
+		return nil
+	}
+	for _, record := range history.records {
+		if record.validFrom <= timestampNano && (record.validUntil == 0 || timestampNano < record.validUntil) {
+			return record.endpoint
+		}
+	}
+	return history.current()
+}
+
+// set returns a new history whose current record is the endpoint,
+// the record of the same pod is replaced, the one of another pod is closed
+func (history *endpointHistory) set(endpoint *EndpointInfo, now int64) *endpointHistory {
+	record := endpointRecord{endpoint: endpoint, validFrom: now}
+	result := &endpointHistory{}
+	current := history.current()
+	if current != nil && getResourceKey(current.Pod) == getResourceKey(endpoint.Pod) {
+		record.validFrom = history.records[0].validFrom
+		result.records = append(result.records, record)
+		result.records = append(result.records, history.records[1:]...)
+		return result
+	}
+	result.records = append(result.records, record)
+	return result.appendClosed(history, now)
+}
+
+// close returns a new history without current record, nil if no record is left
+func (history *endpointHistory) close(now int64) *endpointHistory {
+	result := (&endpointHistory{}).appendClosed(history, now)
+	if len(result.records) == 0 {
+		return nil
+	}
+	return result
+}
+
+// appendClosed appends records of the old history which are not expired, the current one is closed
+func (history *endpointHistory) appendClosed(old *endpointHistory, now int64) *endpointHistory {
+	if old == nil {
+		return history
+	}
+	for _, record := range old.records {
+		if record.validUntil == 0 {
+			record.validUntil = now
+		}
+		if record.validUntil+int64(ENDPOINT_HISTORY_TTL) <= now || len(history.records) >= MAX_ENDPOINT_HISTORY {
+			break
+		}
+		history.records = append(history.records, record)
+	}
+	return history
+}
+
+// resolveDeployment follows ownerReferences to the top level controller,
+// e.g. Pod->ReplicaSet->Deployment, Pod->Job->CronJob
+func (manager *K8sResourceManager) resolveDeployment(pod *PodInfo) (*DeploymentInfo, []string) {
+	owner := pod.Owner()
+	if owner == nil {
+		//bare pod is its own workload
+		return newOwnerDeploymentInfo(pod, &metav1.OwnerReference{Kind: "Pod", Name: pod.Name()}), nil
+	}
+
+	var result *DeploymentInfo
+	var owners []string
+	for depth := 0; owner != nil && depth < MAX_OWNER_DEPTH; depth++ {
+		owners = append(owners, string(owner.UID))
+		deployment := manager.deploymentUIDMap[string(owner.UID)]
+		if deployment == nil {
+			//owner is not watched, e.g. CronJob or custom controllers like argo Rollout
+			return newOwnerDeploymentInfo(pod, owner), owners
+		}
+		result = deployment
+		owner = deployment.owner
+	}
+	return result, owners
+}
+
+func (manager *K8sResourceManager) newEndpointInfo(pod *PodInfo) *EndpointInfo {
+	deployment, owners := manager.resolveDeployment(pod)
+	result := &EndpointInfo{
+		Pod:               pod,
+		Deployment:        deployment,
+		Skip:              !manager.policy.IsMonitored(pod, deployment, manager.namespaceMap[pod.Namespace()]),
+		owners:            owners,
+		IngressController: manager.ingressControllerSelector.Matches(labels.Set(pod.Labels)),
+	}
+	for _, service := range manager.GetMatchedResources(pod, SERVICE_TYPE) {
+		result.Services = append(result.Services, service.(*ServiceInfo))
+	}
+	result.Protocols = getEndpointProtocols(pod, deployment, result.Services)
+	return result
+}
+
+// getEndpointProtocols merges protocol hints, pod annotation wins over service appProtocol or port name,
+// which wins over container port name
+func getEndpointProtocols(pod *PodInfo, deployment *DeploymentInfo, services []*ServiceInfo) map[uint32]string {
+	result := make(map[uint32]string)
+	for port, protocol := range deployment.PortProtocols {
+		result[port] = protocol
+	}
+	for port, protocol := range pod.PortProtocols {
+		result[port] = protocol
+	}
+	for _, service := range services {
+		for _, port := range service.Ports {
+			if port.TargetPort > 0 && port.Protocol != "" {
+				result[port.TargetPort] = port.Protocol
+			}
+		}
+	}
+	for port, protocol := range pod.AnnotationProtocols {
+		result[port] = protocol
+	}
+	return result
+}
+
+func (manager *K8sResourceManager) getEndpointHistory(ip string) *endpointHistory {
+	value, ok := manager.endpointIPMap.Load(ip)
+	if !ok {
+		return nil
+	}
+	return value.(*endpointHistory)
+}
+
+// host network pods share the node ip, they are known by node ip and container port
+type hostPortKey struct {
+	ip   string
+	port uint32
+}
+
+func getHostPortKeys(pod *PodInfo) []hostPortKey {
+	var result []hostPortKey
+	for _, port := range pod.Ports {
+		result = append(result, hostPortKey{ip: pod.PodIP, port: port})
+	}
+	return result
+}
+
+func (manager *K8sResourceManager) getHostEndpoint(key hostPortKey) *EndpointInfo {
+	value, ok := manager.hostEndpointMap.Load(key)
+	if !ok {
+		return nil
+	}
+	return value.(*EndpointInfo)
+}
+
+func addPodIndex(index map[string]map[resourceKey]*PodInfo, key string, pod *PodInfo) {
+	pods := index[key]
+	if pods == nil {
+		pods = make(map[resourceKey]*PodInfo)
+		index[key] = pods
+	}
+	pods[getResourceKey(pod)] = pod
+}
+
+func removePodIndex(index map[string]map[resourceKey]*PodInfo, key string, podKey resourceKey) {
+	pods := index[key]
+	delete(pods, podKey)
+	if len(pods) == 0 {
+		delete(index, key)
+	}
+}
+
+func (manager *K8sResourceManager) indexPod(pod *PodInfo, owners []string) {
+	key := getResourceKey(pod)
+	manager.unindexPod(key)
+	for _, owner := range owners {
+		addPodIndex(manager.ownerPods, owner, pod)
+	}
+	addPodIndex(manager.namespacePods, pod.Namespace(), pod)
+	manager.podOwners[key] = owners
+}
+
+func (manager *K8sResourceManager) unindexPod(key resourceKey) {
+	for _, owner := range manager.podOwners[key] {
+		removePodIndex(manager.ownerPods, owner, key)
+	}
+	removePodIndex(manager.namespacePods, key.namespace, key)
+	delete(manager.podOwners, key)
+}
+
+func (manager *K8sResourceManager) refreshEndpoint(pod *PodInfo) *EndpointInfo {
+	endpoint := manager.newEndpointInfo(pod)
+	manager.indexPod(pod, endpoint.owners)
+	if pod.UID() != "" {
+		manager.podUIDMap.Store(pod.UID(), endpoint)
+	}
+	if pod.HostNetwork {
+		for _, key := range getHostPortKeys(pod) {
+			manager.hostEndpointMap.Store(key, endpoint)
+		}
+		return endpoint
+	}
+	manager.endpointIPMap.Store(pod.PodIP, manager.getEndpointHistory(pod.PodIP).set(endpoint, nowNano()))
+	return endpoint
+}
+
+// closeEndpoint keeps the ip's current endpoint in history
+func (manager *K8sResourceManager) closeEndpoint(ip string) {
+	history := manager.getEndpointHistory(ip).close(nowNano())
+	if history == nil {
+		manager.endpointIPMap.Delete(ip)
+	} else {
+		manager.endpointIPMap.Store(ip, history)
+	}
+}
+
+// purgeEndpointHistory removes ips whose pods are all deleted longer than ENDPOINT_HISTORY_TTL
+func (manager *K8sResourceManager) purgeEndpointHistory() {
+	now := nowNano()
+	if now-manager.lastPurgeNano < int64(ENDPOINT_HISTORY_TTL) {
+		return
+	}
+	manager.lastPurgeNano = now
+	manager.endpointIPMap.Range(func(key, value interface{}) bool {
+		if value.(*endpointHistory).current() == nil {
+			manager.closeEndpoint(key.(string))
+		}
+		return true
+	})
+}
+
+// rangeEndpoints iterates current endpoints
+func (manager *K8sResourceManager) rangeEndpoints(f func(endpoint *EndpointInfo)) {
+	manager.endpointIPMap.Range(func(key, value interface{}) bool {
+		if endpoint := value.(*endpointHistory).current(); endpoint != nil {
+			f(endpoint)
+		}
+		return true
+	})
+	visited := make(map[*EndpointInfo]bool)
+	manager.hostEndpointMap.Range(func(key, value interface{}) bool {
+		endpoint := value.(*EndpointInfo)
+		if !visited[endpoint] {
+			visited[endpoint] = true
+			f(endpoint)
+		}
+		return true
+	})
+}
+
+// refreshPods recomputes endpoints of the pods which are not replaced by a new pod of the same ip
+func (manager *K8sResourceManager) refreshPods(pods map[resourceKey]*PodInfo) {
+	//the index is changed by refreshEndpoint
+	var list []*PodInfo
+	for _, pod := range pods {
+		list = append(list, pod)
+	}
+	for _, pod := range list {
+		if manager.getPodEndpoint(pod) != nil {
+			manager.refreshEndpoint(pod)
+		}
+	}
+}
+
+// refreshOwnerEndpoints recomputes endpoints whose owner chain contains the given uid
+func (manager *K8sResourceManager) refreshOwnerEndpoints(uid string) {
+	manager.refreshPods(manager.ownerPods[uid])
+}
+
+func (manager *K8sResourceManager) refreshNamespaceEndpoints(namespace string) {
+	manager.refreshPods(manager.namespacePods[namespace])
+}
+
+func (manager *K8sResourceManager) getServicePods(key resourceKey) []*PodInfo {
+	value, ok := manager.servicePodMap.Load(key)
+	if !ok {
+		return nil
+	}
+	return value.([]*PodInfo)
+}
+
+func (manager *K8sResourceManager) addServiceEndpoints(service *ServiceInfo) {
+	var pods []*PodInfo
+	for _, pod := range manager.GetMatchedResources(service, POD_TYPE) {
+		pods = append(pods, pod.(*PodInfo))
+		manager.refreshEndpoint(pod.(*PodInfo))
+	}
+	manager.servicePodMap.Store(getResourceKey(service), pods)
+}
+
+func (manager *K8sResourceManager) removeServiceEndpoints(service *ServiceInfo) {
+	key := getResourceKey(service)
+	pods := manager.getServicePods(key)
+	manager.servicePodMap.Delete(key)
+	for _, pod := range pods {
+		manager.refreshEndpoint(pod)
+	}
+}
+
+func (manager *K8sResourceManager) addPodEndpoint(pod *PodInfo) {
+	endpoint := manager.refreshEndpoint(pod)
+	for _, service := range endpoint.Services {
+		key := getResourceKey(service)
+		//copy on write, readers may be iterating the old slice
+		pods := append([]*PodInfo(nil), manager.getServicePods(key)...)
+		manager.servicePodMap.Store(key, append(pods, pod))
+	}
+}
+
+// removeServicePods removes the pod from the pods of its services by key,
+// its endpoint may have been replaced by a new pod reusing the ip
+func (manager *K8sResourceManager) removeServicePods(pod *PodInfo) {
+	podKey := getResourceKey(pod)
+	for _, service := range manager.GetMatchedResources(pod, SERVICE_TYPE) {
+		key := getResourceKey(service)
+		existPods := manager.getServicePods(key)
+		var pods []*PodInfo
+		for _, existPod := range existPods {
+			if getResourceKey(existPod) == podKey {
+				continue
+			}
+			pods = append(pods, existPod)
+		}
+		if len(pods) != len(existPods) {
+			manager.servicePodMap.Store(key, pods)
+		}
+	}
+}
+
+func (manager *K8sResourceManager) getPodEndpoint(pod *PodInfo) *EndpointInfo {
+	var endpoint *EndpointInfo
+	if pod.HostNetwork {
+		if len(pod.Ports) > 0 {
+			endpoint = manager.getHostEndpoint(hostPortKey{ip: pod.PodIP, port: pod.Ports[0]})
+		}
+	} else {
+		endpoint = manager.GetEndpointFromIp(pod.PodIP)
+	}
+	if endpoint == nil || getResourceKey(endpoint.Pod) != getResourceKey(pod) {
+		return nil
+	}
+	return endpoint
+}
+
+func (manager *K8sResourceManager) removePodEndpoint(pod *PodInfo) {
+	manager.podUIDMap.Delete(pod.UID())
+	manager.unindexPod(getResourceKey(pod))
+	if manager.getPodEndpoint(pod) != nil {
+		manager.removeStaleEndpoint(pod, nil)
+	}
+	manager.removeServicePods(pod)
+}
+
+// removeStaleEndpoint removes ip or host ports of the old pod which are not used by the new pod
+func (manager *K8sResourceManager) removeStaleEndpoint(oldPod, newPod *PodInfo) {
+	if !oldPod.HostNetwork {
+		if newPod == nil || newPod.HostNetwork || oldPod.PodIP != newPod.PodIP {
+			manager.closeEndpoint(oldPod.PodIP)
+		}
+		return
+	}
+	newKeys := make(map[hostPortKey]bool)
+	if newPod != nil && newPod.HostNetwork {
+		for _, key := range getHostPortKeys(newPod) {
+			newKeys[key] = true
+		}
+	}
+	for _, key := range getHostPortKeys(oldPod) {
+		endpoint := manager.getHostEndpoint(key)
+		if !newKeys[key] && endpoint != nil && getResourceKey(endpoint.Pod) == getResourceKey(oldPod) {
+			manager.hostEndpointMap.Delete(key)
+		}
+	}
+}
+
+// updatePodEndpoint replaces the endpoint in place, so the pod ip is never missing for readers
+func (manager *K8sResourceManager) updatePodEndpoint(oldPod, newPod *PodInfo) {
+	if manager.getPodEndpoint(oldPod) != nil {
+		manager.removeStaleEndpoint(oldPod, newPod)
+	}
+	manager.removeServicePods(oldPod)
+	manager.addPodEndpoint(newPod)
+}
@@ -0,0 +1,187 @@
+package kubernetes
+
+import (
+	networkingv1 "k8s.io/api/networking/v1"
+	"sort"
+	"strings"
+)
+
+const (
+	INGRESS_PATH_EXACT  = "Exact"
+	INGRESS_PATH_PREFIX = "Prefix"
+)
+
+type IngressPathInfo struct {
+	//empty for the default backend
+	Path string
+	//Exact, Prefix or ImplementationSpecific, which is matched as string prefix
+	PathType    string
+	ServiceName string
+}
+
+type IngressRuleInfo struct {
+	//empty for any host, may start with "*." for a wildcard host
+	Host  string
+	Paths []*IngressPathInfo
+}
+
+type IngressInfo struct {
+	ResourceVersion string
+	name            string
+	namespace       string
+	Rules           []*IngressRuleInfo
+}
+
+func (ingress *IngressInfo) Name() string {
+	return ingress.name
+}
+
+func (ingress *IngressInfo) Namespace() string {
+	return ingress.namespace
+}
+
+func NewIngressInfo(ingress *networkingv1.Ingress) *IngressInfo {
+	result := &IngressInfo{
+		ResourceVersion: ingress.ResourceVersion,
+		name:            ingress.Name,
+		namespace:       ingress.Namespace,
+	}
+	for _, rule := range ingress.Spec.Rules {
+		if rule.HTTP == nil {
+			continue
+		}
+		ruleInfo := &IngressRuleInfo{Host: strings.ToLower(rule.Host)}
+		for _, path := range rule.HTTP.Paths {
+			pathInfo := &IngressPathInfo{
+				Path: path.Path,
+			}
+			if path.Backend.Service != nil {
+				pathInfo.ServiceName = path.Backend.Service.Name
+			}
+			if path.PathType != nil {
+				pathInfo.PathType = string(*path.PathType)
+			}
+			ruleInfo.Paths = append(ruleInfo.Paths, pathInfo)
+		}
+		result.Rules = append(result.Rules, ruleInfo)
+	}
+	if ingress.Spec.DefaultBackend != nil && ingress.Spec.DefaultBackend.Service != nil {
+		result.Rules = append(result.Rules, &IngressRuleInfo{
+			Paths: []*IngressPathInfo{{ServiceName: ingress.Spec.DefaultBackend.Service.Name}},
+		})
+	}
+	return result
+}
+
+// matchPath returns the length of the matched path, -1 if not matched
+func (path *IngressPathInfo) matchPath(requestPath string) int {
+	switch path.PathType {
+	case INGRESS_PATH_EXACT:
+		if requestPath == path.Path {
+			return len(path.Path)
+		}
+	case INGRESS_PATH_PREFIX:
+		//matched element by element, "/foo" matches "/foo/bar" but not "/foobar"
+		prefix := strings.TrimSuffix(path.Path, "/")
+		if prefix == "" || requestPath == prefix || strings.HasPrefix(requestPath, prefix+"/") {
+			return len(prefix)
+		}
+	default:
+		if strings.HasPrefix(requestPath, path.Path) {
+			return len(path.Path)
+		}
+	}
+	return -1
+}
+
+type ingressRoute struct {
+	ingress *IngressInfo
+	rule    *IngressRuleInfo
+	path    *IngressPathInfo
+}
+
+// ingressIndex maps hosts to ingress paths, it is copied on write like serviceIndex
+type ingressIndex struct {
+	hostRoutes map[string][]ingressRoute
+}
+
+func newIngressIndex() *ingressIndex {
+	return &ingressIndex{
+		hostRoutes: make(map[string][]ingressRoute),
+	}
+}
+
+func (index *ingressIndex) copy() *ingressIndex {
+	result := newIngressIndex()
+	for k, v := range index.hostRoutes {
+		result.hostRoutes[k] = v
+	}
+	return result
+}
+
+func (index *ingressIndex) add(info *IngressInfo) {
+	for _, rule := range info.Rules {
+		routes := append([]ingressRoute(nil), index.hostRoutes[rule.Host]...)
+		for _, path := range rule.Paths {
+			routes = append(routes, ingressRoute{ingress: info, rule: rule, path: path})
+		}
+		//exact path first when paths have the same length
+		sort.SliceStable(routes, func(i, j int) bool {
+			return routes[i].path.PathType == INGRESS_PATH_EXACT && routes[j].path.PathType != INGRESS_PATH_EXACT
+		})
+		index.hostRoutes[rule.Host] = routes
+	}
+}
+
+func (index *ingressIndex) remove(info *IngressInfo) {
+	for _, rule := range info.Rules {
+		var routes []ingressRoute
+		for _, route := range index.hostRoutes[rule.Host] {
+			if route.ingress.Name() == info.Name() && route.ingress.Namespace() == info.Namespace() {
+				continue
+			}
+			routes = append(routes, route)
+		}
+		if len(routes) == 0 {
+			delete(index.hostRoutes, rule.Host)
+		} else {
+			index.hostRoutes[rule.Host] = routes
+		}
+	}
+}
+
+func (index *ingressIndex) matchRoutes(routes []ingressRoute, requestPath string) *ingressRoute {
+	var result *ingressRoute
+	maxLength := -1
+	for i := range routes {
+		length := routes[i].path.matchPath(requestPath)
+		if length > maxLength {
+			maxLength = length
+			result = &routes[i]
+		}
+	}
+	return result
+}
+
+// match finds the ingress path of a request, exact host wins over wildcard host, which wins over rules without host
+func (index *ingressIndex) match(host string, url string) *ingressRoute {
+	host = strings.ToLower(host)
+	if i := strings.LastIndex(host, ":"); i >= 0 && !strings.HasSuffix(host, "]") {
+		host = host[:i]
+	}
+	requestPath := url
+	if i := strings.IndexAny(requestPath, "?#"); i >= 0 {
+		requestPath = requestPath[:i]
+	}
+	hosts := []string{host}
+	if i := strings.Index(host, "."); i >= 0 {
+		hosts = append(hosts, "*"+host[i:])
+	}
+	hosts = append(hosts, "")
+	for _, item := range hosts {
+		if route := index.matchRoutes(index.hostRoutes[item], requestPath); route != nil {
+			return route
+		}
+	}
+	return nil
+}
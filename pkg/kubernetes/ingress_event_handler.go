@@ -0,0 +1,95 @@
+package kubernetes
+
+import (
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/client-go/tools/cache"
+	"reflect"
+)
+
+type IngressEventHandler interface {
+	IngressValid(info *IngressInfo) bool
+	IngressAdded(info *IngressInfo)
+	IngressDeleted(info *IngressInfo)
+	IngressUpdated(oldIngress, newIngress *IngressInfo)
+}
+
+func (manager *K8sResourceManager) IngressValid(info *IngressInfo) bool {
+	return true
+}
+
+func (manager *K8sResourceManager) IngressAdded(info *IngressInfo) {
+	index := manager.getIngressIndex().copy()
+	index.add(info)
+	manager.ingressIndex.Store(index)
+}
+
+func (manager *K8sResourceManager) IngressDeleted(info *IngressInfo) {
+	index := manager.getIngressIndex().copy()
+	index.remove(info)
+	manager.ingressIndex.Store(index)
+}
+
+func (manager *K8sResourceManager) IngressUpdated(oldIngress, newIngress *IngressInfo) {
+	index := manager.getIngressIndex().copy()
+	index.remove(oldIngress)
+	index.add(newIngress)
+	manager.ingressIndex.Store(index)
+}
+
+func (manager *K8sResourceManager) WatchIngresses(handlers ...IngressEventHandler) {
+	manager.addEventHandler(manager.informerFactory.Networking().V1().Ingresses().Informer(),
+		cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				ingress := NewIngressInfo(obj.(*networkingv1.Ingress))
+
+				manager.Lock()
+				defer manager.Unlock()
+
+				for _, h := range handlers {
+					if h.IngressValid(ingress) {
+						h.IngressAdded(ingress)
+					}
+				}
+			},
+			DeleteFunc: func(obj interface{}) {
+				ingress := NewIngressInfo(getDeletedObject(obj).(*networkingv1.Ingress))
+
+				manager.Lock()
+				defer manager.Unlock()
+
+				for _, h := range handlers {
+					if h.IngressValid(ingress) {
+						h.IngressDeleted(ingress)
+					}
+				}
+			},
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				oldIngress := NewIngressInfo(oldObj.(*networkingv1.Ingress))
+				newIngress := NewIngressInfo(newObj.(*networkingv1.Ingress))
+
+				newVersion := newIngress.ResourceVersion
+				//ignore ResourceVersion diff
+				newIngress.ResourceVersion = oldIngress.ResourceVersion
+				if reflect.DeepEqual(oldIngress, newIngress) {
+					return
+				}
+
+				newIngress.ResourceVersion = newVersion
+				manager.Lock()
+				defer manager.Unlock()
+
+				for _, h := range handlers {
+					oldValid := h.IngressValid(oldIngress)
+					newValid := h.IngressValid(newIngress)
+					if !oldValid && newValid {
+						h.IngressAdded(newIngress)
+					} else if oldValid && !newValid {
+						h.IngressDeleted(oldIngress)
+					} else if oldValid && newValid {
+						h.IngressUpdated(oldIngress, newIngress)
+					}
+				}
+			},
+		},
+	)
+}
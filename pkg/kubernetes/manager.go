@@ -1,45 +1,115 @@
 package kubernetes
 
 import (
+	"context"
 	"fmt"
 	"github.com/golang/glog"
+	"github.com/luguoxiang/kubernetes-traffic-monitor/pkg/config"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/metadata"
+	"k8s.io/client-go/metadata/metadatainformer"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
 	"net"
 	"os"
+	"sort"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type ResourcesOnLabel map[ResourceType][]ResourceInfoPointer
 
+const MAX_OWNER_DEPTH = 8
+
 type K8sResourceManager struct {
-	podIPMap             map[string]*PodInfo
-	serviceIPMap         map[string]*ServiceInfo
-	labelTypeResourceMap map[string]ResourcesOnLabel
-	clientSet            kubernetes.Interface
-	mutex                *sync.RWMutex
-	locked               int32
+	serviceIndex         atomic.Value
+	ingressIndex         atomic.Value
+	labelTypeResourceMap map[labelKey]ResourcesOnLabel
+	deploymentUIDMap     map[string]*DeploymentInfo
+	namespaceMap         map[string]*NamespaceInfo
+	policy               *Policy
+	//pods of ingress controllers, their requests are attributed to ingresses
+	ingressControllerSelector labels.Selector
+	//pod ip to *endpointHistory
+	endpointIPMap sync.Map
+	lastPurgeNano int64
+	//pod uid to *EndpointInfo
+	podUIDMap sync.Map
+	//hostPortKey to *EndpointInfo of host network pods
+	hostEndpointMap sync.Map
+	//pods with endpoints by owner uid and by namespace, to refresh endpoints of a changed owner or namespace
+	ownerPods     map[string]map[resourceKey]*PodInfo
+	namespacePods map[string]map[resourceKey]*PodInfo
+	podOwners     map[resourceKey][]string
+	//node ip to *EndpointInfo of nodes, copied on write
+	nodeEndpoints   atomic.Value
+	nodeMap         map[string]*NodeInfo
+	servicePodMap   sync.Map
+	clientSet       kubernetes.Interface
+	metadataClient  metadata.Interface
+	resyncPeriod    time.Duration
+	informerFactory informers.SharedInformerFactory
+	//informers of pods in this node
+	nodeInformerFactory     informers.SharedInformerFactory
+	metadataInformerFactory metadatainformer.SharedInformerFactory
+	informersSynced         []cache.InformerSynced
+	remotePods              *remotePodIndex
+	mutex                   *sync.RWMutex
 
 	nodeIps         []string
 	podIpInThisNode string
 }
 
-func NewK8sResourceManager() (*K8sResourceManager, error) {
+func newK8sResourceManager(clientSet kubernetes.Interface, resyncPeriod time.Duration, policy *Policy) *K8sResourceManager {
+	result := &K8sResourceManager{
+		clientSet:            clientSet,
+		resyncPeriod:         resyncPeriod,
+		informerFactory:      informers.NewSharedInformerFactory(clientSet, resyncPeriod),
+		mutex:                &sync.RWMutex{},
+		labelTypeResourceMap: make(map[labelKey]ResourcesOnLabel),
+		deploymentUIDMap:     make(map[string]*DeploymentInfo),
+		namespaceMap:         make(map[string]*NamespaceInfo),
+		nodeMap:              make(map[string]*NodeInfo),
+		ownerPods:            make(map[string]map[resourceKey]*PodInfo),
+		namespacePods:        make(map[string]map[resourceKey]*PodInfo),
+		podOwners:            make(map[resourceKey][]string),
+		policy:               policy,
+	}
+	result.ingressControllerSelector = labels.Nothing()
+	result.serviceIndex.Store(newServiceIndex())
+	result.ingressIndex.Store(newIngressIndex())
+	result.nodeEndpoints.Store(make(map[string]*EndpointInfo))
+	return result
+}
+
+func NewK8sResourceManager(resyncPeriod time.Duration, policyConfig *config.PolicyConfig) (*K8sResourceManager, error) {
 
-	clientSet, err := getK8sClientSet()
+	restConfig, err := getK8sConfig()
+	if err != nil {
+		return nil, err
+	}
+	clientSet, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, err
+	}
+	metadataClient, err := metadata.NewForConfig(restConfig)
 	if err != nil {
 		return nil, err
 	}
 
-	result := &K8sResourceManager{
-		clientSet: clientSet,
-
-		mutex: &sync.RWMutex{},
+	policy, err := NewPolicy(policyConfig)
+	if err != nil {
+		return nil, err
 	}
 
+	result := newK8sResourceManager(clientSet, resyncPeriod, policy)
+	result.metadataClient = metadataClient
+
 	ifaces, err := net.Interfaces()
 	if err != nil {
 		return nil, fmt.Errorf("Failed to get Interfaces: %s", err.Error())
@@ -64,76 +134,213 @@ func NewK8sResourceManager() (*K8sResourceManager, error) {
 		}
 	}
 
-	result.podIPMap = make(map[string]*PodInfo)
-	result.serviceIPMap = make(map[string]*ServiceInfo)
-	result.labelTypeResourceMap = make(map[string]ResourcesOnLabel)
 	return result, nil
 }
+
+func (manager *K8sResourceManager) addEventHandler(informer cache.SharedIndexInformer, handler cache.ResourceEventHandler) {
+	informer.AddEventHandler(handler)
+	manager.informersSynced = append(manager.informersSynced, informer.HasSynced)
+}
+
+// Start runs the informers of all Watch* calls made before
+func (manager *K8sResourceManager) Start(stopper <-chan struct{}) {
+	manager.informerFactory.Start(stopper)
+	if manager.nodeInformerFactory != nil {
+		manager.nodeInformerFactory.Start(stopper)
+	}
+	if manager.metadataInformerFactory != nil {
+		manager.metadataInformerFactory.Start(stopper)
+	}
+}
+
+// WaitForCacheSync blocks until all started informers have listed their resources
+func (manager *K8sResourceManager) WaitForCacheSync(stopper <-chan struct{}) bool {
+	return cache.WaitForCacheSync(stopper, manager.informersSynced...)
+}
+
 func (manager *K8sResourceManager) NewCond() *sync.Cond {
 	return sync.NewCond(manager.mutex)
 }
 func (manager *K8sResourceManager) Lock() {
 	manager.mutex.Lock()
-	atomic.AddInt32(&manager.locked, 1)
 }
 func (manager *K8sResourceManager) Unlock() {
-	atomic.StoreInt32(&manager.locked, 0)
 	manager.mutex.Unlock()
 }
 
-func (manager *K8sResourceManager) IsLocked() bool {
-	return atomic.LoadInt32(&manager.locked) != 0
+func (manager *K8sResourceManager) GetPodsForService(service *ServiceInfo) []*PodInfo {
+	return manager.getServicePods(getResourceKey(service))
 }
 
-func (manager *K8sResourceManager) GetPodsForService(service *ServiceInfo) []*PodInfo {
-	manager.Lock()
-	defer manager.Unlock()
+func (manager *K8sResourceManager) GetPodDeployment(pod *PodInfo) *DeploymentInfo {
+	if pod == nil {
+		return nil
+	}
 
-	pods := manager.GetMatchedResources(service, POD_TYPE)
+	endpoint := manager.GetEndpointFromIp(pod.PodIP)
+	if endpoint != nil && endpoint.Pod == pod {
+		return endpoint.Deployment
+	}
 
-	var result []*PodInfo
-	for _, pod := range pods {
-		result = append(result, pod.(*PodInfo))
+	manager.mutex.RLock()
+	defer manager.mutex.RUnlock()
+
+	deployment, _ := manager.resolveDeployment(pod)
+	return deployment
+}
+
+func (manager *K8sResourceManager) GetPodFromIp(ip string) *PodInfo {
+	endpoint := manager.GetEndpointFromIp(ip)
+	if endpoint == nil {
+		return nil
 	}
-	return result
+	return endpoint.Pod
 }
 
-func (manager *K8sResourceManager) GetPodDeployment(pod *PodInfo) *DeploymentInfo {
-	if pod == nil {
+// GetEndpointFromIp returns pod, workload and services of a pod ip, it does not wait for the lock
+func (manager *K8sResourceManager) GetEndpointFromIp(ip string) *EndpointInfo {
+	return manager.getEndpointHistory(ip).current()
+}
+
+// GetEndpointFromIpAt resolves a pod ip at the time of a packet,
+// a reused ip is still resolved to its previous pod for packets before the reuse
+func (manager *K8sResourceManager) GetEndpointFromIpAt(ip string, timestampNano int64) *EndpointInfo {
+	return manager.getEndpointHistory(ip).at(timestampNano)
+}
+
+// GetEndpointFromAddressAt resolves a pod ip, a host network pod by node ip and port,
+// or falls back to the node itself. Unmonitored host network pods also fall back to the node
+func (manager *K8sResourceManager) GetEndpointFromAddressAt(ip string, port uint32, timestampNano int64) *EndpointInfo {
+	if endpoint := manager.GetEndpointFromIpAt(ip, timestampNano); endpoint != nil {
+		return endpoint
+	}
+	hostEndpoint := manager.getHostEndpoint(hostPortKey{ip: ip, port: port})
+	if hostEndpoint != nil && !hostEndpoint.Skip {
+		return hostEndpoint
+	}
+	if endpoint := manager.getNodeEndpoints()[ip]; endpoint != nil {
+		return endpoint
+	}
+	return hostEndpoint
+}
+
+// GetEndpointFromPodUID returns the endpoint of a pod found by its process
+func (manager *K8sResourceManager) GetEndpointFromPodUID(uid string) *EndpointInfo {
+	value, ok := manager.podUIDMap.Load(uid)
+	if !ok {
 		return nil
 	}
-	manager.Lock()
-	defer manager.Unlock()
+	return value.(*EndpointInfo)
+}
 
-	resources := manager.GetMatchedResources(pod, DEPLOYMENT_TYPE)
-	var result *DeploymentInfo
-	for _, resource := range resources {
-		if result == nil || len(result.GetSelector()) < len(resource.GetSelector()) {
-			//return matched deployment which has max number of selectors
-			result = resource.(*DeploymentInfo)
+func (manager *K8sResourceManager) getNodeEndpoints() map[string]*EndpointInfo {
+	return manager.nodeEndpoints.Load().(map[string]*EndpointInfo)
+}
+
+// GetProtocolPorts returns container ports which have a protocol hint other than http
+func (manager *K8sResourceManager) GetProtocolPorts() []uint32 {
+	portMap := make(map[uint32]bool)
+	manager.rangeEndpoints(func(endpoint *EndpointInfo) {
+		for port, protocol := range endpoint.Protocols {
+			if protocol != PROTOCOL_HTTP {
+				portMap[port] = true
+			}
 		}
+	})
+	var result []uint32
+	for port := range portMap {
+		result = append(result, port)
 	}
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
 	return result
 }
 
-func (manager *K8sResourceManager) GetPodFromIp(ip string) *PodInfo {
-	manager.Lock()
-	defer manager.Unlock()
+func (manager *K8sResourceManager) getServiceIndex() *serviceIndex {
+	return manager.serviceIndex.Load().(*serviceIndex)
+}
+
+func (manager *K8sResourceManager) getIngressIndex() *ingressIndex {
+	return manager.ingressIndex.Load().(*ingressIndex)
+}
+
+// GetIngress returns the ingress, rule and path which route the request, nil if not found
+func (manager *K8sResourceManager) GetIngress(host string, url string) (*IngressInfo, *IngressRuleInfo, *IngressPathInfo) {
+	route := manager.getIngressIndex().match(host, url)
+	if route == nil {
+		return nil, nil, nil
+	}
+	return route.ingress, route.rule, route.path
+}
 
-	return manager.podIPMap[ip]
+// SetIngressControllerSelector sets the label selector of ingress controller pods, it should be called before watching pods
+func (manager *K8sResourceManager) SetIngressControllerSelector(selector string) error {
+	result, err := labels.Parse(selector)
+	if err != nil {
+		return fmt.Errorf("Invalid ingress controller selector '%s': %s", selector, err.Error())
+	}
+	if result.Empty() {
+		result = labels.Nothing()
+	}
+	manager.ingressControllerSelector = result
+	return nil
 }
 
 func (manager *K8sResourceManager) GetPodIpInThisNode() string {
 	return manager.podIpInThisNode
 }
 func (manager *K8sResourceManager) GetServiceFromClusterIp(ip string) *ServiceInfo {
-	manager.Lock()
-	defer manager.Unlock()
+	return manager.getServiceIndex().clusterIPMap[ip]
+}
+
+// GetExternalNameServices returns ExternalName services of a dns name
+func (manager *K8sResourceManager) GetExternalNameServices(name string) []*ServiceInfo {
+	return manager.getServiceIndex().externalNameMap[normalizeDnsName(name)]
+}
 
-	return manager.serviceIPMap[ip]
+// IsLocalIp checks ips of this node
+func (manager *K8sResourceManager) IsLocalIp(ip string) bool {
+	for _, nodeIp := range manager.nodeIps {
+		if nodeIp == ip {
+			return true
+		}
+	}
+	return false
 }
 
-func getK8sClientSet() (kubernetes.Interface, error) {
+// IsNodeIp checks ips of this node and ips of nodes in the cluster
+func (manager *K8sResourceManager) IsNodeIp(ip string) bool {
+	return manager.IsLocalIp(ip) || manager.getNodeEndpoints()[ip] != nil
+}
+
+// GetServiceFromAddress returns the service exposed on ip:port, the address could be
+// a cluster ip, an external ip, a load balancer ip or a node port on this node
+func (manager *K8sResourceManager) GetServiceFromAddress(ip string, port uint32) (*ServiceInfo, *ServicePortInfo) {
+	index := manager.getServiceIndex()
+
+	service := index.clusterIPMap[ip]
+	if service != nil {
+		return service, service.GetPort(port)
+	}
+
+	services := index.entryIPMap[ip]
+	for _, service := range services {
+		portInfo := service.GetPort(port)
+		if portInfo != nil {
+			return service, portInfo
+		}
+	}
+	if len(services) > 0 {
+		return services[0], nil
+	}
+
+	service = index.nodePortMap[port]
+	if service != nil && manager.IsNodeIp(ip) {
+		return service, service.GetNodePort(port)
+	}
+	return nil, nil
+}
+
+func getK8sConfig() (*rest.Config, error) {
 	configPath := os.Getenv("KUBECONFIG")
 
 	var config *rest.Config
@@ -145,16 +352,11 @@ func getK8sClientSet() (kubernetes.Interface, error) {
 		glog.Infof("KUBECONFIG:%s\n", configPath)
 		config, err = clientcmd.BuildConfigFromFlags("", configPath)
 	}
-	if err != nil {
-		return nil, err
-	}
-
-	// create the clientset
-	return kubernetes.NewForConfig(config)
+	return config, err
 }
 
 func (manager *K8sResourceManager) GetK8sIP() string {
-	service, err := manager.clientSet.CoreV1().Services("default").Get("kubernetes", metav1.GetOptions{})
+	service, err := manager.clientSet.CoreV1().Services("default").Get(context.TODO(), "kubernetes", metav1.GetOptions{})
 	if err != nil {
 		return ""
 	}
@@ -1,25 +1,34 @@
 package kubernetes
 
 import (
+	"fmt"
+	"github.com/luguoxiang/kubernetes-traffic-monitor/pkg/config"
 	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
-	v1beta1 "k8s.io/api/extensions/v1beta1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	networkingv1 "k8s.io/api/networking/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/client-go/kubernetes/fake"
-	"sync"
 	"testing"
+	"time"
 )
 
-func TestWatch(t *testing.T) {
-	k8sManager := &K8sResourceManager{
-		clientSet:            fake.NewSimpleClientset(),
-		mutex:                &sync.RWMutex{},
-		nodeIps:              []string{"12.1.1.1"},
-		podIPMap:             make(map[string]*PodInfo),
-		serviceIPMap:         make(map[string]*ServiceInfo),
-		labelTypeResourceMap: make(map[string]ResourcesOnLabel),
+var isController = true
+
+func newTestPolicy() *Policy {
+	policy, err := NewPolicy(&config.NewConfig().Policy)
+	if err != nil {
+		panic(err.Error())
 	}
+	return policy
+}
+
+func TestWatch(t *testing.T) {
+	k8sManager := newK8sResourceManager(fake.NewSimpleClientset(), 0, newTestPolicy())
+	k8sManager.nodeIps = []string{"12.1.1.1"}
 
 	var pod corev1.Pod
 	pod.Name = "test-pod"
@@ -27,6 +36,7 @@ func TestWatch(t *testing.T) {
 	pod.Labels = map[string]string{"a": "b", "c": "d"}
 	pod.Status.PodIP = "10.1.1.1"
 	pod.Status.HostIP = "12.1.1.1"
+	pod.OwnerReferences = []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "test-deploy-1", UID: "rs-uid", Controller: &isController}}
 
 	k8sManager.PodAdded(NewPodInfo(&pod))
 	podInfo := k8sManager.GetPodFromIp("10.1.1.1")
@@ -62,22 +72,53 @@ func TestWatch(t *testing.T) {
 	assert.Equal(t, len(pods), 1)
 	assert.Equal(t, pods[0], podInfo)
 
-	var deploy v1beta1.Deployment
+	endpoint := k8sManager.GetEndpointFromIp("10.1.1.1")
+	assert.NotNil(t, endpoint)
+	assert.Equal(t, endpoint.Pod, podInfo)
+	assert.Equal(t, len(endpoint.Services), 1)
+	assert.Equal(t, endpoint.Services[0].Name(), "test-service")
+
+	var deploy appsv1.Deployment
 	deploy.Name = "test-deploy"
 	deploy.Namespace = "test-ns"
+	deploy.UID = "deploy-uid"
 	deploy.Spec.Selector = &metav1.LabelSelector{MatchLabels: map[string]string{"a": "b"}}
 
+	var replicaSet appsv1.ReplicaSet
+	replicaSet.Name = "test-deploy-1"
+	replicaSet.Namespace = "test-ns"
+	replicaSet.UID = "rs-uid"
+	replicaSet.OwnerReferences = []metav1.OwnerReference{{Kind: "Deployment", Name: "test-deploy", UID: "deploy-uid", Controller: &isController}}
+	replicaSet.Spec.Selector = &metav1.LabelSelector{MatchLabels: map[string]string{"a": "b"}}
+
+	//another workload with overlapping selector should not be matched
+	var otherDeploy appsv1.Deployment
+	otherDeploy.Name = "other-deploy"
+	otherDeploy.Namespace = "test-ns"
+	otherDeploy.UID = "other-uid"
+	otherDeploy.Spec.Selector = &metav1.LabelSelector{MatchLabels: map[string]string{"a": "b", "c": "d"}}
+
 	k8sManager.DeploymentAdded(NewDeploymentInfo(&deploy))
+	k8sManager.DeploymentAdded(NewDeploymentInfo(&replicaSet))
+	k8sManager.DeploymentAdded(NewDeploymentInfo(&otherDeploy))
 	deployment := k8sManager.GetPodDeployment(podInfo)
 
 	assert.NotNil(t, deployment)
 	assert.Equal(t, deployment.Name(), "test-deploy")
 	assert.Equal(t, deployment.Namespace(), "test-ns")
+	assert.Equal(t, deployment.Kind(), "Deployment")
+	assert.Equal(t, k8sManager.GetEndpointFromIp("10.1.1.1").Deployment, deployment)
 
 	k8sManager.DeploymentDeleted(NewDeploymentInfo(&deploy))
 
+	//owner is unknown, use the owner reference
 	deployment = k8sManager.GetPodDeployment(podInfo)
-	assert.Nil(t, deployment)
+	assert.NotNil(t, deployment)
+	assert.Equal(t, deployment.Name(), "test-deploy")
+	assert.Equal(t, deployment.Kind(), "Deployment")
+
+	k8sManager.DeploymentDeleted(NewDeploymentInfo(&replicaSet))
+	k8sManager.DeploymentDeleted(NewDeploymentInfo(&otherDeploy))
 
 	k8sManager.PodDeleted(NewPodInfo(&pod))
 	podInfo = k8sManager.GetPodFromIp("10.1.1.1")
@@ -92,3 +133,572 @@ func TestWatch(t *testing.T) {
 	assert.Nil(t, serviceInfo)
 
 }
+
+func TestServiceAddress(t *testing.T) {
+	k8sManager := newK8sResourceManager(fake.NewSimpleClientset(), 0, newTestPolicy())
+	k8sManager.nodeIps = []string{"12.1.1.1"}
+
+	var service corev1.Service
+	service.Name = "test-service"
+	service.Namespace = "test-ns"
+	service.Spec.Selector = map[string]string{"c": "d"}
+	service.Spec.ClusterIP = "11.1.1.1"
+	service.Spec.ExternalIPs = []string{"13.1.1.1"}
+	service.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: "14.1.1.1"}, {Hostname: "test.elb.com"}}
+	service.Spec.Ports = []corev1.ServicePort{{Name: "http", Port: 123, NodePort: 30123, TargetPort: intstr.IntOrString{Type: intstr.Int, IntVal: 456}}}
+
+	k8sManager.ServiceAdded(NewServiceInfo(&service))
+
+	for _, address := range []struct {
+		ip   string
+		port uint32
+	}{{"11.1.1.1", 123}, {"13.1.1.1", 123}, {"14.1.1.1", 123}, {"12.1.1.1", 30123}} {
+		serviceInfo, portInfo := k8sManager.GetServiceFromAddress(address.ip, address.port)
+		assert.NotNil(t, serviceInfo)
+		assert.Equal(t, serviceInfo.Name(), "test-service")
+		assert.NotNil(t, portInfo)
+		assert.Equal(t, portInfo.TargetPort, uint32(456))
+	}
+
+	serviceInfo, portInfo := k8sManager.GetServiceFromAddress("14.1.1.1", 124)
+	assert.NotNil(t, serviceInfo)
+	assert.Nil(t, portInfo)
+
+	//node port on a non-node ip
+	serviceInfo, portInfo = k8sManager.GetServiceFromAddress("15.1.1.1", 30123)
+	assert.Nil(t, serviceInfo)
+	assert.Nil(t, portInfo)
+
+	k8sManager.ServiceDeleted(NewServiceInfo(&service))
+	for _, ip := range []string{"11.1.1.1", "13.1.1.1", "14.1.1.1"} {
+		serviceInfo, _ = k8sManager.GetServiceFromAddress(ip, 123)
+		assert.Nil(t, serviceInfo)
+	}
+	serviceInfo, _ = k8sManager.GetServiceFromAddress("12.1.1.1", 30123)
+	assert.Nil(t, serviceInfo)
+}
+
+func TestExternalNameService(t *testing.T) {
+	k8sManager := newK8sResourceManager(fake.NewSimpleClientset(), 0, newTestPolicy())
+
+	var service corev1.Service
+	service.Name = "partner-api"
+	service.Namespace = "test-ns"
+	service.Spec.Type = corev1.ServiceTypeExternalName
+	service.Spec.ExternalName = "API.Partner.com."
+	k8sManager.ServiceAdded(NewServiceInfo(&service))
+
+	services := k8sManager.GetExternalNameServices("api.partner.com")
+	assert.Equal(t, len(services), 1)
+	assert.Equal(t, services[0].Name(), "partner-api")
+	assert.Equal(t, len(k8sManager.GetExternalNameServices("api.partner.com.")), 1)
+	assert.Nil(t, k8sManager.GetServiceFromClusterIp(""))
+
+	k8sManager.ServiceDeleted(NewServiceInfo(&service))
+	assert.Equal(t, len(k8sManager.GetExternalNameServices("api.partner.com")), 0)
+}
+
+func TestPodOwner(t *testing.T) {
+	k8sManager := newK8sResourceManager(fake.NewSimpleClientset(), 0, newTestPolicy())
+
+	var job batchv1.Job
+	job.Name = "test-cron-123"
+	job.Namespace = "test-ns"
+	job.UID = "job-uid"
+	job.OwnerReferences = []metav1.OwnerReference{{Kind: "CronJob", Name: "test-cron", UID: "cron-uid", Controller: &isController}}
+	k8sManager.DeploymentAdded(NewDeploymentInfo(&job))
+
+	var pod corev1.Pod
+	pod.Name = "test-cron-123-abc"
+	pod.Namespace = "test-ns"
+	pod.Status.PodIP = "10.1.1.1"
+	pod.OwnerReferences = []metav1.OwnerReference{{Kind: "Job", Name: "test-cron-123", UID: "job-uid", Controller: &isController}}
+	pod.Spec.Containers = []corev1.Container{{Ports: []corev1.ContainerPort{{ContainerPort: 8080}}}}
+
+	deployment := k8sManager.GetPodDeployment(NewPodInfo(&pod))
+	assert.NotNil(t, deployment)
+	assert.Equal(t, deployment.Name(), "test-cron")
+	assert.Equal(t, deployment.Kind(), "CronJob")
+	assert.Equal(t, deployment.Namespace(), "test-ns")
+	assert.Equal(t, deployment.Ports, []uint32{8080})
+
+	//bare pod
+	pod.OwnerReferences = nil
+	deployment = k8sManager.GetPodDeployment(NewPodInfo(&pod))
+	assert.NotNil(t, deployment)
+	assert.Equal(t, deployment.Name(), "test-cron-123-abc")
+	assert.Equal(t, deployment.Kind(), "Pod")
+}
+
+func TestInformer(t *testing.T) {
+	deploy := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-deploy", Namespace: "test-ns", UID: "deploy-uid"},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"a": "b"}},
+		},
+	}
+	replicaSet := &appsv1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-deploy-1", Namespace: "test-ns", UID: "rs-uid",
+			OwnerReferences: []metav1.OwnerReference{{Kind: "Deployment", Name: "test-deploy", UID: "deploy-uid", Controller: &isController}}},
+		Spec: appsv1.ReplicaSetSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"a": "b"}},
+		},
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-pod", Namespace: "test-ns", Labels: map[string]string{"a": "b"},
+			OwnerReferences: []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "test-deploy-1", UID: "rs-uid", Controller: &isController}}},
+		Status: corev1.PodStatus{PodIP: "10.1.1.1", HostIP: "12.1.1.1"},
+	}
+	k8sManager := newK8sResourceManager(fake.NewSimpleClientset(deploy, replicaSet, pod), 0, newTestPolicy())
+
+	k8sManager.WatchPods(k8sManager)
+	k8sManager.WatchDeployments(k8sManager)
+	k8sManager.WatchReplicaSets(k8sManager)
+
+	stopper := make(chan struct{})
+	defer close(stopper)
+	k8sManager.Start(stopper)
+	assert.True(t, k8sManager.WaitForCacheSync(stopper))
+
+	podInfo := k8sManager.GetPodFromIp("10.1.1.1")
+	assert.NotNil(t, podInfo)
+	deployment := k8sManager.GetPodDeployment(podInfo)
+	assert.NotNil(t, deployment)
+	assert.Equal(t, deployment.Name(), "test-deploy")
+	assert.Equal(t, deployment.Kind(), "Deployment")
+}
+
+func newBenchmarkManager(podIps []string) *K8sResourceManager {
+	k8sManager := newK8sResourceManager(fake.NewSimpleClientset(), 0, newTestPolicy())
+	k8sManager.Lock()
+	defer k8sManager.Unlock()
+
+	var replicaSet appsv1.ReplicaSet
+	replicaSet.Name = "bench-deploy-1"
+	replicaSet.Namespace = "bench-ns"
+	replicaSet.UID = "rs-uid"
+	replicaSet.Spec.Selector = &metav1.LabelSelector{MatchLabels: map[string]string{"app": "bench"}}
+	k8sManager.DeploymentAdded(NewDeploymentInfo(&replicaSet))
+
+	var service corev1.Service
+	service.Name = "bench-service"
+	service.Namespace = "bench-ns"
+	service.Spec.Selector = map[string]string{"app": "bench"}
+	service.Spec.ClusterIP = "11.1.1.1"
+	k8sManager.ServiceAdded(NewServiceInfo(&service))
+
+	for i, ip := range podIps {
+		var pod corev1.Pod
+		pod.Name = fmt.Sprintf("bench-pod-%d", i)
+		pod.Namespace = "bench-ns"
+		pod.Labels = map[string]string{"app": "bench"}
+		pod.Status.PodIP = ip
+		pod.OwnerReferences = []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "bench-deploy-1", UID: "rs-uid", Controller: &isController}}
+		k8sManager.PodAdded(NewPodInfo(&pod))
+	}
+	return k8sManager
+}
+
+func getBenchmarkPodIps() []string {
+	var result []string
+	for i := 0; i < 1000; i++ {
+		result = append(result, fmt.Sprintf("10.1.%d.%d", i/256, i%256))
+	}
+	return result
+}
+
+func runEndpointBenchmark(b *testing.B, k8sManager *K8sResourceManager, podIps []string) {
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			endpoint := k8sManager.GetEndpointFromIp(podIps[i%len(podIps)])
+			if endpoint == nil || endpoint.Deployment == nil {
+				b.Fatal("endpoint not found")
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkGetEndpointFromIp(b *testing.B) {
+	podIps := getBenchmarkPodIps()
+	runEndpointBenchmark(b, newBenchmarkManager(podIps), podIps)
+}
+
+// BenchmarkGetEndpointFromIpWithUpdates keeps updating pods like informers do while looking up endpoints
+func BenchmarkGetEndpointFromIpWithUpdates(b *testing.B) {
+	podIps := getBenchmarkPodIps()
+	k8sManager := newBenchmarkManager(podIps)
+
+	stopper := make(chan struct{})
+	defer close(stopper)
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-stopper:
+				return
+			default:
+			}
+			endpoint := k8sManager.GetEndpointFromIp(podIps[i%len(podIps)])
+			k8sManager.Lock()
+			k8sManager.PodUpdated(endpoint.Pod, endpoint.Pod)
+			k8sManager.Unlock()
+		}
+	}()
+
+	runEndpointBenchmark(b, k8sManager, podIps)
+}
+
+func TestPolicy(t *testing.T) {
+	policy, err := NewPolicy(&config.PolicyConfig{
+		ExcludeNamespaces: []string{"kube-system"},
+		PodSelector:       "tier!=db",
+	})
+	assert.Nil(t, err)
+	k8sManager := newK8sResourceManager(fake.NewSimpleClientset(), 0, policy)
+
+	newPod := func(name string, namespace string, ip string, labels map[string]string, annotations map[string]string) *PodInfo {
+		var pod corev1.Pod
+		pod.Name = name
+		pod.Namespace = namespace
+		pod.Labels = labels
+		pod.Annotations = annotations
+		pod.Status.PodIP = ip
+		return NewPodInfo(&pod)
+	}
+
+	k8sManager.PodAdded(newPod("web", "test-ns", "10.1.1.1", map[string]string{"tier": "web"}, nil))
+	k8sManager.PodAdded(newPod("db", "test-ns", "10.1.1.2", map[string]string{"tier": "db"}, nil))
+	k8sManager.PodAdded(newPod("dns", "kube-system", "10.1.1.3", nil, nil))
+	k8sManager.PodAdded(newPod("debug", "kube-system", "10.1.1.4", nil, map[string]string{MONITOR_ENABLED_ANNOTATION: "true"}))
+
+	assert.False(t, k8sManager.GetEndpointFromIp("10.1.1.1").Skip)
+	assert.True(t, k8sManager.GetEndpointFromIp("10.1.1.2").Skip)
+	assert.True(t, k8sManager.GetEndpointFromIp("10.1.1.3").Skip)
+	assert.False(t, k8sManager.GetEndpointFromIp("10.1.1.4").Skip)
+
+	var namespace corev1.Namespace
+	namespace.Name = "test-ns"
+	namespace.Annotations = map[string]string{MONITOR_ENABLED_ANNOTATION: "false", "other": "value"}
+	namespaceInfo := NewNamespaceInfo(&namespace)
+	assert.Equal(t, len(namespaceInfo.Annotations), 1)
+
+	k8sManager.NamespaceAdded(namespaceInfo)
+	assert.True(t, k8sManager.GetEndpointFromIp("10.1.1.1").Skip)
+
+	k8sManager.NamespaceDeleted(namespaceInfo)
+	assert.False(t, k8sManager.GetEndpointFromIp("10.1.1.1").Skip)
+}
+
+func TestProtocolHints(t *testing.T) {
+	k8sManager := newK8sResourceManager(fake.NewSimpleClientset(), 0, newTestPolicy())
+
+	var pod corev1.Pod
+	pod.Name = "test-pod"
+	pod.Namespace = "test-ns"
+	pod.Labels = map[string]string{"a": "b"}
+	pod.Annotations = map[string]string{PROTOCOLS_ANNOTATION: "9000=redis, 9001=kubernetes.io/h2c,abc"}
+	pod.Status.PodIP = "10.1.1.1"
+	pod.Spec.Containers = []corev1.Container{{Ports: []corev1.ContainerPort{
+		{Name: "grpc-api", ContainerPort: 8080},
+		{Name: "mysql", ContainerPort: 3306},
+		{Name: "web", ContainerPort: 80},
+		{Name: "http-admin", ContainerPort: 9000},
+		{ContainerPort: 9001},
+		{ContainerPort: 9002},
+	}}}
+	k8sManager.PodAdded(NewPodInfo(&pod))
+
+	endpoint := k8sManager.GetEndpointFromIp("10.1.1.1")
+	assert.Equal(t, endpoint.GetProtocol(8080), PROTOCOL_GRPC)
+	assert.Equal(t, endpoint.GetProtocol(3306), PROTOCOL_MYSQL)
+	assert.Equal(t, endpoint.GetProtocol(80), "")
+	assert.Equal(t, endpoint.GetProtocol(9000), PROTOCOL_REDIS)
+	assert.Equal(t, endpoint.GetProtocol(9001), PROTOCOL_HTTP2)
+
+	appProtocol := "HTTP"
+	var service corev1.Service
+	service.Name = "test-service"
+	service.Namespace = "test-ns"
+	service.Spec.Selector = map[string]string{"a": "b"}
+	service.Spec.ClusterIP = "11.1.1.1"
+	service.Spec.Ports = []corev1.ServicePort{
+		{Name: "grpc", Port: 80, TargetPort: intstr.FromInt(80)},
+		{Name: "redis", Port: 9000, TargetPort: intstr.FromInt(9000)},
+		{Name: "tcp", Port: 3306, TargetPort: intstr.FromInt(3306), AppProtocol: &appProtocol},
+		{Port: 9002, TargetPort: intstr.FromInt(9002)},
+	}
+	serviceInfo := NewServiceInfo(&service)
+	assert.Equal(t, serviceInfo.Ports[0].Protocol, PROTOCOL_GRPC)
+	assert.Equal(t, serviceInfo.Ports[2].Protocol, PROTOCOL_HTTP)
+	assert.Equal(t, serviceInfo.Ports[3].Protocol, "")
+	k8sManager.ServiceAdded(serviceInfo)
+
+	endpoint = k8sManager.GetEndpointFromIp("10.1.1.1")
+	assert.Equal(t, endpoint.GetProtocol(80), PROTOCOL_GRPC)
+	//appProtocol wins over container port name
+	assert.Equal(t, endpoint.GetProtocol(3306), PROTOCOL_HTTP)
+	//annotation wins over service
+	assert.Equal(t, endpoint.GetProtocol(9000), PROTOCOL_REDIS)
+	assert.Equal(t, endpoint.GetProtocol(9002), "")
+
+	assert.Equal(t, k8sManager.GetProtocolPorts(), []uint32{80, 8080, 9000, 9001})
+}
+
+func TestRemotePods(t *testing.T) {
+	k8sManager := newK8sResourceManager(fake.NewSimpleClientset(), 0, newTestPolicy())
+	k8sManager.remotePods = newRemotePodIndex()
+	k8sManager.remotePods.handlers = []PodEventHandler{k8sManager}
+	k8sManager.remotePods.isNodeIp = k8sManager.IsNodeIp
+	index := k8sManager.remotePods
+
+	var service corev1.Service
+	service.Name = "test-service"
+	service.Namespace = "test-ns"
+	service.Spec.Selector = map[string]string{"a": "b"}
+	service.Spec.ClusterIP = "11.1.1.1"
+	service.Spec.Ports = []corev1.ServicePort{{Port: 80, TargetPort: intstr.FromInt(8080)}}
+	k8sManager.ServiceAdded(NewServiceInfo(&service))
+
+	index.setMeta(&metav1.ObjectMeta{Name: "test-pod", Namespace: "test-ns", Labels: map[string]string{"a": "b"},
+		OwnerReferences: []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "test-deploy-1", UID: "rs-uid", Controller: &isController}}})
+	//ip is unknown yet
+	assert.Nil(t, k8sManager.GetEndpointFromIp("10.1.1.1"))
+
+	portName := "grpc"
+	port := int32(8080)
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-service-abc", Namespace: "test-ns"},
+		Endpoints: []discoveryv1.Endpoint{
+			{Addresses: []string{"10.1.1.1"}, TargetRef: &corev1.ObjectReference{Kind: "Pod", Name: "test-pod", Namespace: "test-ns"}},
+			{Addresses: []string{"10.1.1.2"}, TargetRef: &corev1.ObjectReference{Kind: "Pod", Name: "other-pod", Namespace: "test-ns"}},
+		},
+		Ports: []discoveryv1.EndpointPort{{Name: &portName, Port: &port}},
+	}
+	index.setSlice(NewEndpointSliceInfo(slice))
+
+	endpoint := k8sManager.GetEndpointFromIp("10.1.1.1")
+	assert.NotNil(t, endpoint)
+	assert.Equal(t, endpoint.Pod.Name(), "test-pod")
+	assert.Equal(t, endpoint.Pod.Ports, []uint32{8080})
+	assert.Equal(t, endpoint.GetProtocol(8080), PROTOCOL_GRPC)
+	assert.Equal(t, endpoint.Deployment.Name(), "test-deploy-1")
+	assert.Equal(t, endpoint.Deployment.Kind(), "ReplicaSet")
+	assert.Equal(t, len(endpoint.Services), 1)
+	//no metadata
+	assert.Nil(t, k8sManager.GetEndpointFromIp("10.1.1.2"))
+
+	//the pod is a host network pod while its ip is a node ip
+	var node corev1.Node
+	node.Name = "test-node"
+	node.Status.Addresses = []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: "10.1.1.1"}}
+	k8sManager.NodeAdded(NewNodeInfo(&node))
+	assert.Nil(t, k8sManager.GetEndpointFromIp("10.1.1.1"))
+	assert.Equal(t, k8sManager.getHostEndpoint(hostPortKey{ip: "10.1.1.1", port: 8080}).Pod.Name(), "test-pod")
+	//host network pods are not monitored by default
+	assert.Equal(t, k8sManager.GetEndpointFromAddressAt("10.1.1.1", 8080, 0).Deployment.Name(), "node/test-node")
+	k8sManager.NodeDeleted(NewNodeInfo(&node))
+	assert.Equal(t, k8sManager.GetEndpointFromIp("10.1.1.1").Pod.Name(), "test-pod")
+
+	//the pod is watched by WatchNodePods
+	localPod := NewPodInfo(&corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-pod", Namespace: "test-ns", Labels: map[string]string{"a": "b"}},
+		Status:     corev1.PodStatus{PodIP: "10.1.1.1"},
+	})
+	index.setLocal(getResourceKey(localPod), true)
+	assert.Nil(t, k8sManager.GetEndpointFromIp("10.1.1.1"))
+	k8sManager.PodAdded(localPod)
+	assert.Equal(t, k8sManager.GetEndpointFromIp("10.1.1.1").Pod, localPod)
+	index.setMeta(&metav1.ObjectMeta{Name: "test-pod", Namespace: "test-ns", Labels: map[string]string{"a": "c"}})
+	assert.Equal(t, k8sManager.GetEndpointFromIp("10.1.1.1").Pod, localPod)
+	k8sManager.PodDeleted(localPod)
+	index.setLocal(getResourceKey(localPod), false)
+
+	endpoint = k8sManager.GetEndpointFromIp("10.1.1.1")
+	assert.NotNil(t, endpoint)
+	assert.Equal(t, endpoint.Pod.Labels["a"], "c")
+	assert.Equal(t, len(endpoint.Services), 0)
+
+	index.deleteSlice(NewEndpointSliceInfo(slice))
+	assert.Nil(t, k8sManager.GetEndpointFromIp("10.1.1.1"))
+	assert.Equal(t, len(index.pods), 0)
+	assert.Equal(t, len(index.podSlices), 0)
+}
+
+func TestEndpointHistory(t *testing.T) {
+	now := int64(1000)
+	nowNano = func() int64 { return now }
+	defer func() { nowNano = func() int64 { return time.Now().UnixNano() } }()
+
+	k8sManager := newK8sResourceManager(fake.NewSimpleClientset(), 0, newTestPolicy())
+	var service corev1.Service
+	service.Name = "test-service"
+	service.Namespace = "test-ns"
+	service.Spec.Selector = map[string]string{"app": "test"}
+	k8sManager.ServiceAdded(NewServiceInfo(&service))
+	serviceKey := resourceKey{namespace: "test-ns", name: "test-service"}
+
+	newPod := func(name string) *PodInfo {
+		return NewPodInfo(&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "test-ns", Labels: map[string]string{"app": "test"}},
+			Status:     corev1.PodStatus{PodIP: "10.1.1.1"},
+		})
+	}
+	pod1 := newPod("pod-1")
+	pod2 := newPod("pod-2")
+
+	k8sManager.PodAdded(pod1)
+	now = 2000
+	//the ip is reused before pod-1's deletion is notified
+	k8sManager.PodAdded(pod2)
+	now = 3000
+	k8sManager.PodDeleted(pod1)
+
+	assert.Equal(t, k8sManager.GetEndpointFromIp("10.1.1.1").Pod, pod2)
+	assert.Equal(t, len(k8sManager.GetEndpointFromIp("10.1.1.1").Services), 1)
+	//the deleted pod is removed from the service though its ip is reused
+	assert.Equal(t, k8sManager.getServicePods(serviceKey), []*PodInfo{pod2})
+	assert.Equal(t, k8sManager.GetEndpointFromIpAt("10.1.1.1", 1500).Pod, pod1)
+	assert.Equal(t, k8sManager.GetEndpointFromIpAt("10.1.1.1", 2500).Pod, pod2)
+	//before any pod is known
+	assert.Equal(t, k8sManager.GetEndpointFromIpAt("10.1.1.1", 500).Pod, pod2)
+
+	now = 4000
+	k8sManager.PodDeleted(pod2)
+	assert.Nil(t, k8sManager.GetEndpointFromIp("10.1.1.1"))
+	assert.Empty(t, k8sManager.getServicePods(serviceKey))
+	assert.Equal(t, len(k8sManager.namespacePods), 0)
+	assert.Nil(t, k8sManager.GetEndpointFromIpAt("10.1.1.1", 4500))
+	assert.Equal(t, k8sManager.GetEndpointFromIpAt("10.1.1.1", 3500).Pod, pod2)
+	assert.Equal(t, k8sManager.GetEndpointFromIpAt("10.1.1.1", 1500).Pod, pod1)
+
+	//purged after ttl
+	now = 4000 + int64(ENDPOINT_HISTORY_TTL)
+	k8sManager.purgeEndpointHistory()
+	assert.Nil(t, k8sManager.GetEndpointFromIpAt("10.1.1.1", 3500))
+	_, ok := k8sManager.endpointIPMap.Load("10.1.1.1")
+	assert.False(t, ok)
+}
+
+func TestHostNetwork(t *testing.T) {
+	k8sManager := newK8sResourceManager(fake.NewSimpleClientset(), 0, newTestPolicy())
+
+	var node corev1.Node
+	node.Name = "test-node"
+	node.Status.Addresses = []corev1.NodeAddress{
+		{Type: corev1.NodeInternalIP, Address: "12.1.1.1"},
+		{Type: corev1.NodeHostName, Address: "test-node"},
+	}
+	k8sManager.NodeAdded(NewNodeInfo(&node))
+	assert.True(t, k8sManager.IsNodeIp("12.1.1.1"))
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-ingress", Namespace: "test-ns",
+			OwnerReferences: []metav1.OwnerReference{{Kind: "DaemonSet", Name: "test-ingress", UID: "ds-uid", Controller: &isController}}},
+		Spec:   corev1.PodSpec{HostNetwork: true, Containers: []corev1.Container{{Ports: []corev1.ContainerPort{{ContainerPort: 80}}}}},
+		Status: corev1.PodStatus{PodIP: "12.1.1.1", HostIP: "12.1.1.1"},
+	}
+	podInfo := NewPodInfo(pod)
+	assert.True(t, k8sManager.PodValid(podInfo))
+	k8sManager.PodAdded(podInfo)
+	assert.Nil(t, k8sManager.GetEndpointFromIp("12.1.1.1"))
+	assert.Equal(t, k8sManager.GetPodIpInThisNode(), "")
+
+	//host network pods are not monitored by default, their ports are reported as the node
+	endpoint := k8sManager.getHostEndpoint(hostPortKey{ip: "12.1.1.1", port: 80})
+	assert.Equal(t, endpoint.Pod, podInfo)
+	assert.True(t, endpoint.Skip)
+	endpoint = k8sManager.GetEndpointFromAddressAt("12.1.1.1", 80, 0)
+	assert.Nil(t, endpoint.Pod)
+	assert.Equal(t, endpoint.Deployment.Name(), "node/test-node")
+	assert.False(t, endpoint.Skip)
+
+	pod.Annotations = map[string]string{MONITOR_ENABLED_ANNOTATION: "true"}
+	enabledPodInfo := NewPodInfo(pod)
+	k8sManager.PodUpdated(podInfo, enabledPodInfo)
+	podInfo = enabledPodInfo
+	endpoint = k8sManager.GetEndpointFromAddressAt("12.1.1.1", 80, 0)
+	assert.Equal(t, endpoint.Pod, podInfo)
+	assert.Equal(t, endpoint.Deployment.Name(), "test-ingress")
+	assert.True(t, endpoint.HasPort(80))
+	assert.False(t, endpoint.Skip)
+
+	endpoint = k8sManager.GetEndpointFromAddressAt("12.1.1.1", 10250, 0)
+	assert.Nil(t, endpoint.Pod)
+	assert.Equal(t, endpoint.Deployment.Name(), "node/test-node")
+	assert.True(t, endpoint.HasPort(10250))
+	assert.Nil(t, k8sManager.GetEndpointFromAddressAt("12.1.1.2", 80, 0))
+
+	pod.Spec.Containers[0].Ports[0].ContainerPort = 8080
+	newPodInfo := NewPodInfo(pod)
+	k8sManager.PodUpdated(podInfo, newPodInfo)
+	assert.Equal(t, k8sManager.GetEndpointFromAddressAt("12.1.1.1", 8080, 0).Pod, newPodInfo)
+	assert.Nil(t, k8sManager.GetEndpointFromAddressAt("12.1.1.1", 80, 0).Pod)
+
+	k8sManager.PodDeleted(newPodInfo)
+	assert.Nil(t, k8sManager.GetEndpointFromAddressAt("12.1.1.1", 8080, 0).Pod)
+
+	k8sManager.NodeDeleted(NewNodeInfo(&node))
+	assert.False(t, k8sManager.IsNodeIp("12.1.1.1"))
+	assert.Nil(t, k8sManager.GetEndpointFromAddressAt("12.1.1.1", 10250, 0))
+}
+
+func TestIngress(t *testing.T) {
+	k8sManager := newK8sResourceManager(fake.NewSimpleClientset(), 0, newTestPolicy())
+	assert.NotNil(t, k8sManager.SetIngressControllerSelector("app=(bad"))
+	assert.Nil(t, k8sManager.SetIngressControllerSelector("app=ingress-nginx"))
+
+	exact := networkingv1.PathTypeExact
+	prefix := networkingv1.PathTypePrefix
+	newPath := func(path string, pathType *networkingv1.PathType, service string) networkingv1.HTTPIngressPath {
+		return networkingv1.HTTPIngressPath{Path: path, PathType: pathType, Backend: networkingv1.IngressBackend{Service: &networkingv1.IngressServiceBackend{Name: service}}}
+	}
+	var ingress networkingv1.Ingress
+	ingress.Name = "test-ingress"
+	ingress.Namespace = "test-ns"
+	ingress.Spec.DefaultBackend = &networkingv1.IngressBackend{Service: &networkingv1.IngressServiceBackend{Name: "default-svc"}}
+	ingress.Spec.Rules = []networkingv1.IngressRule{
+		{Host: "shop.example.com", IngressRuleValue: networkingv1.IngressRuleValue{HTTP: &networkingv1.HTTPIngressRuleValue{
+			Paths: []networkingv1.HTTPIngressPath{newPath("/", &prefix, "web-svc"), newPath("/api", &prefix, "api-svc"), newPath("/api/login", &exact, "login-svc")},
+		}}},
+		{Host: "*.example.com", IngressRuleValue: networkingv1.IngressRuleValue{HTTP: &networkingv1.HTTPIngressRuleValue{
+			Paths: []networkingv1.HTTPIngressPath{newPath("/static", nil, "static-svc")},
+		}}},
+	}
+	ingressInfo := NewIngressInfo(&ingress)
+	k8sManager.IngressAdded(ingressInfo)
+
+	for _, request := range []struct {
+		host    string
+		url     string
+		service string
+		rule    string
+	}{
+		{"shop.example.com", "/", "web-svc", "shop.example.com"},
+		{"Shop.Example.com:8080", "/api/v1?a=b", "api-svc", "shop.example.com"},
+		{"shop.example.com", "/apis", "web-svc", "shop.example.com"},
+		{"shop.example.com", "/api/login", "login-svc", "shop.example.com"},
+		{"shop.example.com", "/api/login/x", "api-svc", "shop.example.com"},
+		{"blog.example.com", "/static/a.css", "static-svc", "*.example.com"},
+		{"blog.example.com", "/", "default-svc", ""},
+		{"", "/", "default-svc", ""},
+	} {
+		ingress, rule, path := k8sManager.GetIngress(request.host, request.url)
+		assert.NotNil(t, ingress, request.url)
+		assert.Equal(t, ingress.Name(), "test-ingress")
+		assert.Equal(t, path.ServiceName, request.service, request.host+request.url)
+		assert.Equal(t, rule.Host, request.rule)
+	}
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "nginx", Namespace: "ingress", Labels: map[string]string{"app": "ingress-nginx"}},
+		Status:     corev1.PodStatus{PodIP: "10.1.1.1"},
+	}
+	k8sManager.PodAdded(NewPodInfo(pod))
+	assert.True(t, k8sManager.GetEndpointFromIp("10.1.1.1").IngressController)
+
+	k8sManager.IngressDeleted(ingressInfo)
+	ingressResult, _, _ := k8sManager.GetIngress("shop.example.com", "/")
+	assert.Nil(t, ingressResult)
+}
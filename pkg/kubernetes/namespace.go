@@ -0,0 +1,28 @@
+package kubernetes
+
+import (
+	"fmt"
+	"k8s.io/api/core/v1"
+)
+
+type NamespaceInfo struct {
+	name        string
+	Labels      map[string]string
+	Annotations map[string]string
+}
+
+func (namespace *NamespaceInfo) Name() string {
+	return namespace.name
+}
+
+func (namespace *NamespaceInfo) String() string {
+	return fmt.Sprintf("Namespace %s", namespace.name)
+}
+
+func NewNamespaceInfo(namespace *v1.Namespace) *NamespaceInfo {
+	return &NamespaceInfo{
+		name:        namespace.Name,
+		Labels:      namespace.Labels,
+		Annotations: getMonitorAnnotations(namespace.Annotations),
+	}
+}
@@ -0,0 +1,85 @@
+package kubernetes
+
+import (
+	"k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"reflect"
+)
+
+type NamespaceEventHandler interface {
+	NamespaceValid(namespace *NamespaceInfo) bool
+	NamespaceAdded(namespace *NamespaceInfo)
+	NamespaceDeleted(namespace *NamespaceInfo)
+	NamespaceUpdated(oldNamespace, newNamespace *NamespaceInfo)
+}
+
+func (manager *K8sResourceManager) NamespaceValid(namespace *NamespaceInfo) bool {
+	return true
+}
+
+func (manager *K8sResourceManager) NamespaceAdded(namespace *NamespaceInfo) {
+	manager.namespaceMap[namespace.Name()] = namespace
+	manager.refreshNamespaceEndpoints(namespace.Name())
+}
+
+func (manager *K8sResourceManager) NamespaceDeleted(namespace *NamespaceInfo) {
+	delete(manager.namespaceMap, namespace.Name())
+	manager.refreshNamespaceEndpoints(namespace.Name())
+}
+
+func (manager *K8sResourceManager) NamespaceUpdated(oldNamespace, newNamespace *NamespaceInfo) {
+	manager.NamespaceAdded(newNamespace)
+}
+
+func (manager *K8sResourceManager) WatchNamespaces(handlers ...NamespaceEventHandler) {
+	manager.addEventHandler(manager.informerFactory.Core().V1().Namespaces().Informer(),
+		cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				namespace := NewNamespaceInfo(obj.(*v1.Namespace))
+
+				manager.Lock()
+				defer manager.Unlock()
+
+				for _, h := range handlers {
+					if h.NamespaceValid(namespace) {
+						h.NamespaceAdded(namespace)
+					}
+				}
+			},
+			DeleteFunc: func(obj interface{}) {
+				namespace := NewNamespaceInfo(getDeletedObject(obj).(*v1.Namespace))
+
+				manager.Lock()
+				defer manager.Unlock()
+
+				for _, h := range handlers {
+					if h.NamespaceValid(namespace) {
+						h.NamespaceDeleted(namespace)
+					}
+				}
+			},
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				oldNamespace := NewNamespaceInfo(oldObj.(*v1.Namespace))
+				newNamespace := NewNamespaceInfo(newObj.(*v1.Namespace))
+				if reflect.DeepEqual(oldNamespace, newNamespace) {
+					return
+				}
+
+				manager.Lock()
+				defer manager.Unlock()
+
+				for _, h := range handlers {
+					oldValid := h.NamespaceValid(oldNamespace)
+					newValid := h.NamespaceValid(newNamespace)
+					if !oldValid && newValid {
+						h.NamespaceAdded(newNamespace)
+					} else if oldValid && !newValid {
+						h.NamespaceDeleted(oldNamespace)
+					} else if oldValid && newValid {
+						h.NamespaceUpdated(oldNamespace, newNamespace)
+					}
+				}
+			},
+		},
+	)
+}
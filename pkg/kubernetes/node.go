@@ -0,0 +1,52 @@
+package kubernetes
+
+import (
+	"fmt"
+	"k8s.io/api/core/v1"
+	"net"
+)
+
+const NODE_PREFIX = "node/"
+
+type NodeInfo struct {
+	name   string
+	IPs    []string
+	Labels map[string]string
+}
+
+func (node *NodeInfo) Name() string {
+	return node.name
+}
+
+func (node *NodeInfo) String() string {
+	return fmt.Sprintf("Node %s", node.name)
+}
+
+func NewNodeInfo(node *v1.Node) *NodeInfo {
+	result := &NodeInfo{
+		name:   node.Name,
+		Labels: node.Labels,
+	}
+	for _, address := range node.Status.Addresses {
+		if address.Type != v1.NodeInternalIP && address.Type != v1.NodeExternalIP {
+			continue
+		}
+		ip := net.ParseIP(address.Address)
+		if ip == nil || ip.To4() == nil {
+			continue
+		}
+		result.IPs = append(result.IPs, address.Address)
+	}
+	return result
+}
+
+// newNodeEndpointInfo creates the endpoint of traffic to or from the node itself, whose identity is node/<name>
+func newNodeEndpointInfo(node *NodeInfo) *EndpointInfo {
+	return &EndpointInfo{
+		Deployment: &DeploymentInfo{
+			name:   NODE_PREFIX + node.name,
+			kind:   "Node",
+			Labels: node.Labels,
+		},
+	}
+}
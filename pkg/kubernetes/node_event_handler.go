@@ -0,0 +1,109 @@
+package kubernetes
+
+import (
+	"k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"reflect"
+)
+
+type NodeEventHandler interface {
+	NodeValid(node *NodeInfo) bool
+	NodeAdded(node *NodeInfo)
+	NodeDeleted(node *NodeInfo)
+	NodeUpdated(oldNode, newNode *NodeInfo)
+}
+
+func (manager *K8sResourceManager) NodeValid(node *NodeInfo) bool {
+	return true
+}
+
+// storeNodeEndpoints rebuilds the copy on write node ip index
+func (manager *K8sResourceManager) storeNodeEndpoints() {
+	nodeEndpoints := make(map[string]*EndpointInfo)
+	for _, node := range manager.nodeMap {
+		endpoint := newNodeEndpointInfo(node)
+		for _, ip := range node.IPs {
+			nodeEndpoints[ip] = endpoint
+		}
+	}
+	manager.nodeEndpoints.Store(nodeEndpoints)
+}
+
+func (manager *K8sResourceManager) NodeAdded(node *NodeInfo) {
+	manager.nodeMap[node.Name()] = node
+	manager.storeNodeEndpoints()
+	if manager.remotePods != nil {
+		//host network pods of other nodes are known by node ips
+		manager.remotePods.refreshIps(node.IPs)
+	}
+}
+
+func (manager *K8sResourceManager) NodeDeleted(node *NodeInfo) {
+	delete(manager.nodeMap, node.Name())
+	manager.storeNodeEndpoints()
+	if manager.remotePods != nil {
+		manager.remotePods.refreshIps(node.IPs)
+	}
+}
+
+func (manager *K8sResourceManager) NodeUpdated(oldNode, newNode *NodeInfo) {
+	manager.NodeAdded(newNode)
+	if manager.remotePods != nil {
+		//ips removed from the node
+		manager.remotePods.refreshIps(oldNode.IPs)
+	}
+}
+
+func (manager *K8sResourceManager) WatchNodes(handlers ...NodeEventHandler) {
+	manager.addEventHandler(manager.informerFactory.Core().V1().Nodes().Informer(),
+		cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				node := NewNodeInfo(obj.(*v1.Node))
+
+				manager.Lock()
+				defer manager.Unlock()
+
+				for _, h := range handlers {
+					if h.NodeValid(node) {
+						h.NodeAdded(node)
+					}
+				}
+			},
+			DeleteFunc: func(obj interface{}) {
+				node := NewNodeInfo(getDeletedObject(obj).(*v1.Node))
+
+				manager.Lock()
+				defer manager.Unlock()
+
+				for _, h := range handlers {
+					if h.NodeValid(node) {
+						h.NodeDeleted(node)
+					}
+				}
+			},
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				oldNode := NewNodeInfo(oldObj.(*v1.Node))
+				newNode := NewNodeInfo(newObj.(*v1.Node))
+				//node status is updated frequently by kubelet
+				if reflect.DeepEqual(oldNode, newNode) {
+					return
+				}
+
+				manager.Lock()
+				defer manager.Unlock()
+
+				for _, h := range handlers {
+					oldValid := h.NodeValid(oldNode)
+					newValid := h.NodeValid(newNode)
+					if !oldValid && newValid {
+						h.NodeAdded(newNode)
+					} else if oldValid && !newValid {
+						h.NodeDeleted(oldNode)
+					} else if oldValid && newValid {
+						h.NodeUpdated(oldNode, newNode)
+					}
+				}
+			},
+		},
+	)
+}
@@ -3,16 +3,25 @@ package kubernetes
 import (
 	"fmt"
 	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 type PodInfo struct {
 	ResourceVersion string
 	name            string
 	namespace       string
+	uid             string
 	PodIP           string
 	HostIP          string
 	HostNetwork     bool
 	Labels          map[string]string
+	Annotations     map[string]string
+	Ports           []uint32
+	//protocols from container port names
+	PortProtocols map[uint32]string
+	//protocols from traffic-monitor.io/protocols annotation
+	AnnotationProtocols map[uint32]string
+	owner               *metav1.OwnerReference
 }
 
 func (pod *PodInfo) GetSelector() map[string]string {
@@ -35,8 +44,13 @@ func (pod *PodInfo) String() string {
 	return fmt.Sprintf("Pod %s@%s", pod.name, pod.namespace)
 }
 
-func (pod *PodInfo) IsSkip() bool {
-	return pod.namespace == "kube-system"
+func (pod *PodInfo) UID() string {
+	return pod.uid
+}
+
+// Owner returns the controller of the pod, nil for a bare pod
+func (pod *PodInfo) Owner() *metav1.OwnerReference {
+	return pod.owner
 }
 
 func NewPodInfo(pod *v1.Pod) *PodInfo {
@@ -47,13 +61,29 @@ func NewPodInfo(pod *v1.Pod) *PodInfo {
 	if pod.Labels == nil {
 		pod.Labels = make(map[string]string)
 	}
-	return &PodInfo{
+	result := &PodInfo{
 		PodIP:           pod.Status.PodIP,
 		HostIP:          pod.Status.HostIP,
 		namespace:       pod.Namespace,
 		name:            pod.Name,
+		uid:             string(pod.UID),
 		Labels:          pod.Labels,
+		Annotations:     getMonitorAnnotations(pod.Annotations),
 		HostNetwork:     pod.Spec.HostNetwork,
 		ResourceVersion: pod.ResourceVersion,
+		owner:           metav1.GetControllerOf(pod),
+	}
+	result.AnnotationProtocols = getAnnotationProtocols(result.Annotations)
+	for _, container := range pod.Spec.Containers {
+		for _, port := range container.Ports {
+			result.Ports = append(result.Ports, uint32(port.ContainerPort))
+			if protocol := getPortNameProtocol(port.Name); protocol != "" {
+				if result.PortProtocols == nil {
+					result.PortProtocols = make(map[uint32]string)
+				}
+				result.PortProtocols[uint32(port.ContainerPort)] = protocol
+			}
+		}
 	}
+	return result
 }
@@ -2,11 +2,11 @@ package kubernetes
 
 import (
 	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/fields"
-
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/tools/cache"
 	"reflect"
-	"time"
 )
 
 type PodEventHandler interface {
@@ -17,102 +17,133 @@ type PodEventHandler interface {
 }
 
 func (manager *K8sResourceManager) PodValid(info *PodInfo) bool {
-	return !info.HostNetwork
+	return true
 }
 
-func (manager *K8sResourceManager) PodAdded(info *PodInfo) {
-	if manager.podIpInThisNode == "" {
+func (manager *K8sResourceManager) checkPodIpInThisNode(info *PodInfo) {
+	if manager.podIpInThisNode == "" && !info.HostNetwork {
 		for _, nodeIp := range manager.nodeIps {
 			if nodeIp == info.HostIP {
 				manager.podIpInThisNode = info.PodIP
 			}
 		}
 	}
+}
+
+func (manager *K8sResourceManager) PodAdded(info *PodInfo) {
+	manager.checkPodIpInThisNode(info)
 	manager.addResource(info)
-	manager.podIPMap[info.PodIP] = info
+	manager.addPodEndpoint(info)
 }
 
 func (manager *K8sResourceManager) PodDeleted(info *PodInfo) {
 	manager.removeResource(info)
-	currentInfo := manager.podIPMap[info.PodIP]
-	if currentInfo != nil && currentInfo.Name() == info.Name() && currentInfo.Namespace() == info.Namespace() {
-		delete(manager.podIPMap, info.PodIP)
-	}
+	manager.removePodEndpoint(info)
+	manager.purgeEndpointHistory()
 }
 
 func (manager *K8sResourceManager) PodUpdated(oldPod, newPod *PodInfo) {
-	manager.PodDeleted(oldPod)
-	manager.PodAdded(newPod)
+	manager.checkPodIpInThisNode(newPod)
+	manager.removeResource(oldPod)
+	manager.addResource(newPod)
+	manager.updatePodEndpoint(oldPod, newPod)
 }
 
-func (manager *K8sResourceManager) WatchPods(stopper chan struct{}, handlers ...PodEventHandler) {
-	watchlist := cache.NewListWatchFromClient(
-		manager.clientSet.CoreV1().RESTClient(), "pods", "",
-		fields.Everything())
-	_, controller := cache.NewInformer(
-		watchlist,
-		&v1.Pod{},
-		time.Second*0,
-		cache.ResourceEventHandlerFuncs{
-			AddFunc: func(obj interface{}) {
-				pod := NewPodInfo(obj.(*v1.Pod))
-				if pod == nil {
-					return
-				}
-				manager.Lock()
-				defer manager.Unlock()
+// dispatchPodUpdate calls PodAdded or PodDeleted if the pod becomes valid or invalid for a handler,
+// either pod could be nil
+func dispatchPodUpdate(handlers []PodEventHandler, oldPod, newPod *PodInfo) {
+	for _, h := range handlers {
+		oldValid := (oldPod != nil && h.PodValid(oldPod))
+		newValid := (newPod != nil && h.PodValid(newPod))
+		if !oldValid && newValid {
+			h.PodAdded(newPod)
+		} else if oldValid && !newValid {
+			h.PodDeleted(oldPod)
+		} else if oldValid && newValid {
+			h.PodUpdated(oldPod, newPod)
+		}
+	}
+}
 
-				for _, h := range handlers {
-					if h.PodValid(pod) {
-						h.PodAdded(pod)
-					}
-				}
-			},
-			DeleteFunc: func(obj interface{}) {
-				pod := NewPodInfo(obj.(*v1.Pod))
-				if pod == nil {
-					return
-				}
-				manager.Lock()
-				defer manager.Unlock()
+// isPodChanged ignores ResourceVersion diff
+func isPodChanged(oldPod, newPod *PodInfo) bool {
+	if oldPod == nil || newPod == nil {
+		return oldPod != newPod
+	}
+	newVersion := newPod.ResourceVersion
+	newPod.ResourceVersion = oldPod.ResourceVersion
+	defer func() { newPod.ResourceVersion = newVersion }()
+	return !reflect.DeepEqual(oldPod, newPod)
+}
 
-				for _, h := range handlers {
-					if h.PodValid(pod) {
-						h.PodDeleted(pod)
-					}
-				}
-			},
-			UpdateFunc: func(oldObj, newObj interface{}) {
-				oldPod := NewPodInfo(oldObj.(*v1.Pod))
-				newPod := NewPodInfo(newObj.(*v1.Pod))
-				if oldPod == nil && newPod == nil {
-					return
-				}
-				if oldPod != nil && newPod != nil {
-					newVersion := newPod.ResourceVersion
-					//ignore ResourceVersion diff
-					newPod.ResourceVersion = oldPod.ResourceVersion
-					if reflect.DeepEqual(oldPod, newPod) {
-						return
-					}
-					newPod.ResourceVersion = newVersion
+func (manager *K8sResourceManager) newPodEventHandlerFuncs(handlers []PodEventHandler) cache.ResourceEventHandlerFuncs {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			pod := NewPodInfo(obj.(*v1.Pod))
+			if pod == nil {
+				return
+			}
+			manager.Lock()
+			defer manager.Unlock()
+
+			if manager.remotePods != nil {
+				manager.remotePods.setLocal(getResourceKey(pod), true)
+			}
+			for _, h := range handlers {
+				if h.PodValid(pod) {
+					h.PodAdded(pod)
 				}
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			pod := NewPodInfo(getDeletedObject(obj).(*v1.Pod))
+			if pod == nil {
+				return
+			}
+			manager.Lock()
+			defer manager.Unlock()
 
-				manager.Lock()
-				defer manager.Unlock()
-				for _, h := range handlers {
-					oldValid := (oldPod != nil && h.PodValid(oldPod))
-					newValid := (newPod != nil && h.PodValid(newPod))
-					if !oldValid && newValid {
-						h.PodAdded(newPod)
-					} else if oldValid && !newValid {
-						h.PodDeleted(oldPod)
-					} else if oldValid && newValid {
-						h.PodUpdated(oldPod, newPod)
-					}
+			for _, h := range handlers {
+				if h.PodValid(pod) {
+					h.PodDeleted(pod)
 				}
-			},
+			}
+			if manager.remotePods != nil {
+				manager.remotePods.setLocal(getResourceKey(pod), false)
+			}
 		},
-	)
-	controller.Run(stopper)
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldPod := NewPodInfo(oldObj.(*v1.Pod))
+			newPod := NewPodInfo(newObj.(*v1.Pod))
+			if !isPodChanged(oldPod, newPod) {
+				return
+			}
+
+			manager.Lock()
+			defer manager.Unlock()
+			if newPod != nil && manager.remotePods != nil {
+				manager.remotePods.setLocal(getResourceKey(newPod), true)
+			}
+			dispatchPodUpdate(handlers, oldPod, newPod)
+		},
+	}
+}
+
+// WatchPods watches pods of all nodes
+func (manager *K8sResourceManager) WatchPods(handlers ...PodEventHandler) {
+	manager.addEventHandler(manager.informerFactory.Core().V1().Pods().Informer(),
+		manager.newPodEventHandlerFuncs(handlers))
+}
+
+// WatchNodePods watches only pods running in the given node,
+// pods of other nodes could be resolved by WatchRemotePods
+func (manager *K8sResourceManager) WatchNodePods(nodeName string, handlers ...PodEventHandler) {
+	if manager.nodeInformerFactory == nil {
+		manager.nodeInformerFactory = informers.NewSharedInformerFactoryWithOptions(manager.clientSet, manager.resyncPeriod,
+			informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+				options.FieldSelector = fields.OneTermEqualSelector("spec.nodeName", nodeName).String()
+			}))
+	}
+	manager.addEventHandler(manager.nodeInformerFactory.Core().V1().Pods().Informer(),
+		manager.newPodEventHandlerFuncs(handlers))
 }
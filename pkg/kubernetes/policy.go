@@ -0,0 +1,93 @@
+package kubernetes
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/luguoxiang/kubernetes-traffic-monitor/pkg/config"
+	"k8s.io/apimachinery/pkg/labels"
+	"strconv"
+)
+
+// Policy decides whether traffic of a pod should be monitored
+type Policy struct {
+	includeNamespaces map[string]bool
+	excludeNamespaces map[string]bool
+	podSelector       labels.Selector
+	namespaceSelector labels.Selector
+	hostNetwork       bool
+}
+
+func NewPolicy(policyConfig *config.PolicyConfig) (*Policy, error) {
+	result := &Policy{
+		includeNamespaces: make(map[string]bool),
+		excludeNamespaces: make(map[string]bool),
+		hostNetwork:       policyConfig.HostNetwork,
+	}
+	for _, namespace := range policyConfig.IncludeNamespaces {
+		result.includeNamespaces[namespace] = true
+	}
+	for _, namespace := range policyConfig.ExcludeNamespaces {
+		result.excludeNamespaces[namespace] = true
+	}
+
+	var err error
+	result.podSelector, err = labels.Parse(policyConfig.PodSelector)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid pod selector '%s': %s", policyConfig.PodSelector, err.Error())
+	}
+	result.namespaceSelector, err = labels.Parse(policyConfig.NamespaceSelector)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid namespace selector '%s': %s", policyConfig.NamespaceSelector, err.Error())
+	}
+	return result, nil
+}
+
+func getEnabledAnnotation(annotations map[string]string) (bool, bool /*found*/) {
+	value, ok := annotations[MONITOR_ENABLED_ANNOTATION]
+	if !ok {
+		return false, false
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		glog.Warningf("Invalid annotation %s: %s", MONITOR_ENABLED_ANNOTATION, value)
+		return false, false
+	}
+	return enabled, true
+}
+
+// IsMonitored checks annotations of pod, workload and namespace first, then the configured namespaces and selectors.
+// namespace is nil if it is unknown yet
+func (policy *Policy) IsMonitored(pod *PodInfo, deployment *DeploymentInfo, namespace *NamespaceInfo) bool {
+	if enabled, ok := getEnabledAnnotation(pod.Annotations); ok {
+		return enabled
+	}
+	if deployment != nil {
+		if enabled, ok := getEnabledAnnotation(deployment.Annotations); ok {
+			return enabled
+		}
+	}
+	if namespace != nil {
+		if enabled, ok := getEnabledAnnotation(namespace.Annotations); ok {
+			return enabled
+		}
+	}
+
+	if pod.HostNetwork && !policy.hostNetwork {
+		return false
+	}
+	if len(policy.includeNamespaces) > 0 && !policy.includeNamespaces[pod.Namespace()] {
+		return false
+	}
+	if policy.excludeNamespaces[pod.Namespace()] {
+		return false
+	}
+	if !policy.podSelector.Matches(labels.Set(pod.Labels)) {
+		return false
+	}
+	if !policy.namespaceSelector.Empty() {
+		if namespace == nil || !policy.namespaceSelector.Matches(labels.Set(namespace.Labels)) {
+			return false
+		}
+	}
+	return true
+}
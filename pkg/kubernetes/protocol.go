@@ -0,0 +1,67 @@
+package kubernetes
+
+import (
+	"github.com/golang/glog"
+	"strconv"
+	"strings"
+)
+
+const (
+	PROTOCOL_HTTP  = "http"
+	PROTOCOL_HTTP2 = "http2"
+	PROTOCOL_GRPC  = "grpc"
+	PROTOCOL_MYSQL = "mysql"
+	PROTOCOL_REDIS = "redis"
+)
+
+// protocols recognized from port names, see https://istio.io/docs/ops/configuration/traffic-management/protocol-selection/
+var portNameProtocols = []string{PROTOCOL_HTTP2, PROTOCOL_HTTP, PROTOCOL_GRPC, PROTOCOL_MYSQL, PROTOCOL_REDIS}
+
+// normalizeProtocol converts appProtocol or annotation values, e.g. "kubernetes.io/h2c" or "HTTP", to a protocol name
+func normalizeProtocol(protocol string) string {
+	protocol = strings.ToLower(strings.TrimSpace(protocol))
+	if index := strings.LastIndex(protocol, "/"); index >= 0 {
+		protocol = protocol[index+1:]
+	}
+	switch protocol {
+	case "h2c", "h2":
+		return PROTOCOL_HTTP2
+	case "grpc-web":
+		return PROTOCOL_HTTP
+	}
+	return protocol
+}
+
+// getPortNameProtocol follows the <protocol>[-<suffix>] port name convention, e.g. "http-web", "grpc"
+func getPortNameProtocol(name string) string {
+	name = strings.ToLower(name)
+	for _, protocol := range portNameProtocols {
+		if name == protocol || strings.HasPrefix(name, protocol+"-") {
+			return protocol
+		}
+	}
+	return ""
+}
+
+// getAnnotationProtocols parses annotation like traffic-monitor.io/protocols: "9000=redis,8081=grpc"
+func getAnnotationProtocols(annotations map[string]string) map[uint32]string {
+	value := annotations[PROTOCOLS_ANNOTATION]
+	if value == "" {
+		return nil
+	}
+	result := make(map[uint32]string)
+	for _, item := range strings.Split(value, ",") {
+		pair := strings.SplitN(item, "=", 2)
+		if len(pair) != 2 {
+			glog.Warningf("Ignore invalid protocol hint '%s'", item)
+			continue
+		}
+		port, err := strconv.ParseUint(strings.TrimSpace(pair[0]), 10, 16)
+		if err != nil || port == 0 {
+			glog.Warningf("Ignore invalid protocol hint '%s'", item)
+			continue
+		}
+		result[uint32(port)] = normalizeProtocol(pair[1])
+	}
+	return result
+}
@@ -0,0 +1,252 @@
+package kubernetes
+
+import (
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net"
+	"sort"
+)
+
+type endpointSliceAddress struct {
+	ip  string
+	pod resourceKey
+}
+
+type endpointSlicePort struct {
+	port     uint32
+	protocol string
+}
+
+// EndpointSliceInfo keeps pod ips and ports of an EndpointSlice
+type EndpointSliceInfo struct {
+	name      string
+	namespace string
+	addresses []endpointSliceAddress
+	ports     []endpointSlicePort
+}
+
+func (slice *EndpointSliceInfo) Name() string {
+	return slice.name
+}
+
+func (slice *EndpointSliceInfo) Namespace() string {
+	return slice.namespace
+}
+
+func (slice *EndpointSliceInfo) getPods() []resourceKey {
+	var result []resourceKey
+	for _, address := range slice.addresses {
+		result = append(result, address.pod)
+	}
+	return result
+}
+
+func NewEndpointSliceInfo(slice *discoveryv1.EndpointSlice) *EndpointSliceInfo {
+	result := &EndpointSliceInfo{
+		name:      slice.Name,
+		namespace: slice.Namespace,
+	}
+	for _, endpoint := range slice.Endpoints {
+		if endpoint.TargetRef == nil || endpoint.TargetRef.Kind != "Pod" {
+			continue
+		}
+		for _, address := range endpoint.Addresses {
+			ip := net.ParseIP(address)
+			if ip == nil || ip.To4() == nil {
+				continue
+			}
+			result.addresses = append(result.addresses, endpointSliceAddress{
+				ip:  address,
+				pod: resourceKey{namespace: endpoint.TargetRef.Namespace, name: endpoint.TargetRef.Name},
+			})
+		}
+	}
+	for _, port := range slice.Ports {
+		if port.Port == nil {
+			continue
+		}
+		var protocol string
+		if port.Name != nil {
+			protocol = getPortNameProtocol(*port.Name)
+		}
+		if port.AppProtocol != nil && *port.AppProtocol != "" {
+			protocol = normalizeProtocol(*port.AppProtocol)
+		}
+		result.ports = append(result.ports, endpointSlicePort{port: uint32(*port.Port), protocol: protocol})
+	}
+	return result
+}
+
+// remotePodIndex resolves pods of other nodes without watching their full spec and status.
+// Pod ips and ports come from EndpointSlices, labels, annotations and owners from pod metadata,
+// so a remote pod is only known when it is selected by a service
+type remotePodIndex struct {
+	handlers  []PodEventHandler
+	isNodeIp  func(ip string) bool
+	metas     map[resourceKey]*metav1.ObjectMeta
+	slices    map[resourceKey]*EndpointSliceInfo
+	podSlices map[resourceKey]map[resourceKey]bool
+	ipPods    map[string]map[resourceKey]bool
+	//pods which have been dispatched to handlers
+	pods map[resourceKey]*PodInfo
+	//pods watched by WatchNodePods
+	localPods map[resourceKey]bool
+}
+
+func newRemotePodIndex() *remotePodIndex {
+	return &remotePodIndex{
+		metas:     make(map[resourceKey]*metav1.ObjectMeta),
+		slices:    make(map[resourceKey]*EndpointSliceInfo),
+		podSlices: make(map[resourceKey]map[resourceKey]bool),
+		ipPods:    make(map[string]map[resourceKey]bool),
+		pods:      make(map[resourceKey]*PodInfo),
+		localPods: make(map[resourceKey]bool),
+	}
+}
+
+func (index *remotePodIndex) newPodInfo(key resourceKey) *PodInfo {
+	meta := index.metas[key]
+	if meta == nil || index.localPods[key] {
+		return nil
+	}
+	result := &PodInfo{
+		ResourceVersion: meta.ResourceVersion,
+		name:            meta.Name,
+		namespace:       meta.Namespace,
+		uid:             string(meta.UID),
+		Labels:          meta.Labels,
+		Annotations:     getMonitorAnnotations(meta.Annotations),
+		owner:           metav1.GetControllerOf(meta),
+	}
+	if result.Labels == nil {
+		result.Labels = make(map[string]string)
+	}
+	result.AnnotationProtocols = getAnnotationProtocols(result.Annotations)
+	portMap := make(map[uint32]bool)
+	for sliceKey := range index.podSlices[key] {
+		slice := index.slices[sliceKey]
+		for _, address := range slice.addresses {
+			if address.pod == key {
+				result.PodIP = address.ip
+			}
+		}
+		for _, port := range slice.ports {
+			portMap[port.port] = true
+			if port.protocol != "" {
+				if result.PortProtocols == nil {
+					result.PortProtocols = make(map[uint32]string)
+				}
+				result.PortProtocols[port.port] = port.protocol
+			}
+		}
+	}
+	if result.PodIP == "" {
+		return nil
+	}
+	//host network pod shares the node ip
+	result.HostNetwork = index.isNodeIp != nil && index.isNodeIp(result.PodIP)
+	for port := range portMap {
+		result.Ports = append(result.Ports, port)
+	}
+	sort.Slice(result.Ports, func(i, j int) bool { return result.Ports[i] < result.Ports[j] })
+	return result
+}
+
+// refresh dispatches the change of a remote pod to handlers
+func (index *remotePodIndex) refresh(key resourceKey) {
+	oldPod := index.pods[key]
+	newPod := index.newPodInfo(key)
+	if !isPodChanged(oldPod, newPod) {
+		return
+	}
+	if newPod == nil {
+		delete(index.pods, key)
+	} else {
+		index.pods[key] = newPod
+	}
+	dispatchPodUpdate(index.handlers, oldPod, newPod)
+}
+
+func (index *remotePodIndex) setMeta(meta *metav1.ObjectMeta) {
+	key := resourceKey{namespace: meta.Namespace, name: meta.Name}
+	index.metas[key] = meta
+	index.refresh(key)
+}
+
+func (index *remotePodIndex) deleteMeta(meta *metav1.ObjectMeta) {
+	key := resourceKey{namespace: meta.Namespace, name: meta.Name}
+	delete(index.metas, key)
+	index.refresh(key)
+}
+
+func (index *remotePodIndex) removeSlice(sliceKey resourceKey) []resourceKey {
+	slice := index.slices[sliceKey]
+	if slice == nil {
+		return nil
+	}
+	delete(index.slices, sliceKey)
+	pods := slice.getPods()
+	for _, pod := range pods {
+		delete(index.podSlices[pod], sliceKey)
+		if len(index.podSlices[pod]) == 0 {
+			delete(index.podSlices, pod)
+		}
+	}
+	for _, address := range slice.addresses {
+		if index.podSlices[address.pod] == nil {
+			delete(index.ipPods[address.ip], address.pod)
+			if len(index.ipPods[address.ip]) == 0 {
+				delete(index.ipPods, address.ip)
+			}
+		}
+	}
+	return pods
+}
+
+func (index *remotePodIndex) setSlice(slice *EndpointSliceInfo) {
+	sliceKey := resourceKey{namespace: slice.namespace, name: slice.name}
+	pods := index.removeSlice(sliceKey)
+	index.slices[sliceKey] = slice
+	for _, address := range slice.addresses {
+		if index.podSlices[address.pod] == nil {
+			index.podSlices[address.pod] = make(map[resourceKey]bool)
+		}
+		index.podSlices[address.pod][sliceKey] = true
+		if index.ipPods[address.ip] == nil {
+			index.ipPods[address.ip] = make(map[resourceKey]bool)
+		}
+		index.ipPods[address.ip][address.pod] = true
+		pods = append(pods, address.pod)
+	}
+	for _, pod := range pods {
+		index.refresh(pod)
+	}
+}
+
+func (index *remotePodIndex) deleteSlice(slice *EndpointSliceInfo) {
+	for _, pod := range index.removeSlice(resourceKey{namespace: slice.namespace, name: slice.name}) {
+		index.refresh(pod)
+	}
+}
+
+// setLocal marks a pod as watched by WatchNodePods, its remote version is removed
+func (index *remotePodIndex) setLocal(key resourceKey, local bool) {
+	if index.localPods[key] == local {
+		return
+	}
+	if local {
+		index.localPods[key] = true
+	} else {
+		delete(index.localPods, key)
+	}
+	index.refresh(key)
+}
+
+// refreshIps refreshes remote pods of the ips, e.g. when they are found to be node ips
+func (index *remotePodIndex) refreshIps(ips []string) {
+	for _, ip := range ips {
+		for pod := range index.ipPods[ip] {
+			index.refresh(pod)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package kubernetes
+
+import (
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/metadata/metadatainformer"
+	"k8s.io/client-go/tools/cache"
+)
+
+// WatchRemotePods resolves pods of other nodes from pod metadata and EndpointSlices,
+// which is much lighter than WatchPods for large clusters. It is used together with WatchNodePods
+func (manager *K8sResourceManager) WatchRemotePods(handlers ...PodEventHandler) {
+	if manager.remotePods == nil {
+		manager.remotePods = newRemotePodIndex()
+		manager.remotePods.isNodeIp = manager.IsNodeIp
+	}
+	manager.remotePods.handlers = append(manager.remotePods.handlers, handlers...)
+	if manager.metadataInformerFactory == nil {
+		manager.metadataInformerFactory = metadatainformer.NewSharedInformerFactory(manager.metadataClient, manager.resyncPeriod)
+	}
+
+	getMeta := func(obj interface{}) *metav1.ObjectMeta {
+		meta, ok := getDeletedObject(obj).(*metav1.PartialObjectMetadata)
+		if !ok {
+			glog.Warningf("Unexpected pod metadata %T", obj)
+			return nil
+		}
+		return &meta.ObjectMeta
+	}
+	manager.addEventHandler(manager.metadataInformerFactory.ForResource(v1.SchemeGroupVersion.WithResource("pods")).Informer(),
+		cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				meta := getMeta(obj)
+				if meta == nil {
+					return
+				}
+				manager.Lock()
+				defer manager.Unlock()
+				manager.remotePods.setMeta(meta)
+			},
+			DeleteFunc: func(obj interface{}) {
+				meta := getMeta(obj)
+				if meta == nil {
+					return
+				}
+				manager.Lock()
+				defer manager.Unlock()
+				manager.remotePods.deleteMeta(meta)
+			},
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				meta := getMeta(newObj)
+				if meta == nil {
+					return
+				}
+				manager.Lock()
+				defer manager.Unlock()
+				manager.remotePods.setMeta(meta)
+			},
+		},
+	)
+
+	manager.addEventHandler(manager.informerFactory.Discovery().V1().EndpointSlices().Informer(),
+		cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				slice := NewEndpointSliceInfo(obj.(*discoveryv1.EndpointSlice))
+				manager.Lock()
+				defer manager.Unlock()
+				manager.remotePods.setSlice(slice)
+			},
+			DeleteFunc: func(obj interface{}) {
+				slice := NewEndpointSliceInfo(getDeletedObject(obj).(*discoveryv1.EndpointSlice))
+				manager.Lock()
+				defer manager.Unlock()
+				manager.remotePods.deleteSlice(slice)
+			},
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				slice := NewEndpointSliceInfo(newObj.(*discoveryv1.EndpointSlice))
+				manager.Lock()
+				defer manager.Unlock()
+				manager.remotePods.setSlice(slice)
+			},
+		},
+	)
+}
@@ -4,20 +4,28 @@ import (
 	"bytes"
 	"fmt"
 	"k8s.io/api/core/v1"
+	"strings"
 )
 
 type ServicePortInfo struct {
 	Port       uint32
 	TargetPort uint32
+	NodePort   uint32
 	Name       string
+	//from appProtocol or port name, empty if unknown
+	Protocol string
 }
 type ServiceInfo struct {
 	ResourceVersion string
 	name            string
 	namespace       string
 	ClusterIP       string
-	selector        map[string]string
-	Ports           []*ServicePortInfo
+	ExternalIPs     []string
+	LoadBalancerIPs []string
+	//dns name of an ExternalName service, lower case without trailing dot
+	ExternalName string
+	selector     map[string]string
+	Ports        []*ServicePortInfo
 }
 
 func (service *ServiceInfo) Type() ResourceType {
@@ -28,6 +36,32 @@ func (service *ServiceInfo) IsKubeAPIService() bool {
 	return service.Name() == "kubernetes" && service.Namespace() == "default"
 }
 
+// ip addresses other than cluster ip that the service is exposed on
+func (service *ServiceInfo) GetEntryIPs() []string {
+	var result []string
+	result = append(result, service.ExternalIPs...)
+	result = append(result, service.LoadBalancerIPs...)
+	return result
+}
+
+func (service *ServiceInfo) GetPort(port uint32) *ServicePortInfo {
+	for _, portInfo := range service.Ports {
+		if portInfo.Port == port {
+			return portInfo
+		}
+	}
+	return nil
+}
+
+func (service *ServiceInfo) GetNodePort(nodePort uint32) *ServicePortInfo {
+	for _, portInfo := range service.Ports {
+		if portInfo.NodePort == nodePort {
+			return portInfo
+		}
+	}
+	return nil
+}
+
 func (service *ServiceInfo) Name() string {
 	return service.name
 }
@@ -51,6 +85,10 @@ func (service *ServiceInfo) String() string {
 	return buffer.String()
 }
 
+func normalizeDnsName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
 func NewServiceInfo(service *v1.Service) *ServiceInfo {
 
 	info := &ServiceInfo{
@@ -58,21 +96,132 @@ func NewServiceInfo(service *v1.Service) *ServiceInfo {
 		namespace:       service.Namespace,
 		selector:        service.Spec.Selector,
 		ClusterIP:       service.Spec.ClusterIP,
+		ExternalIPs:     service.Spec.ExternalIPs,
 		ResourceVersion: service.ResourceVersion,
 	}
+	if service.Spec.Type == v1.ServiceTypeExternalName {
+		info.ExternalName = normalizeDnsName(service.Spec.ExternalName)
+	}
+	for _, ingress := range service.Status.LoadBalancer.Ingress {
+		if ingress.IP != "" {
+			info.LoadBalancerIPs = append(info.LoadBalancerIPs, ingress.IP)
+		}
+	}
 	for _, port := range service.Spec.Ports {
 		var targetPort uint32
 		if port.TargetPort.IntVal > 0 {
 			targetPort = uint32(port.TargetPort.IntVal)
 		}
 
+		protocol := getPortNameProtocol(port.Name)
+		if port.AppProtocol != nil && *port.AppProtocol != "" {
+			protocol = normalizeProtocol(*port.AppProtocol)
+		}
+
 		info.Ports = append(info.Ports, &ServicePortInfo{
 			Name:       port.Name,
 			Port:       uint32(port.Port),
 			TargetPort: targetPort,
+			NodePort:   uint32(port.NodePort),
+			Protocol:   protocol,
 		})
 	}
 
 	return info
 
 }
+
+// serviceIndex maps service addresses to services.
+// It is copied on write, so lookups from packet handling need no lock
+type serviceIndex struct {
+	clusterIPMap map[string]*ServiceInfo
+	entryIPMap   map[string][]*ServiceInfo
+	nodePortMap  map[uint32]*ServiceInfo
+	//dns name to ExternalName services
+	externalNameMap map[string][]*ServiceInfo
+}
+
+func newServiceIndex() *serviceIndex {
+	return &serviceIndex{
+		clusterIPMap:    make(map[string]*ServiceInfo),
+		entryIPMap:      make(map[string][]*ServiceInfo),
+		nodePortMap:     make(map[uint32]*ServiceInfo),
+		externalNameMap: make(map[string][]*ServiceInfo),
+	}
+}
+
+func (index *serviceIndex) copy() *serviceIndex {
+	result := newServiceIndex()
+	for k, v := range index.clusterIPMap {
+		result.clusterIPMap[k] = v
+	}
+	for k, v := range index.entryIPMap {
+		result.entryIPMap[k] = v
+	}
+	for k, v := range index.nodePortMap {
+		result.nodePortMap[k] = v
+	}
+	for k, v := range index.externalNameMap {
+		result.externalNameMap[k] = v
+	}
+	return result
+}
+
+func (index *serviceIndex) add(info *ServiceInfo) {
+	if info.ClusterIP != "" {
+		index.clusterIPMap[info.ClusterIP] = info
+	}
+	for _, ip := range info.GetEntryIPs() {
+		services := append([]*ServiceInfo(nil), index.entryIPMap[ip]...)
+		index.entryIPMap[ip] = append(services, info)
+	}
+	for _, port := range info.Ports {
+		if port.NodePort > 0 {
+			index.nodePortMap[port.NodePort] = info
+		}
+	}
+	if info.ExternalName != "" {
+		services := append([]*ServiceInfo(nil), index.externalNameMap[info.ExternalName]...)
+		index.externalNameMap[info.ExternalName] = append(services, info)
+	}
+}
+
+func removeService(services []*ServiceInfo, info *ServiceInfo) []*ServiceInfo {
+	var result []*ServiceInfo
+	for _, service := range services {
+		if service.Name() == info.Name() && service.Namespace() == info.Namespace() {
+			continue
+		}
+		result = append(result, service)
+	}
+	return result
+}
+
+func (index *serviceIndex) remove(info *ServiceInfo) {
+	currentInfo := index.clusterIPMap[info.ClusterIP]
+	if currentInfo != nil && currentInfo.Name() == info.Name() && currentInfo.Namespace() == info.Namespace() {
+		delete(index.clusterIPMap, info.ClusterIP)
+	}
+	for _, ip := range info.GetEntryIPs() {
+		services := removeService(index.entryIPMap[ip], info)
+		if len(services) == 0 {
+			delete(index.entryIPMap, ip)
+		} else {
+			index.entryIPMap[ip] = services
+		}
+	}
+	if info.ExternalName != "" {
+		services := removeService(index.externalNameMap[info.ExternalName], info)
+		if len(services) == 0 {
+			delete(index.externalNameMap, info.ExternalName)
+		} else {
+			index.externalNameMap[info.ExternalName] = services
+		}
+	}
+	for _, port := range info.Ports {
+		currentInfo = index.nodePortMap[port.NodePort]
+		if currentInfo != nil && currentInfo.Name() == info.Name() && currentInfo.Namespace() == info.Namespace() {
+			delete(index.nodePortMap, port.NodePort)
+		}
+	}
+}
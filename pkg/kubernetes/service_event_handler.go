@@ -2,10 +2,8 @@ package kubernetes
 
 import (
 	"k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/client-go/tools/cache"
 	"reflect"
-	"time"
 )
 
 type ServiceEventHandler interface {
@@ -21,17 +19,20 @@ func (manager *K8sResourceManager) ServiceValid(info *ServiceInfo) bool {
 
 func (manager *K8sResourceManager) ServiceAdded(info *ServiceInfo) {
 	manager.addResource(info)
-	if info.ClusterIP != "" {
-		manager.serviceIPMap[info.ClusterIP] = info
-	}
+	manager.addServiceEndpoints(info)
+
+	index := manager.getServiceIndex().copy()
+	index.add(info)
+	manager.serviceIndex.Store(index)
 }
 
 func (manager *K8sResourceManager) ServiceDeleted(info *ServiceInfo) {
 	manager.removeResource(info)
-	currentInfo := manager.serviceIPMap[info.ClusterIP]
-	if currentInfo != nil && currentInfo.Name() == info.Name() && currentInfo.Namespace() == info.Namespace() {
-		delete(manager.serviceIPMap, info.ClusterIP)
-	}
+	manager.removeServiceEndpoints(info)
+
+	index := manager.getServiceIndex().copy()
+	index.remove(info)
+	manager.serviceIndex.Store(index)
 }
 
 func (manager *K8sResourceManager) ServiceUpdated(oldService, newService *ServiceInfo) {
@@ -39,14 +40,8 @@ func (manager *K8sResourceManager) ServiceUpdated(oldService, newService *Servic
 	manager.ServiceAdded(newService)
 }
 
-func (manager *K8sResourceManager) WatchServices(stopper chan struct{}, handlers ...ServiceEventHandler) {
-	watchlist := cache.NewListWatchFromClient(
-		manager.clientSet.CoreV1().RESTClient(), "services", "",
-		fields.Everything())
-	_, controller := cache.NewInformer(
-		watchlist,
-		&v1.Service{},
-		time.Second*0,
+func (manager *K8sResourceManager) WatchServices(handlers ...ServiceEventHandler) {
+	manager.addEventHandler(manager.informerFactory.Core().V1().Services().Informer(),
 		cache.ResourceEventHandlerFuncs{
 			AddFunc: func(obj interface{}) {
 				service := NewServiceInfo(obj.(*v1.Service))
@@ -61,7 +56,7 @@ func (manager *K8sResourceManager) WatchServices(stopper chan struct{}, handlers
 				}
 			},
 			DeleteFunc: func(obj interface{}) {
-				service := NewServiceInfo(obj.(*v1.Service))
+				service := NewServiceInfo(getDeletedObject(obj).(*v1.Service))
 
 				manager.Lock()
 				defer manager.Unlock()
@@ -101,5 +96,4 @@ func (manager *K8sResourceManager) WatchServices(stopper chan struct{}, handlers
 			},
 		},
 	)
-	controller.Run(stopper)
 }
@@ -0,0 +1,51 @@
+package procfs
+
+import (
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+var (
+	//cgroupfs driver: /kubepods/burstable/pod<uid>/<container id>
+	//systemd driver: /kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod<uid with _>.slice/docker-<container id>.scope
+	podUIDRegexp      = regexp.MustCompile(`pod([0-9a-f]{8}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{12})`)
+	containerIdRegexp = regexp.MustCompile(`([0-9a-f]{64})(\.scope)?$`)
+)
+
+// ProcessInfo is the container of a process, PodUID is empty if the process is not in a pod
+type ProcessInfo struct {
+	Pid         int
+	PodUID      string
+	ContainerID string
+}
+
+// parseCgroup finds pod uid and container id from the content of /proc/<pid>/cgroup
+func parseCgroup(pid int, content string) *ProcessInfo {
+	result := &ProcessInfo{Pid: pid}
+	for _, line := range strings.Split(content, "\n") {
+		//hierarchy-ID:controller-list:cgroup-path
+		items := strings.SplitN(line, ":", 3)
+		if len(items) != 3 {
+			continue
+		}
+		match := podUIDRegexp.FindStringSubmatch(items[2])
+		if match == nil {
+			continue
+		}
+		result.PodUID = strings.Replace(match[1], "_", "-", -1)
+		if match = containerIdRegexp.FindStringSubmatch(items[2]); match != nil {
+			result.ContainerID = match[1]
+		}
+		return result
+	}
+	return result
+}
+
+func readCgroup(path string, pid int) (*ProcessInfo, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseCgroup(pid, string(data)), nil
+}
@@ -0,0 +1,175 @@
+package procfs
+
+import (
+	"github.com/golang/glog"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	SOCKET_REFRESH_INTERVAL = time.Second
+	//sockets are read again soon after a socket is not found, e.g. a new client connection
+	SOCKET_MISS_REFRESH_INTERVAL = 100 * time.Millisecond
+	PROCESS_REFRESH_INTERVAL     = 5 * time.Second
+)
+
+// socketState is a snapshot of sockets and their processes, it is never modified once stored
+type socketState struct {
+	sockets        *socketIndex
+	inodePids      map[uint64]int
+	processes      map[int]*ProcessInfo
+	pidsUpdateTime time.Time
+}
+
+// SocketResolver maps a local tcp socket to its owning process and the process's pod.
+// The sockets are read from <procPath>/net/tcp{,6}, which are of the network namespace of the agent,
+// so the agent should run in host network to resolve host network pods, and in host pid namespace to read their fds.
+// /proc is read by the goroutine of Start, GetProcess only looks up the latest snapshot
+type SocketResolver struct {
+	procPath string
+	state    atomic.Value
+	//signals the refresh goroutine that a socket is not found
+	missed chan struct{}
+	now    func() time.Time
+}
+
+func NewSocketResolver(procPath string) *SocketResolver {
+	result := &SocketResolver{
+		procPath: procPath,
+		missed:   make(chan struct{}, 1),
+		now:      time.Now,
+	}
+	result.state.Store(&socketState{sockets: newSocketIndex(nil)})
+	return result
+}
+
+func (resolver *SocketResolver) getState() *socketState {
+	return resolver.state.Load().(*socketState)
+}
+
+func (resolver *SocketResolver) readSockets() *socketIndex {
+	var sockets []socketInfo
+	for _, name := range []string{"tcp", "tcp6"} {
+		result, err := readSockets(filepath.Join(resolver.procPath, "net", name))
+		if err != nil {
+			glog.Warningf("Failed to read sockets: %s", err.Error())
+			continue
+		}
+		sockets = append(sockets, result...)
+	}
+	return newSocketIndex(sockets)
+}
+
+// readPids scans socket fds of all processes, and reads cgroups of the processes owning sockets
+func (resolver *SocketResolver) readPids() (map[uint64]int, map[int]*ProcessInfo) {
+	inodePids := make(map[uint64]int)
+	processes := make(map[int]*ProcessInfo)
+
+	dirs, err := ioutil.ReadDir(resolver.procPath)
+	if err != nil {
+		glog.Warningf("Failed to read %s: %s", resolver.procPath, err.Error())
+		return inodePids, processes
+	}
+	for _, dir := range dirs {
+		pid, err := strconv.Atoi(dir.Name())
+		if err != nil {
+			continue
+		}
+		fdPath := filepath.Join(resolver.procPath, dir.Name(), "fd")
+		fds, err := ioutil.ReadDir(fdPath)
+		if err != nil {
+			//the process has exited or is not accessible
+			continue
+		}
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(fdPath, fd.Name()))
+			if err != nil || !strings.HasPrefix(link, "socket:[") {
+				continue
+			}
+			inode, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]"), 10, 64)
+			if err != nil {
+				continue
+			}
+			inodePids[inode] = pid
+			if _, ok := processes[pid]; !ok {
+				processes[pid] = resolver.readProcess(pid)
+			}
+		}
+	}
+	return inodePids, processes
+}
+
+func (resolver *SocketResolver) readProcess(pid int) *ProcessInfo {
+	process, err := readCgroup(filepath.Join(resolver.procPath, strconv.Itoa(pid), "cgroup"), pid)
+	if err != nil {
+		if glog.V(2) {
+			glog.Infof("Failed to read cgroup of %d: %s", pid, err.Error())
+		}
+		return nil
+	}
+	return process
+}
+
+// refresh reads sockets, and processes every PROCESS_REFRESH_INTERVAL
+func (resolver *SocketResolver) refresh() {
+	old := resolver.getState()
+	state := &socketState{
+		sockets:        resolver.readSockets(),
+		inodePids:      old.inodePids,
+		processes:      old.processes,
+		pidsUpdateTime: old.pidsUpdateTime,
+	}
+	now := resolver.now()
+	if state.inodePids == nil || now.Sub(state.pidsUpdateTime) >= PROCESS_REFRESH_INTERVAL {
+		state.inodePids, state.processes = resolver.readPids()
+		state.pidsUpdateTime = now
+	}
+	resolver.state.Store(state)
+}
+
+// Start reads /proc, then refreshes it in background every SOCKET_REFRESH_INTERVAL,
+// or SOCKET_MISS_REFRESH_INTERVAL after a socket is not found
+func (resolver *SocketResolver) Start() {
+	resolver.refresh()
+	go func() {
+		ticker := time.NewTicker(SOCKET_REFRESH_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-resolver.missed:
+			}
+			resolver.refresh()
+			time.Sleep(SOCKET_MISS_REFRESH_INTERVAL)
+		}
+	}()
+}
+
+// GetProcess returns the process which owns the local socket ip:port, nil if not found.
+// A socket opened after the last refresh is not found until the next one
+func (resolver *SocketResolver) GetProcess(ip string, port uint32) *ProcessInfo {
+	netIp := net.ParseIP(ip)
+	if netIp == nil {
+		return nil
+	}
+	state := resolver.getState()
+	inode := state.sockets.find(netIp, port)
+	if inode == 0 {
+		select {
+		case resolver.missed <- struct{}{}:
+		default:
+		}
+		return nil
+	}
+	pid, ok := state.inodePids[inode]
+	if !ok {
+		return nil
+	}
+	return state.processes[pid]
+}
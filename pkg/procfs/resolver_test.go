@@ -0,0 +1,126 @@
+package procfs
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const (
+	testTcp = `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000:0050 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 1001 1 0000000000000000 100 0 0 10 0
+   1: 0101010C:0035 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 1002 1 0000000000000000 100 0 0 10 0
+   2: 0101010C:C350 0201010C:0050 01 00000000:00000000 00:00000000 00000000     0        0 1003 1 0000000000000000 20 4 30 10 -1
+   3: 0101010C:1F90 0201010C:D431 06 00000000:00000000 00:00000000 00000000     0        0 0 1 0000000000000000 20 4 30 10 -1
+`
+	testTcp6 = `  sl  local_address                         remote_address                        st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000000000000000000000000000:1F90 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 1004 1 0000000000000000 100 0 0 10 0
+`
+	testCgroupfs = `12:pids:/kubepods/burstable/pod0b7d8a0c-6b8e-11e9-a1b2-0242ac110002/4a0a1c2e3f4a5b6c7d8e9f0a1b2c3d4e5f6a7b8c9d0e1f2a3b4c5d6e7f8a9b0c
+1:name=systemd:/kubepods/burstable/pod0b7d8a0c-6b8e-11e9-a1b2-0242ac110002/4a0a1c2e3f4a5b6c7d8e9f0a1b2c3d4e5f6a7b8c9d0e1f2a3b4c5d6e7f8a9b0c
+`
+	testSystemd = `0::/kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod1c2d3e4f_5a6b_7c8d_9e0f_a1b2c3d4e5f6.slice/cri-containerd-5f6a7b8c9d0e1f2a3b4c5d6e7f8a9b0c4a0a1c2e3f4a5b6c7d8e9f0a1b2c3d4e.scope
+`
+	testHost = `1:name=systemd:/system.slice/kubelet.service
+`
+)
+
+func writeTestFile(t *testing.T, path string, content string) {
+	assert.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+	assert.Nil(t, ioutil.WriteFile(path, []byte(content), 0644))
+}
+
+func addTestProcess(t *testing.T, procPath string, pid string, cgroup string, sockets ...string) {
+	writeTestFile(t, filepath.Join(procPath, pid, "cgroup"), cgroup)
+	fdPath := filepath.Join(procPath, pid, "fd")
+	assert.Nil(t, os.MkdirAll(fdPath, 0755))
+	assert.Nil(t, os.Symlink("/dev/null", filepath.Join(fdPath, "0")))
+	for i, socket := range sockets {
+		assert.Nil(t, os.Symlink("socket:["+socket+"]", filepath.Join(fdPath, string(rune('3'+i)))))
+	}
+}
+
+func TestParseHexAddress(t *testing.T) {
+	ip, port, err := parseHexAddress("0100007F:0050")
+	assert.Nil(t, err)
+	assert.Equal(t, ip.String(), "127.0.0.1")
+	assert.Equal(t, port, uint32(80))
+
+	ip, port, err = parseHexAddress("0000000000000000FFFF00000100007F:1F90")
+	assert.Nil(t, err)
+	assert.True(t, ip.Equal(net.ParseIP("127.0.0.1")))
+	assert.Equal(t, port, uint32(8080))
+
+	_, _, err = parseHexAddress("0100007F")
+	assert.NotNil(t, err)
+}
+
+func TestParseCgroup(t *testing.T) {
+	process := parseCgroup(1, testCgroupfs)
+	assert.Equal(t, process.PodUID, "0b7d8a0c-6b8e-11e9-a1b2-0242ac110002")
+	assert.Equal(t, process.ContainerID, "4a0a1c2e3f4a5b6c7d8e9f0a1b2c3d4e5f6a7b8c9d0e1f2a3b4c5d6e7f8a9b0c")
+
+	process = parseCgroup(2, testSystemd)
+	assert.Equal(t, process.PodUID, "1c2d3e4f-5a6b-7c8d-9e0f-a1b2c3d4e5f6")
+	assert.Equal(t, process.ContainerID, "5f6a7b8c9d0e1f2a3b4c5d6e7f8a9b0c4a0a1c2e3f4a5b6c7d8e9f0a1b2c3d4e")
+
+	process = parseCgroup(3, testHost)
+	assert.Equal(t, process.PodUID, "")
+}
+
+func TestSocketResolver(t *testing.T) {
+	procPath, err := ioutil.TempDir("", "proc")
+	assert.Nil(t, err)
+	defer os.RemoveAll(procPath)
+
+	writeTestFile(t, filepath.Join(procPath, "net", "tcp"), testTcp)
+	writeTestFile(t, filepath.Join(procPath, "net", "tcp6"), testTcp6)
+	addTestProcess(t, procPath, "100", testCgroupfs, "1001", "1003")
+	addTestProcess(t, procPath, "200", testSystemd, "1002")
+	addTestProcess(t, procPath, "300", testHost, "1004")
+	writeTestFile(t, filepath.Join(procPath, "self", "cgroup"), testHost)
+
+	now := time.Now()
+	resolver := NewSocketResolver(procPath)
+	resolver.now = func() time.Time { return now }
+	resolver.refresh()
+
+	//listening on any address
+	process := resolver.GetProcess("12.1.1.1", 80)
+	assert.NotNil(t, process)
+	assert.Equal(t, process.Pid, 100)
+	assert.Equal(t, process.PodUID, "0b7d8a0c-6b8e-11e9-a1b2-0242ac110002")
+
+	//client connection
+	process = resolver.GetProcess("12.1.1.1", 50000)
+	assert.Equal(t, process.Pid, 100)
+
+	process = resolver.GetProcess("12.1.1.1", 53)
+	assert.Equal(t, process.Pid, 200)
+	assert.Equal(t, process.PodUID, "1c2d3e4f-5a6b-7c8d-9e0f-a1b2c3d4e5f6")
+	assert.Nil(t, resolver.GetProcess("12.1.1.2", 53))
+
+	//tcp6 socket of a process not in a pod
+	process = resolver.GetProcess("12.1.1.1", 8080)
+	assert.Equal(t, process.Pid, 300)
+	assert.Equal(t, process.PodUID, "")
+
+	//new socket is found after refresh, its process after process refresh interval
+	writeTestFile(t, filepath.Join(procPath, "net", "tcp"), testTcp+
+		"   4: 0101010C:2328 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 1005 1 0000000000000000 100 0 0 10 0\n")
+	addTestProcess(t, procPath, "400", testSystemd, "1005")
+	assert.Nil(t, resolver.GetProcess("12.1.1.1", 9000))
+	//the miss wakes up the refresh goroutine
+	assert.Equal(t, len(resolver.missed), 1)
+	resolver.refresh()
+	assert.Nil(t, resolver.GetProcess("12.1.1.1", 9000))
+	now = now.Add(PROCESS_REFRESH_INTERVAL)
+	resolver.refresh()
+	process = resolver.GetProcess("12.1.1.1", 9000)
+	assert.NotNil(t, process)
+	assert.Equal(t, process.Pid, 400)
+}
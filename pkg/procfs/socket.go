@@ -0,0 +1,130 @@
+package procfs
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	TCP_ESTABLISHED = 0x01
+	TCP_LISTEN      = 0x0A
+)
+
+type socketInfo struct {
+	localIp   net.IP
+	localPort uint32
+	state     uint8
+	inode     uint64
+}
+
+// parseHexAddress parses address like "0100007F:0050", ip is in host byte order of 32 bit words
+func parseHexAddress(address string) (net.IP, uint32, error) {
+	items := strings.Split(address, ":")
+	if len(items) != 2 {
+		return nil, 0, fmt.Errorf("unexpected address %s", address)
+	}
+	port, err := strconv.ParseUint(items[1], 16, 16)
+	if err != nil {
+		return nil, 0, fmt.Errorf("unexpected port %s", address)
+	}
+	data, err := hex.DecodeString(items[0])
+	if err != nil || (len(data) != net.IPv4len && len(data) != net.IPv6len) {
+		return nil, 0, fmt.Errorf("unexpected ip %s", address)
+	}
+	ip := make(net.IP, len(data))
+	for i := 0; i < len(data); i += 4 {
+		ip[i], ip[i+1], ip[i+2], ip[i+3] = data[i+3], data[i+2], data[i+1], data[i]
+	}
+	return ip, uint32(port), nil
+}
+
+// readSockets parses /proc/net/tcp or /proc/net/tcp6, a missing file is ignored
+func readSockets(path string) ([]socketInfo, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var result []socketInfo
+	scanner := bufio.NewScanner(file)
+	//skip header: sl local_address rem_address st tx_queue rx_queue tr tm->when retrnsmt uid timeout inode
+	scanner.Scan()
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		ip, port, err := parseHexAddress(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		state, err := strconv.ParseUint(fields[3], 16, 8)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected state %s", fields[3])
+		}
+		inode, err := strconv.ParseUint(fields[9], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected inode %s", fields[9])
+		}
+		result = append(result, socketInfo{localIp: ip, localPort: port, state: uint8(state), inode: inode})
+	}
+	return result, scanner.Err()
+}
+
+type socketKey struct {
+	ip   [net.IPv6len]byte
+	port uint32
+}
+
+func getSocketKey(ip net.IP, port uint32) socketKey {
+	key := socketKey{port: port}
+	copy(key.ip[:], ip.To16())
+	return key
+}
+
+// socketIndex finds inodes of established or listening sockets by local address
+type socketIndex struct {
+	bound map[socketKey]uint64
+	//sockets listening on any address by port
+	listenAny map[uint32]uint64
+}
+
+func newSocketIndex(sockets []socketInfo) *socketIndex {
+	result := &socketIndex{
+		bound:     make(map[socketKey]uint64),
+		listenAny: make(map[uint32]uint64),
+	}
+	for _, socket := range sockets {
+		if socket.inode == 0 || (socket.state != TCP_ESTABLISHED && socket.state != TCP_LISTEN) {
+			continue
+		}
+		if socket.state == TCP_LISTEN && socket.localIp.IsUnspecified() {
+			if _, ok := result.listenAny[socket.localPort]; !ok {
+				result.listenAny[socket.localPort] = socket.inode
+			}
+			continue
+		}
+		key := getSocketKey(socket.localIp, socket.localPort)
+		if _, ok := result.bound[key]; !ok {
+			result.bound[key] = socket.inode
+		}
+	}
+	return result
+}
+
+// find prefers the socket bound to the ip, then a socket listening on any address, 0 if not found
+func (index *socketIndex) find(ip net.IP, port uint32) uint64 {
+	if inode, ok := index.bound[getSocketKey(ip, port)]; ok {
+		return inode
+	}
+	return index.listenAny[port]
+}
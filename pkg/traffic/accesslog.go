@@ -0,0 +1,233 @@
+package traffic
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/luguoxiang/kubernetes-traffic-monitor/pkg/config"
+	"io"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ACCESS_LOG_JSON   = "json"
+	ACCESS_LOG_LOGFMT = "logfmt"
+)
+
+type accessLogField struct {
+	name string
+	//nil value omits the field
+	value func(info *TrafficInfo) interface{}
+}
+
+// bodySizeValue omits an unknown body size
+func bodySizeValue(size int64) interface{} {
+	if size < 0 {
+		return nil
+	}
+	return size
+}
+
+// accessLogFields are written in this order
+var accessLogFields = []accessLogField{
+	{"time", func(info *TrafficInfo) interface{} {
+		return time.Unix(0, info.requestTimestampNano).UTC().Format(time.RFC3339Nano)
+	}},
+	{"source_ip", func(info *TrafficInfo) interface{} { return info.SrcIP }},
+	{"source_pod", func(info *TrafficInfo) interface{} { return info.SrcPod }},
+	{"source", func(info *TrafficInfo) interface{} { return info.Src }},
+	{"source_ns", func(info *TrafficInfo) interface{} { return info.SrcNS }},
+	{"client_ip", func(info *TrafficInfo) interface{} { return info.ClientIP }},
+	{"destination_ip", func(info *TrafficInfo) interface{} { return info.DstIP }},
+	{"destination_port", func(info *TrafficInfo) interface{} { return info.DstPort }},
+	{"destination_pod", func(info *TrafficInfo) interface{} { return info.DstPod }},
+	{"destination", func(info *TrafficInfo) interface{} { return info.Dst }},
+	{"destination_ns", func(info *TrafficInfo) interface{} { return info.DstNS }},
+	{"entry_service", func(info *TrafficInfo) interface{} { return info.EntryService }},
+	{"entry_service_ns", func(info *TrafficInfo) interface{} { return info.EntryServiceNS }},
+	{"protocol", func(info *TrafficInfo) interface{} { return info.Protocol }},
+	{"method", func(info *TrafficInfo) interface{} { return info.Method }},
+	{"url", func(info *TrafficInfo) interface{} { return info.Url }},
+	{"path", func(info *TrafficInfo) interface{} { return info.Path }},
+	{"status", func(info *TrafficInfo) interface{} { return info.Status }},
+	{"duration_ms", func(info *TrafficInfo) interface{} { return info.GetDurationTimeMiliSeconds() }},
+	{"request_bytes", func(info *TrafficInfo) interface{} { return bodySizeValue(info.RequestBodyBytes) }},
+	{"response_bytes", func(info *TrafficInfo) interface{} { return bodySizeValue(info.ResponseBodyBytes) }},
+	{"observer", func(info *TrafficInfo) interface{} { return info.Observer }},
+}
+
+// rotatingFile renames the file to path.1 when it exceeds maxSize, older files are shifted to path.2 ... path.<maxBackups>
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	result := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := result.open(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (file *rotatingFile) open() error {
+	f, err := os.OpenFile(file.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to open access log %s: %s", file.path, err.Error())
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("Failed to open access log %s: %s", file.path, err.Error())
+	}
+	file.file = f
+	file.size = stat.Size()
+	return nil
+}
+
+func (file *rotatingFile) rotate() error {
+	file.file.Close()
+	if file.maxBackups <= 0 {
+		os.Remove(file.path)
+	} else {
+		os.Remove(fmt.Sprintf("%s.%d", file.path, file.maxBackups))
+		for i := file.maxBackups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", file.path, i), fmt.Sprintf("%s.%d", file.path, i+1))
+		}
+		os.Rename(file.path, file.path+".1")
+	}
+	return file.open()
+}
+
+func (file *rotatingFile) Write(data []byte) (int, error) {
+	if file.maxSize > 0 && file.size > 0 && file.size+int64(len(data)) > file.maxSize {
+		if err := file.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := file.file.Write(data)
+	file.size += int64(n)
+	return n, err
+}
+
+// AccessLogSink writes a json or logfmt line for each completed request
+type AccessLogSink struct {
+	writer     io.Writer
+	logfmt     bool
+	sampleRate float64
+	fields     []accessLogField
+	random     func() float64
+}
+
+func NewAccessLogSink(accessLogConfig *config.AccessLogConfig) (*AccessLogSink, error) {
+	var writer io.Writer = os.Stdout
+	if accessLogConfig.Path != "" {
+		file, err := openRotatingFile(accessLogConfig.Path, int64(accessLogConfig.MaxSizeMB)*1024*1024, accessLogConfig.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		writer = file
+	}
+	return newAccessLogSink(accessLogConfig, writer)
+}
+
+func newAccessLogSink(accessLogConfig *config.AccessLogConfig, writer io.Writer) (*AccessLogSink, error) {
+	result := &AccessLogSink{
+		writer:     writer,
+		sampleRate: accessLogConfig.SampleRate,
+		random:     rand.Float64,
+	}
+	switch accessLogConfig.Format {
+	case ACCESS_LOG_JSON, "":
+	case ACCESS_LOG_LOGFMT:
+		result.logfmt = true
+	default:
+		return nil, fmt.Errorf("Unknown access log format %s", accessLogConfig.Format)
+	}
+	if len(accessLogConfig.Fields) == 0 {
+		result.fields = accessLogFields
+	}
+	for _, name := range accessLogConfig.Fields {
+		found := false
+		for _, field := range accessLogFields {
+			if field.name == name {
+				result.fields = append(result.fields, field)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("Unknown access log field %s", name)
+		}
+	}
+	return result, nil
+}
+
+func formatLogfmtValue(value interface{}) string {
+	var result string
+	switch v := value.(type) {
+	case string:
+		result = v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+	if result == "" || strings.ContainsAny(result, " =") || strconv.Quote(result) != `"`+result+`"` {
+		return strconv.Quote(result)
+	}
+	return result
+}
+
+func (sink *AccessLogSink) format(info *TrafficInfo) []byte {
+	var buffer bytes.Buffer
+	if !sink.logfmt {
+		buffer.WriteString("{")
+	}
+	written := 0
+	for _, field := range sink.fields {
+		value := field.value(info)
+		if value == nil {
+			continue
+		}
+		written++
+		if sink.logfmt {
+			if written > 1 {
+				buffer.WriteString(" ")
+			}
+			buffer.WriteString(field.name)
+			buffer.WriteString("=")
+			buffer.WriteString(formatLogfmtValue(value))
+			continue
+		}
+		if written > 1 {
+			buffer.WriteString(",")
+		}
+		data, _ := json.Marshal(value)
+		buffer.WriteString(strconv.Quote(field.name))
+		buffer.WriteString(":")
+		buffer.Write(data)
+	}
+	if !sink.logfmt {
+		buffer.WriteString("}")
+	}
+	buffer.WriteString("\n")
+	return buffer.Bytes()
+}
+
+func (sink *AccessLogSink) Save(info *TrafficInfo) {
+	if sink.sampleRate < 1 && sink.random() >= sink.sampleRate {
+		return
+	}
+	if _, err := sink.writer.Write(sink.format(info)); err != nil {
+		glog.Warningf("Failed to write access log: %s", err.Error())
+	}
+}
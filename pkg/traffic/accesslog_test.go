@@ -0,0 +1,88 @@
+package traffic
+
+import (
+	"bytes"
+	"github.com/luguoxiang/kubernetes-traffic-monitor/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAccessLogSink(t *testing.T) {
+	info := &TrafficInfo{
+		SrcIP:                 "10.1.1.1",
+		SrcPod:                "a-5d8f-x2",
+		Src:                   "a",
+		SrcNS:                 "test",
+		DstPort:               8080,
+		Dst:                   "b",
+		DstNS:                 "test",
+		Method:                "GET",
+		Url:                   "/users/1?q=a b",
+		Status:                "200",
+		RequestBytes:          120,
+		RequestBodyBytes:      100,
+		ResponseBodyBytes:     -1,
+		requestTimestampNano:  1e9,
+		responseTimestampNano: 1e9 + 2500000,
+	}
+	var buffer bytes.Buffer
+	sink, err := newAccessLogSink(&config.AccessLogConfig{SampleRate: 1, Fields: []string{"time", "source_pod", "destination", "destination_port", "url", "duration_ms", "request_bytes", "response_bytes"}}, &buffer)
+	assert.Nil(t, err)
+	sink.Save(info)
+	assert.Equal(t, buffer.String(), `{"time":"1970-01-01T00:00:01Z","source_pod":"a-5d8f-x2","destination":"b","destination_port":8080,"url":"/users/1?q=a b","duration_ms":2.5,"request_bytes":100}`+"\n")
+
+	buffer.Reset()
+	sink, err = newAccessLogSink(&config.AccessLogConfig{Format: ACCESS_LOG_LOGFMT, SampleRate: 1, Fields: []string{"source", "destination_pod", "url", "duration_ms"}}, &buffer)
+	assert.Nil(t, err)
+	sink.Save(info)
+	assert.Equal(t, buffer.String(), `source=a destination_pod="" url="/users/1?q=a b" duration_ms=2.5`+"\n")
+
+	//all fields by default
+	buffer.Reset()
+	sink, err = newAccessLogSink(&config.AccessLogConfig{SampleRate: 1}, &buffer)
+	assert.Nil(t, err)
+	assert.Equal(t, len(sink.fields), len(accessLogFields))
+
+	//sampling
+	sink.sampleRate = 0.5
+	sink.random = func() float64 { return 0.7 }
+	sink.Save(info)
+	assert.Equal(t, buffer.Len(), 0)
+	sink.random = func() float64 { return 0.2 }
+	sink.Save(info)
+	assert.NotEqual(t, buffer.Len(), 0)
+
+	_, err = newAccessLogSink(&config.AccessLogConfig{Format: "xml"}, &buffer)
+	assert.NotNil(t, err)
+	_, err = newAccessLogSink(&config.AccessLogConfig{Fields: []string{"unknown"}}, &buffer)
+	assert.NotNil(t, err)
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "accesslog")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+
+	file, err := openRotatingFile(path, 10, 2)
+	assert.Nil(t, err)
+	for _, line := range []string{"aaaaaa\n", "bbbbbb\n", "cccccc\n", "dddddd\n"} {
+		_, err = file.Write([]byte(line))
+		assert.Nil(t, err)
+	}
+	for name, content := range map[string]string{"access.log": "dddddd\n", "access.log.1": "cccccc\n", "access.log.2": "bbbbbb\n"} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		assert.Nil(t, err)
+		assert.Equal(t, string(data), content)
+	}
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+
+	//size of an existing file counts
+	file, err = openRotatingFile(path, 10, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, file.size, int64(7))
+}
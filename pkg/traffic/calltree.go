@@ -0,0 +1,214 @@
+package traffic
+
+import (
+	"encoding/hex"
+	"github.com/golang/glog"
+	"sort"
+)
+
+// requests of more calls are dropped until the buffered call trees are emitted
+const MAX_CALL_RECORDS = 100000
+
+type callRecord struct {
+	info     *TrafficInfo
+	spanID   string
+	parent   *callRecord
+	children []*callRecord
+	//probability of the parent among concurrent inbound requests, 1 for a root
+	confidence float64
+	//weights of the parent and of all parent candidates
+	best  float64
+	total float64
+}
+
+func (record *callRecord) start() int64 {
+	return record.info.requestTimestampNano
+}
+
+func (record *callRecord) end() int64 {
+	return record.info.responseTimestampNano
+}
+
+// contains checks if the request of child could be sent by the pod while handling record,
+// the child must start after record arrives and end before record responds
+func (record *callRecord) contains(child *callRecord) bool {
+	return record.start() < child.start() && child.end() <= record.end()
+}
+
+// addCandidate makes the inbound request the parent if it is tighter than the current one
+func (record *callRecord) addCandidate(candidate *callRecord) {
+	weight := 1 / float64(candidate.end()-candidate.start())
+	record.total += weight
+	if weight > record.best {
+		record.best = weight
+		if record.parent != nil {
+			record.parent.children = removeRecord(record.parent.children, record)
+		}
+		record.parent = candidate
+		candidate.children = append(candidate.children, record)
+	}
+	record.confidence = record.best / record.total
+}
+
+func removeRecord(records []*callRecord, record *callRecord) []*callRecord {
+	for i, exist := range records {
+		if exist == record {
+			return append(records[:i], records[i+1:]...)
+		}
+	}
+	return records
+}
+
+// insertRecord keeps records sorted by start time
+func insertRecord(records []*callRecord, record *callRecord) []*callRecord {
+	i := sort.Search(len(records), func(i int) bool { return records[i].start() > record.start() })
+	records = append(records, nil)
+	copy(records[i+1:], records[i:])
+	records[i] = record
+	return records
+}
+
+// podCalls indexes buffered requests received and sent by a pod by start time
+type podCalls struct {
+	inbounds  []*callRecord
+	outbounds []*callRecord
+}
+
+func inboundKey(info *TrafficInfo) string {
+	if info.DstPod == "" {
+		return ""
+	}
+	return info.DstNS + "/" + info.DstPod
+}
+
+func outboundKey(info *TrafficInfo) string {
+	if info.SrcPod == "" {
+		return ""
+	}
+	return info.SrcNS + "/" + info.SrcPod
+}
+
+// CallTreeInferrer infers parent and child relationship of requests without trace headers.
+// An outbound request of a pod is a child candidate of each inbound request of the pod which contains it in time,
+// tighter inbound requests are more likely parents, and the confidence is shared by concurrent candidates.
+// A call tree is emitted when its root has completed for delayNano, since requests complete in any order,
+// the parent of a request is chosen when the request or a candidate is added.
+// It is not safe for concurrent use
+type CallTreeInferrer struct {
+	delayNano int64
+	//the latest response time, or the flush time if it is later
+	clockNano int64
+	records   []*callRecord
+	pods      map[string]*podCalls
+	dropped   int
+}
+
+func NewCallTreeInferrer(delayNano int64) *CallTreeInferrer {
+	return &CallTreeInferrer{delayNano: delayNano, pods: make(map[string]*podCalls)}
+}
+
+func (inferrer *CallTreeInferrer) getPod(key string) *podCalls {
+	pod := inferrer.pods[key]
+	if pod == nil {
+		pod = &podCalls{}
+		inferrer.pods[key] = pod
+	}
+	return pod
+}
+
+func (inferrer *CallTreeInferrer) Add(info *TrafficInfo) {
+	if info.responseTimestampNano > inferrer.clockNano {
+		inferrer.clockNano = info.responseTimestampNano
+	}
+	if len(inferrer.records) >= MAX_CALL_RECORDS {
+		inferrer.dropped++
+		return
+	}
+	record := &callRecord{info: info, spanID: hex.EncodeToString(randomId(8)), confidence: 1}
+	inferrer.records = append(inferrer.records, record)
+
+	if key := outboundKey(info); key != "" {
+		pod := inferrer.getPod(key)
+		//inbound requests of the pod starting before the request are parent candidates
+		for _, candidate := range pod.inbounds {
+			if candidate.start() >= record.start() {
+				break
+			}
+			if candidate.contains(record) {
+				record.addCandidate(candidate)
+			}
+		}
+		pod.outbounds = insertRecord(pod.outbounds, record)
+	}
+	if key := inboundKey(info); key != "" {
+		pod := inferrer.getPod(key)
+		//outbound requests of the pod starting inside the request are child candidates
+		i := sort.Search(len(pod.outbounds), func(i int) bool { return pod.outbounds[i].start() > record.start() })
+		for _, child := range pod.outbounds[i:] {
+			if child.start() >= record.end() {
+				break
+			}
+			if record.contains(child) {
+				child.addCandidate(record)
+			}
+		}
+		pod.inbounds = insertRecord(pod.inbounds, record)
+	}
+}
+
+// remove drops an emitted request from the pod index
+func (inferrer *CallTreeInferrer) remove(record *callRecord) {
+	if key := outboundKey(record.info); key != "" {
+		if pod := inferrer.pods[key]; pod != nil {
+			pod.outbounds = removeRecord(pod.outbounds, record)
+		}
+	}
+	if key := inboundKey(record.info); key != "" {
+		if pod := inferrer.pods[key]; pod != nil {
+			pod.inbounds = removeRecord(pod.inbounds, record)
+		}
+	}
+	for _, key := range []string{outboundKey(record.info), inboundKey(record.info)} {
+		if pod := inferrer.pods[key]; pod != nil && len(pod.inbounds) == 0 && len(pod.outbounds) == 0 {
+			delete(inferrer.pods, key)
+		}
+	}
+}
+
+// Flush returns call trees whose roots have completed for the delay, each tree is a list of requests from the root.
+// nowNano advances the clock when no request is captured
+func (inferrer *CallTreeInferrer) Flush(nowNano int64) [][]*callRecord {
+	if nowNano > inferrer.clockNano {
+		inferrer.clockNano = nowNano
+	}
+	if inferrer.dropped > 0 {
+		glog.Warningf("Dropped %d requests of call tree inference", inferrer.dropped)
+		inferrer.dropped = 0
+	}
+
+	var result [][]*callRecord
+	emitted := make(map[*callRecord]bool)
+	for _, record := range inferrer.records {
+		if record.parent != nil || record.end()+inferrer.delayNano > inferrer.clockNano {
+			continue
+		}
+		tree := []*callRecord{record}
+		for i := 0; i < len(tree); i++ {
+			tree = append(tree, tree[i].children...)
+		}
+		for _, node := range tree {
+			emitted[node] = true
+			inferrer.remove(node)
+		}
+		result = append(result, tree)
+	}
+
+	var remaining []*callRecord
+	for _, record := range inferrer.records {
+		if !emitted[record] {
+			remaining = append(remaining, record)
+		}
+	}
+	inferrer.records = remaining
+	return result
+}
@@ -0,0 +1,87 @@
+package traffic
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func newTestCall(src string, dst string, start int64, end int64) *TrafficInfo {
+	return &TrafficInfo{
+		SrcPod:                src,
+		SrcNS:                 "test",
+		DstPod:                dst,
+		DstNS:                 "test",
+		requestTimestampNano:  start * 1e6,
+		responseTimestampNano: end * 1e6,
+	}
+}
+
+func TestCallTreeInferrer(t *testing.T) {
+	inferrer := NewCallTreeInferrer(1000 * 1e6)
+	//client => frontend => (backend => db, cache)
+	backendToDb := newTestCall("backend", "db", 30, 40)
+	inferrer.Add(backendToDb)
+	frontendToBackend := newTestCall("frontend", "backend", 20, 60)
+	inferrer.Add(frontendToBackend)
+	frontendToCache := newTestCall("frontend", "cache", 65, 70)
+	inferrer.Add(frontendToCache)
+	clientToFrontend := newTestCall("", "frontend", 10, 100)
+	inferrer.Add(clientToFrontend)
+	//outside of any inbound request
+	lonely := newTestCall("backend", "db", 200, 210)
+	inferrer.Add(lonely)
+
+	//roots have not completed for the delay
+	assert.Equal(t, len(inferrer.Flush(0)), 0)
+	assert.Equal(t, len(inferrer.records), 5)
+
+	trees := inferrer.Flush(1101 * 1e6)
+	assert.Equal(t, len(trees), 1)
+	tree := trees[0]
+	assert.Equal(t, len(tree), 4)
+	assert.Equal(t, tree[0].info, clientToFrontend)
+	assert.Nil(t, tree[0].parent)
+	for _, record := range tree[1:] {
+		assert.Equal(t, record.confidence, float64(1))
+		switch record.info {
+		case frontendToBackend, frontendToCache:
+			assert.Equal(t, record.parent.info, clientToFrontend)
+		case backendToDb:
+			assert.Equal(t, record.parent.info, frontendToBackend)
+		}
+	}
+	assert.Equal(t, len(inferrer.records), 1)
+
+	trees = inferrer.Flush(1300 * 1e6)
+	assert.Equal(t, len(trees), 1)
+	assert.Equal(t, trees[0][0].info, lonely)
+	assert.Equal(t, len(inferrer.records), 0)
+	assert.Equal(t, len(inferrer.pods), 0)
+}
+
+func TestCallTreeConcurrency(t *testing.T) {
+	//two concurrent inbound requests contain the outbound request, the tighter one is more likely
+	wide := newTestCall("a", "b", 0, 100)
+	tight := newTestCall("c", "b", 10, 35)
+	child := newTestCall("b", "d", 20, 30)
+	//the parent does not depend on the order of completion
+	for _, calls := range [][]*TrafficInfo{{wide, tight, child}, {child, tight, wide}, {tight, child, wide}} {
+		inferrer := NewCallTreeInferrer(0)
+		for _, call := range calls {
+			inferrer.Add(call)
+		}
+
+		trees := inferrer.Flush(0)
+		assert.Equal(t, len(trees), 2)
+		for _, tree := range trees {
+			if tree[0].info == tight {
+				assert.Equal(t, len(tree), 2)
+				assert.Equal(t, tree[1].info, child)
+				//weights 1/25 and 1/100
+				assert.InDelta(t, tree[1].confidence, 0.8, 1e-9)
+			} else {
+				assert.Equal(t, len(tree), 1)
+			}
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package traffic
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"regexp"
+	"strings"
+)
+
+const (
+	PROXY_V2_HEADER_LENGTH = 16
+	PROXY_V2_FAMILY_TCP4   = 0x11
+	PROXY_V2_FAMILY_TCP6   = 0x21
+	//client ips of older connections are dropped when there are too many
+	MAX_PROXY_FLOWS = 10000
+)
+
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+	httpHeaderRegexp = regexp.MustCompile(`(?im)^(x-forwarded-for|x-real-ip|forwarded):[ \t]*([^\r\n]*)`)
+	forwardedRegexp  = regexp.MustCompile(`(?i)(?:^|[;,\s])for=("[^"]*"|[^;,\s]*)`)
+)
+
+// ClientIPDecoder is implemented by decoders of protocols which carry the original client ip in headers.
+// Like DecodeHost, DecodeClientIP is called for a request which has been decoded by DecodeRequest,
+// trusted tells proxies whose forwarded hops are skipped
+type ClientIPDecoder interface {
+	DecodeClientIP(flow string, payload []byte, trusted func(ip string) bool) string
+}
+
+// parseForwardedFor returns the ip of a node in Forwarded header, e.g. 1.2.3.4, "[2001:db8::1]:4711".
+// Obfuscated identifiers and "unknown" are ignored
+func parseForwardedFor(node string) string {
+	node = strings.Trim(node, `"`)
+	if strings.HasPrefix(node, "[") {
+		if i := strings.Index(node, "]"); i > 0 {
+			node = node[1:i]
+		}
+	} else if host, _, err := net.SplitHostPort(node); err == nil {
+		node = host
+	}
+	ip := net.ParseIP(node)
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// getForwardedHop returns the right most hop which is not a trusted proxy, or the left most hop if all are trusted.
+// Hops left of an untrusted one may be forged by the client, an unknown or obfuscated hop gives empty ip
+func getForwardedHop(hops []string, trusted func(ip string) bool) string {
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := parseForwardedFor(strings.TrimSpace(hops[i]))
+		if ip == "" || i == 0 || !trusted(ip) {
+			return ip
+		}
+	}
+	return ""
+}
+
+// getClientIP returns the original client ip from http headers,
+// Forwarded wins over X-Forwarded-For, which wins over X-Real-IP
+func getClientIP(header func(name string) string, trusted func(ip string) bool) string {
+	if value := header("forwarded"); value != "" {
+		var hops []string
+		for _, match := range forwardedRegexp.FindAllStringSubmatch(value, -1) {
+			hops = append(hops, match[1])
+		}
+		if ip := getForwardedHop(hops, trusted); ip != "" {
+			return ip
+		}
+	}
+	if value := header("x-forwarded-for"); value != "" {
+		if ip := getForwardedHop(strings.Split(value, ","), trusted); ip != "" {
+			return ip
+		}
+	}
+	return parseForwardedFor(strings.TrimSpace(header("x-real-ip")))
+}
+
+// getHttpHeaderValues returns values of http headers matched by headerRegexp in order, names are lower case
+func getHttpHeaderValues(payload []byte, headerRegexp *regexp.Regexp) map[string][]string {
+	headers := make(map[string][]string)
+	//headers end at the first empty line
+	if i := bytes.Index(payload, []byte("\r\n\r\n")); i >= 0 {
+		payload = payload[:i]
+	}
+	for _, match := range headerRegexp.FindAllSubmatch(payload, -1) {
+		name := strings.ToLower(string(match[1]))
+		headers[name] = append(headers[name], string(match[2]))
+	}
+	return headers
+}
+
+// getHttpHeaders returns the first value of http headers matched by headerRegexp, names are lower case
+func getHttpHeaders(payload []byte, headerRegexp *regexp.Regexp) map[string]string {
+	headers := make(map[string]string)
+	for name, values := range getHttpHeaderValues(payload, headerRegexp) {
+		headers[name] = values[0]
+	}
+	return headers
+}
+
+func getHttpClientIP(payload []byte, trusted func(ip string) bool) string {
+	headers := getHttpHeaderValues(payload, httpHeaderRegexp)
+	if len(headers) == 0 {
+		return ""
+	}
+	//proxies may append a header instead of the existing one's value
+	return getClientIP(func(name string) string { return strings.Join(headers[name], ",") }, trusted)
+}
+
+// parseProxyProtocol parses HAProxy PROXY protocol v1 or v2 preamble,
+// returns the source ip and the payload after the preamble
+func parseProxyProtocol(payload []byte) (string, []byte, bool) {
+	if bytes.HasPrefix(payload, proxyV1Prefix) {
+		//PROXY TCP4 1.2.3.4 10.1.1.1 56324 443\r\n
+		end := bytes.Index(payload, []byte("\r\n"))
+		if end < 0 {
+			return "", payload, false
+		}
+		fields := strings.Fields(string(payload[:end]))
+		rest := payload[end+2:]
+		if len(fields) >= 3 && (fields[1] == "TCP4" || fields[1] == "TCP6") {
+			return parseForwardedFor(fields[2]), rest, true
+		}
+		//PROXY UNKNOWN
+		return "", rest, true
+	}
+	if bytes.HasPrefix(payload, proxyV2Signature) {
+		if len(payload) < PROXY_V2_HEADER_LENGTH {
+			return "", payload, false
+		}
+		length := int(binary.BigEndian.Uint16(payload[14:16]))
+		if len(payload) < PROXY_V2_HEADER_LENGTH+length {
+			return "", payload, false
+		}
+		address := payload[PROXY_V2_HEADER_LENGTH : PROXY_V2_HEADER_LENGTH+length]
+		rest := payload[PROXY_V2_HEADER_LENGTH+length:]
+		//LOCAL command has no address
+		if payload[12]&0xf != 1 {
+			return "", rest, true
+		}
+		switch payload[13] {
+		case PROXY_V2_FAMILY_TCP4:
+			if len(address) >= 12 {
+				return net.IP(address[0:4]).String(), rest, true
+			}
+		case PROXY_V2_FAMILY_TCP6:
+			if len(address) >= 36 {
+				return net.IP(address[0:16]).String(), rest, true
+			}
+		}
+		return "", rest, true
+	}
+	return "", payload, false
+}
+
+// ProxyFlows remembers client ips of connections which start with PROXY protocol preamble.
+// It is only used by the packet handling goroutine
+type ProxyFlows struct {
+	clientIPs map[string]string
+}
+
+// Strip removes the PROXY protocol preamble of the payload and remembers its client ip for the flow
+func (flows *ProxyFlows) Strip(flow string, payload []byte) []byte {
+	clientIP, rest, ok := parseProxyProtocol(payload)
+	if !ok {
+		return payload
+	}
+	if flows.clientIPs == nil || len(flows.clientIPs) >= MAX_PROXY_FLOWS {
+		flows.clientIPs = make(map[string]string)
+	}
+	if clientIP == "" {
+		delete(flows.clientIPs, flow)
+	} else {
+		flows.clientIPs[flow] = clientIP
+	}
+	return rest
+}
+
+// GetClientIP returns the client ip given by PROXY protocol preamble of the flow, empty if unknown
+func (flows *ProxyFlows) GetClientIP(flow string) string {
+	return flows.clientIPs[flow]
+}
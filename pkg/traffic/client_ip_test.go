@@ -0,0 +1,76 @@
+package traffic
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestHttpClientIP(t *testing.T) {
+	//proxies inside the cluster
+	trusted := func(ip string) bool { return strings.HasPrefix(ip, "10.") }
+	for _, request := range []struct {
+		headers string
+		ip      string
+	}{
+		{"X-Forwarded-For: 1.2.3.4, 10.1.1.1\r\n", "1.2.3.4"},
+		{"x-forwarded-for: 1.2.3.4:5678\r\nX-Real-IP: 10.1.1.1\r\n", "1.2.3.4"},
+		{"X-Real-IP: 5.6.7.8\r\n", "5.6.7.8"},
+		{"Forwarded: for=192.0.2.60;proto=http;by=203.0.113.43\r\nX-Forwarded-For: 1.2.3.4\r\n", "192.0.2.60"},
+		{"Forwarded: For=\"[2001:db8:cafe::17]:4711\", for=10.1.1.1\r\n", "2001:db8:cafe::17"},
+		{"Forwarded: for=unknown\r\nX-Real-IP: 5.6.7.8\r\n", "5.6.7.8"},
+		{"X-Forwarded-For: not-an-ip\r\n", ""},
+		//the left most hop may be forged by the client
+		{"X-Forwarded-For: 6.6.6.6, 1.2.3.4, 10.1.1.1\r\n", "1.2.3.4"},
+		{"X-Forwarded-For: 6.6.6.6\r\nX-Forwarded-For: 1.2.3.4\r\n", "1.2.3.4"},
+		{"Forwarded: for=6.6.6.6, for=192.0.2.60\r\n", "192.0.2.60"},
+		{"X-Forwarded-For: 10.2.2.2, 10.1.1.1\r\n", "10.2.2.2"},
+		{"Accept: */*\r\n", ""},
+	} {
+		payload := []byte("GET / HTTP/1.1\r\nHost: test\r\n" + request.headers + "\r\nX-Real-IP: 9.9.9.9\r\n")
+		assert.Equal(t, httpDecoder{}.DecodeClientIP("", payload, trusted), request.ip, request.headers)
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	var flows ProxyFlows
+	request := "GET / HTTP/1.1\r\nHost: test\r\n\r\n"
+
+	payload := flows.Strip("a=>b", []byte("PROXY TCP4 1.2.3.4 10.1.1.1 56324 80\r\n"+request))
+	assert.Equal(t, string(payload), request)
+	assert.Equal(t, flows.GetClientIP("a=>b"), "1.2.3.4")
+	assert.Equal(t, flows.GetClientIP("c=>d"), "")
+
+	//keep-alive request of the same connection
+	payload = flows.Strip("a=>b", []byte(request))
+	assert.Equal(t, string(payload), request)
+	assert.Equal(t, flows.GetClientIP("a=>b"), "1.2.3.4")
+
+	payload = flows.Strip("a=>b", []byte("PROXY UNKNOWN\r\n"+request))
+	assert.Equal(t, string(payload), request)
+	assert.Equal(t, flows.GetClientIP("a=>b"), "")
+
+	v2 := append([]byte(nil), proxyV2Signature...)
+	v2 = append(v2, 0x21, PROXY_V2_FAMILY_TCP4, 0, 12, 5, 6, 7, 8, 10, 1, 1, 1, 0xdc, 0x04, 0, 80)
+	payload = flows.Strip("c=>d", append(v2, request...))
+	assert.Equal(t, string(payload), request)
+	assert.Equal(t, flows.GetClientIP("c=>d"), "5.6.7.8")
+
+	v2 = append([]byte(nil), proxyV2Signature...)
+	v2 = append(v2, 0x21, PROXY_V2_FAMILY_TCP6, 0, 36, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1)
+	v2 = append(v2, make([]byte, 20)...)
+	payload = flows.Strip("e=>f", v2)
+	assert.Equal(t, len(payload), 0)
+	assert.Equal(t, flows.GetClientIP("e=>f"), "2001:db8::1")
+
+	//LOCAL command
+	v2 = append([]byte(nil), proxyV2Signature...)
+	v2 = append(v2, 0x20, 0, 0, 0)
+	payload = flows.Strip("g=>h", append(v2, request...))
+	assert.Equal(t, string(payload), request)
+	assert.Equal(t, flows.GetClientIP("g=>h"), "")
+
+	//truncated preamble is left to the decoder
+	payload = flows.Strip("i=>j", []byte("PROXY TCP4 1.2.3.4"))
+	assert.Equal(t, string(payload), "PROXY TCP4 1.2.3.4")
+}
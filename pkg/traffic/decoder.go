@@ -0,0 +1,153 @@
+package traffic
+
+import (
+	"bytes"
+	"github.com/luguoxiang/kubernetes-traffic-monitor/pkg/kubernetes"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	httpRequestRegexp  = regexp.MustCompile(`^(GET|POST|PUT|DELETE|HEAD)\s+(.*)\sHTTP/[\d.]+`)
+	httpResponseRegexp = regexp.MustCompile(`^HTTP/[\d.]+\s+(\d+)`)
+	httpHostRegexp     = regexp.MustCompile(`(?im)^host:[ \t]*([^\r\n]*)`)
+	httpBodyRegexp     = regexp.MustCompile(`(?im)^(content-length|transfer-encoding):[ \t]*([^\r\n]*)`)
+)
+
+// Decoder parses the first packet of a request or response of an application protocol.
+// flow identifies the direction of a tcp connection, for decoders which need connection state
+type Decoder interface {
+	DecodeRequest(flow string, payload []byte) (method string, url string, ok bool)
+	DecodeResponse(flow string, payload []byte) (status string, ok bool)
+}
+
+// HostDecoder is implemented by decoders of protocols with virtual hosts.
+// DecodeHost returns the host of a request which has been decoded by DecodeRequest, empty if unknown
+type HostDecoder interface {
+	DecodeHost(flow string, payload []byte) string
+}
+
+// BodySizeDecoder is implemented by decoders of protocols with message bodies.
+// DecodeBodySize returns the body size of a request or response which has been decoded by DecodeRequest or DecodeResponse,
+// false if unknown
+type BodySizeDecoder interface {
+	DecodeBodySize(flow string, payload []byte) (int64, bool)
+}
+
+type httpDecoder struct{}
+
+func (decoder httpDecoder) DecodeRequest(flow string, payload []byte) (string, string, bool) {
+	match := httpRequestRegexp.FindSubmatch(payload)
+	if match == nil || len(match) <= 2 {
+		return "", "", false
+	}
+	return string(match[1]), string(match[2]), true
+}
+
+func (decoder httpDecoder) DecodeHost(flow string, payload []byte) string {
+	match := httpHostRegexp.FindSubmatch(payload)
+	if match == nil || len(match) <= 1 {
+		return ""
+	}
+	return string(match[1])
+}
+
+func (decoder httpDecoder) DecodeClientIP(flow string, payload []byte, trusted func(ip string) bool) string {
+	return getHttpClientIP(payload, trusted)
+}
+
+func (decoder httpDecoder) DecodeTraceContext(flow string, payload []byte) *TraceContext {
+	return getHttpTraceContext(payload)
+}
+
+func (decoder httpDecoder) DecodeResponse(flow string, payload []byte) (string, bool) {
+	match := httpResponseRegexp.FindSubmatch(payload)
+	if match == nil || len(match) <= 1 {
+		return "", false
+	}
+	return string(match[1]), true
+}
+
+func (decoder httpDecoder) DecodeBodySize(flow string, payload []byte) (int64, bool) {
+	return getHttpBodySize(payload)
+}
+
+// getChunkedBodySize sums the chunks of a chunked body, false if the last chunk is not in the payload
+func getChunkedBodySize(body []byte) (int64, bool) {
+	var result int64
+	for {
+		end := bytes.Index(body, []byte("\r\n"))
+		if end < 0 {
+			return 0, false
+		}
+		//chunk extensions follow ';'
+		line := strings.TrimSpace(strings.SplitN(string(body[:end]), ";", 2)[0])
+		size, err := strconv.ParseInt(line, 16, 64)
+		if err != nil || size < 0 {
+			return 0, false
+		}
+		if size == 0 {
+			return result, true
+		}
+		result += size
+		//chunk data is followed by CRLF
+		if int64(len(body)-end-2) < size+2 {
+			return 0, false
+		}
+		body = body[int64(end+2)+size+2:]
+	}
+}
+
+// getHttpBodySize returns the body size of an HTTP/1 message from its first packet by Content-Length,
+// or by counting a chunked body which ends in the packet. A response body delimited by connection close,
+// or a chunked body longer than the captured 1024 bytes is unknown, since the following packets of the message are not captured
+func getHttpBodySize(payload []byte) (int64, bool) {
+	end := bytes.Index(payload, []byte("\r\n\r\n"))
+	if end < 0 {
+		return 0, false
+	}
+	headers := getHttpHeaders(payload, httpBodyRegexp)
+	if strings.Contains(strings.ToLower(headers["transfer-encoding"]), "chunked") {
+		return getChunkedBodySize(payload[end+4:])
+	}
+	if value, ok := headers["content-length"]; ok {
+		size, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil || size < 0 {
+			return 0, false
+		}
+		return size, true
+	}
+	if match := httpResponseRegexp.FindSubmatch(payload); match != nil {
+		status := string(match[1])
+		//responses which never have a body
+		return 0, status == "204" || status == "304" || strings.HasPrefix(status, "1")
+	}
+	//a request without Content-Length or Transfer-Encoding has no body
+	return 0, true
+}
+
+// DecoderManager holds a decoder for each protocol, decoders are only used by the packet handling goroutine
+type DecoderManager struct {
+	decoders map[string]Decoder
+}
+
+func NewDecoderManager() *DecoderManager {
+	return &DecoderManager{
+		decoders: map[string]Decoder{
+			kubernetes.PROTOCOL_HTTP:  httpDecoder{},
+			kubernetes.PROTOCOL_HTTP2: newHttp2Decoder(false),
+			kubernetes.PROTOCOL_GRPC:  newHttp2Decoder(true),
+			kubernetes.PROTOCOL_REDIS: redisDecoder{},
+			kubernetes.PROTOCOL_MYSQL: mysqlDecoder{},
+		},
+	}
+}
+
+// GetDecoder returns nil for unsupported protocol, ports without protocol hint are treated as http
+func (manager *DecoderManager) GetDecoder(protocol string) Decoder {
+	if protocol == "" {
+		protocol = kubernetes.PROTOCOL_HTTP
+	}
+	return manager.decoders[protocol]
+}
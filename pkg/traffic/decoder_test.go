@@ -0,0 +1,169 @@
+package traffic
+
+import (
+	"bytes"
+	"github.com/luguoxiang/kubernetes-traffic-monitor/pkg/kubernetes"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2/hpack"
+	"testing"
+)
+
+func TestHttpDecoder(t *testing.T) {
+	decoder := NewDecoderManager().GetDecoder("")
+
+	method, url, ok := decoder.DecodeRequest("", []byte("GET /api/v1?a=b HTTP/1.1\r\nHost: test\r\n\r\n"))
+	assert.True(t, ok)
+	assert.Equal(t, method, "GET")
+	assert.Equal(t, url, "/api/v1?a=b")
+	assert.Equal(t, decoder.(HostDecoder).DecodeHost("", []byte("GET / HTTP/1.1\r\nAccept: */*\r\nhost: test:8080\r\n\r\n")), "test:8080")
+
+	status, ok := decoder.DecodeResponse("", []byte("HTTP/1.1 404 Not Found\r\n"))
+	assert.True(t, ok)
+	assert.Equal(t, status, "404")
+
+	_, _, ok = decoder.DecodeRequest("", []byte("continued body"))
+	assert.False(t, ok)
+
+	assert.Nil(t, NewDecoderManager().GetDecoder("kafka"))
+}
+
+func TestHttpBodySize(t *testing.T) {
+	decoder := NewDecoderManager().GetDecoder("").(BodySizeDecoder)
+	for payload, expected := range map[string]int64{
+		"POST /users HTTP/1.1\r\nContent-Length: 1200\r\n\r\n{":                                                 1200,
+		"GET /users HTTP/1.1\r\nHost: test\r\n\r\n":                                                             0,
+		"HTTP/1.1 200 OK\r\ncontent-length:  35\r\n\r\n":                                                        35,
+		"HTTP/1.1 204 No Content\r\n\r\n":                                                                       0,
+		"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\na;ext=1\r\n0123456789\r\n0\r\n\r\n": 15,
+		//the last chunk is in the following packets
+		"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n": -1,
+		//delimited by connection close
+		"HTTP/1.1 200 OK\r\nConnection: close\r\n\r\nhello": -1,
+		//headers are truncated
+		"HTTP/1.1 200 OK\r\nContent-Le":                 -1,
+		"HTTP/1.1 200 OK\r\nContent-Length: -1\r\n\r\n": -1,
+	} {
+		assert.Equal(t, decodeBodySize(decoder.(Decoder), "", []byte(payload)), expected, payload)
+	}
+}
+
+func TestRedisDecoder(t *testing.T) {
+	decoder := NewDecoderManager().GetDecoder(kubernetes.PROTOCOL_REDIS)
+
+	method, _, ok := decoder.DecodeRequest("", []byte("*3\r\n$3\r\nset\r\n$3\r\nkey\r\n$5\r\nvalue\r\n"))
+	assert.True(t, ok)
+	assert.Equal(t, method, "SET")
+
+	method, _, ok = decoder.DecodeRequest("", []byte("PING\r\n"))
+	assert.True(t, ok)
+	assert.Equal(t, method, "PING")
+
+	_, _, ok = decoder.DecodeRequest("", []byte("*2\r\n$3\r\nGE"))
+	assert.False(t, ok)
+
+	status, ok := decoder.DecodeResponse("", []byte("+OK\r\n"))
+	assert.True(t, ok)
+	assert.Equal(t, status, "OK")
+
+	status, ok = decoder.DecodeResponse("", []byte("$5\r\nvalue\r\n"))
+	assert.True(t, ok)
+	assert.Equal(t, status, "OK")
+
+	status, ok = decoder.DecodeResponse("", []byte("-WRONGTYPE Operation against a key\r\n"))
+	assert.True(t, ok)
+	assert.Equal(t, status, "WRONGTYPE")
+}
+
+func TestMysqlDecoder(t *testing.T) {
+	decoder := NewDecoderManager().GetDecoder(kubernetes.PROTOCOL_MYSQL)
+
+	query := []byte("\x03select * from t")
+	method, url, ok := decoder.DecodeRequest("", append([]byte{byte(len(query)), 0, 0, 0}, query...))
+	assert.True(t, ok)
+	assert.Equal(t, method, "QUERY")
+	assert.Equal(t, url, "SELECT")
+
+	//not the first packet of a sequence
+	_, _, ok = decoder.DecodeRequest("", append([]byte{byte(len(query)), 0, 0, 1}, query...))
+	assert.False(t, ok)
+
+	status, ok := decoder.DecodeResponse("", []byte{7, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0})
+	assert.True(t, ok)
+	assert.Equal(t, status, "OK")
+
+	status, ok = decoder.DecodeResponse("", []byte{9, 0, 0, 1, 0xff, 0x28, 0x04, '#', '4', '2', '0', '0', '0'})
+	assert.True(t, ok)
+	assert.Equal(t, status, "1064")
+}
+
+func newHttp2Frame(frameType byte, flags byte, payload []byte) []byte {
+	length := len(payload)
+	frame := []byte{byte(length >> 16), byte(length >> 8), byte(length), frameType, flags, 0, 0, 0, 1}
+	return append(frame, payload...)
+}
+
+func encodeHeaders(encoder *hpack.Encoder, buf *bytes.Buffer, fields ...string) []byte {
+	buf.Reset()
+	for i := 0; i < len(fields); i += 2 {
+		encoder.WriteField(hpack.HeaderField{Name: fields[i], Value: fields[i+1]})
+	}
+	return append([]byte(nil), buf.Bytes()...)
+}
+
+func TestHttp2Decoder(t *testing.T) {
+	var requestBuf, responseBuf bytes.Buffer
+	requestEncoder := hpack.NewEncoder(&requestBuf)
+	responseEncoder := hpack.NewEncoder(&responseBuf)
+	decoder := NewDecoderManager().GetDecoder(kubernetes.PROTOCOL_GRPC)
+
+	settings := newHttp2Frame(0x4, 0, nil)
+	headers := encodeHeaders(requestEncoder, &requestBuf, ":method", "POST", ":path", "/test.Greeter/SayHello", "x-test", "abc")
+	payload := append(append(append([]byte(nil), http2Preface...), settings...), newHttp2Frame(HTTP2_FRAME_HEADERS, 0x4, headers)...)
+	method, url, ok := decoder.DecodeRequest("a=>b", payload)
+	assert.True(t, ok)
+	assert.Equal(t, method, "POST")
+	assert.Equal(t, url, "/test.Greeter/SayHello")
+
+	//the second request refers to the hpack dynamic table of the flow
+	headers = encodeHeaders(requestEncoder, &requestBuf, ":method", "POST", ":path", "/test.Greeter/SayHello", "x-test", "abc")
+	method, url, ok = decoder.DecodeRequest("a=>b", newHttp2Frame(HTTP2_FRAME_HEADERS, 0x4, headers))
+	assert.True(t, ok)
+	assert.Equal(t, url, "/test.Greeter/SayHello")
+	assert.Equal(t, decoder.(HostDecoder).DecodeHost("a=>b", nil), "")
+
+	headers = encodeHeaders(requestEncoder, &requestBuf, ":method", "GET", ":authority", "api.example.com", ":path", "/")
+	_, _, ok = decoder.DecodeRequest("a=>b", newHttp2Frame(HTTP2_FRAME_HEADERS, 0x4, headers))
+	assert.True(t, ok)
+	assert.Equal(t, decoder.(HostDecoder).DecodeHost("a=>b", nil), "api.example.com")
+
+	headers = encodeHeaders(requestEncoder, &requestBuf, ":method", "POST", ":path", "/upload", "content-length", "2048")
+	_, _, ok = decoder.DecodeRequest("a=>b", newHttp2Frame(HTTP2_FRAME_HEADERS, 0x4, headers))
+	assert.True(t, ok)
+	size, ok := decoder.(BodySizeDecoder).DecodeBodySize("a=>b", nil)
+	assert.True(t, ok)
+	assert.Equal(t, size, int64(2048))
+
+	//grpc response is complete with trailers
+	headers = encodeHeaders(responseEncoder, &responseBuf, ":status", "200", "content-type", "application/grpc")
+	_, ok = decoder.DecodeResponse("b=>a", newHttp2Frame(HTTP2_FRAME_HEADERS, 0x4, headers))
+	assert.False(t, ok)
+	headers = encodeHeaders(responseEncoder, &responseBuf, "grpc-status", "5")
+	status, ok := decoder.DecodeResponse("b=>a", append(newHttp2Frame(0x0, 0, []byte("data")), newHttp2Frame(HTTP2_FRAME_HEADERS, 0x5, headers)...))
+	assert.True(t, ok)
+	assert.Equal(t, status, "5")
+	//bodies of DATA frames are not counted
+	_, ok = decoder.(BodySizeDecoder).DecodeBodySize("b=>a", nil)
+	assert.False(t, ok)
+
+	http2Decoder := NewDecoderManager().GetDecoder(kubernetes.PROTOCOL_HTTP2)
+	headers = encodeHeaders(responseEncoder, &responseBuf, ":status", "503")
+	//padded frame
+	frame := append(append([]byte{2}, headers...), 0, 0)
+	status, ok = http2Decoder.DecodeResponse("c=>d", newHttp2Frame(HTTP2_FRAME_HEADERS, 0x4|HTTP2_FLAG_PADDED, frame))
+	assert.True(t, ok)
+	assert.Equal(t, status, "503")
+
+	//truncated frame
+	_, _, ok = http2Decoder.DecodeRequest("e=>f", newHttp2Frame(HTTP2_FRAME_HEADERS, 0x4, headers)[:10])
+	assert.False(t, ok)
+}
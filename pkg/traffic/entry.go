@@ -0,0 +1,75 @@
+package traffic
+
+import (
+	"github.com/luguoxiang/kubernetes-traffic-monitor/pkg/kubernetes"
+)
+
+// entryKey identifies a request before and after kube-proxy's rewrite
+type entryKey struct {
+	//tcp timestamp option, TSval and TSecr
+	timestamp [8]byte
+	//source of requests without tcp timestamp option
+	ip   string
+	port uint32
+}
+
+type entryInfo struct {
+	service       *kubernetes.ServiceInfo
+	timestampNano int64
+}
+
+// EntryManager remembers requests sent to a service's node port, load balancer ip or external ip.
+// kube-proxy will DNAT such a request to a pod ip, the DNATed request can then be attributed to the service
+type EntryManager struct {
+	entries       map[entryKey]*entryInfo
+	lastPurgeNano int64
+}
+
+func getEntryKey(packet *PacketInfo) entryKey {
+	var result entryKey
+	if len(packet.TcpTimestamp) == len(result.timestamp) {
+		//DNAT and SNAT do not change tcp options, with externalTrafficPolicy Cluster kube-proxy also SNATs
+		//requests forwarded to a pod of another node, so the source is not part of the key
+		copy(result.timestamp[:], packet.TcpTimestamp)
+		return result
+	}
+	//only DNATed requests are matched
+	result.ip = packet.SrcIp
+	result.port = packet.SrcPort
+	return result
+}
+
+func (manager *EntryManager) purge(timestampNano int64) {
+	if timestampNano-manager.lastPurgeNano < TIME_RANGE*1e6 {
+		return
+	}
+	for key, entry := range manager.entries {
+		if entry.timestampNano+TIME_RANGE*1e6 <= timestampNano {
+			delete(manager.entries, key)
+		}
+	}
+	manager.lastPurgeNano = timestampNano
+}
+
+func (manager *EntryManager) AddEntry(packet *PacketInfo, service *kubernetes.ServiceInfo) {
+	if manager.entries == nil {
+		manager.entries = make(map[entryKey]*entryInfo)
+	}
+	manager.purge(packet.TimestampNano)
+	manager.entries[getEntryKey(packet)] = &entryInfo{
+		service:       service,
+		timestampNano: packet.TimestampNano,
+	}
+}
+
+// GetEntry returns the service of a request DNATed to the pod of dstEndpoint,
+// an entry of another service with the same tcp timestamp is not matched
+func (manager *EntryManager) GetEntry(packet *PacketInfo, dstEndpoint *kubernetes.EndpointInfo) *kubernetes.ServiceInfo {
+	key := getEntryKey(packet)
+	entry := manager.entries[key]
+	if entry == nil || !hasService(dstEndpoint, entry.service.Namespace(), entry.service.Name()) {
+		return nil
+	}
+	delete(manager.entries, key)
+	return entry.service
+}
@@ -0,0 +1,32 @@
+package traffic
+
+import (
+	"github.com/luguoxiang/kubernetes-traffic-monitor/pkg/kubernetes"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"testing"
+)
+
+func TestEntryManager(t *testing.T) {
+	service := kubernetes.NewServiceInfo(&v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "test"}})
+	other := kubernetes.NewServiceInfo(&v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "other"}})
+	endpoint := &kubernetes.EndpointInfo{Services: []*kubernetes.ServiceInfo{service}}
+	manager := &EntryManager{}
+	timestamp := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	manager.AddEntry(&PacketInfo{SrcIp: "1.1.1.1", SrcPort: 5000, TcpTimestamp: timestamp}, service)
+
+	//the pod is not selected by the service
+	assert.Nil(t, manager.GetEntry(&PacketInfo{SrcIp: "1.1.1.1", SrcPort: 5000, TcpTimestamp: timestamp}, &kubernetes.EndpointInfo{Services: []*kubernetes.ServiceInfo{other}}))
+	assert.Nil(t, manager.GetEntry(&PacketInfo{SrcIp: "1.1.1.1", SrcPort: 5000, TcpTimestamp: []byte{1, 2, 3, 4, 5, 6, 7, 9}}, endpoint))
+
+	//SNATed to the node ip
+	entry := manager.GetEntry(&PacketInfo{SrcIp: "12.1.1.1", SrcPort: 40000, TcpTimestamp: timestamp}, endpoint)
+	assert.Equal(t, entry, service)
+	assert.Nil(t, manager.GetEntry(&PacketInfo{SrcIp: "1.1.1.1", SrcPort: 5000, TcpTimestamp: timestamp}, endpoint))
+
+	//without tcp timestamp option
+	manager.AddEntry(&PacketInfo{SrcIp: "1.1.1.1", SrcPort: 5000}, service)
+	assert.Nil(t, manager.GetEntry(&PacketInfo{SrcIp: "1.1.1.1", SrcPort: 5001}, endpoint))
+	assert.Equal(t, manager.GetEntry(&PacketInfo{SrcIp: "1.1.1.1", SrcPort: 5000}, endpoint), service)
+}
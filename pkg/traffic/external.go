@@ -0,0 +1,204 @@
+package traffic
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/google/gopacket/layers"
+	"github.com/luguoxiang/kubernetes-traffic-monitor/pkg/config"
+	"github.com/luguoxiang/kubernetes-traffic-monitor/pkg/kubernetes"
+	"net"
+	"sort"
+	"strings"
+)
+
+const (
+	//connections usually live longer than dns ttl, so a learned name is kept at least this long
+	DNS_NAME_MIN_TTL_NANO = 10 * 60 * 1e9
+	MAX_DNS_NAMES         = 100000
+	//names of ips learned from dns beyond the limit of distinct names
+	DNS_NAME_OTHER = "other"
+)
+
+type ExternalNameServices interface {
+	GetExternalNameServices(name string) []*kubernetes.ServiceInfo
+}
+
+type cidrName struct {
+	ipNet *net.IPNet
+	name  string
+}
+
+type dnsName struct {
+	//queried name followed by its CNAME chain
+	names      []string
+	expireNano int64
+	//the queried name, or DNS_NAME_OTHER
+	label string
+}
+
+// ExternalResolver names ips outside the cluster by configured CIDRs, ExternalName services
+// and dns answers observed by the agent, in that order.
+// It is not safe for concurrent use
+type ExternalResolver struct {
+	cidrs      []cidrName
+	services   ExternalNameServices
+	observeDNS bool
+	dnsNames   map[string]*dnsName
+	//number of ips of each distinct label, which is limited by maxNames
+	labelIps      map[string]int
+	maxNames      int
+	lastPurgeNano int64
+}
+
+// parseCIDR parses a cidr or a single ip
+func parseCIDR(cidr string) (*net.IPNet, error) {
+	if !strings.Contains(cidr, "/") {
+		if ip := net.ParseIP(cidr); ip != nil && ip.To4() == nil {
+			cidr = cidr + "/128"
+		} else {
+			cidr = cidr + "/32"
+		}
+	}
+	_, ipNet, err := net.ParseCIDR(cidr)
+	return ipNet, err
+}
+
+func NewExternalResolver(externalConfig *config.ExternalConfig, services ExternalNameServices) (*ExternalResolver, error) {
+	result := &ExternalResolver{
+		services:   services,
+		observeDNS: externalConfig.ObserveDNS,
+		dnsNames:   make(map[string]*dnsName),
+		labelIps:   make(map[string]int),
+		maxNames:   externalConfig.MaxDNSNames,
+	}
+	for _, item := range externalConfig.Names {
+		ipNet, err := parseCIDR(item.CIDR)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid cidr %s of external name %s: %s", item.CIDR, item.Name, err.Error())
+		}
+		result.cidrs = append(result.cidrs, cidrName{ipNet: ipNet, name: item.Name})
+	}
+	//longest prefix first
+	sort.SliceStable(result.cidrs, func(i, j int) bool {
+		a, _ := result.cidrs[i].ipNet.Mask.Size()
+		b, _ := result.cidrs[j].ipNet.Mask.Size()
+		return a > b
+	})
+	return result, nil
+}
+
+func (resolver *ExternalResolver) ObserveDNS() bool {
+	return resolver.observeDNS
+}
+
+func (resolver *ExternalResolver) deleteDNSName(ip string) {
+	name := resolver.dnsNames[ip]
+	if name == nil {
+		return
+	}
+	delete(resolver.dnsNames, ip)
+	resolver.labelIps[name.label]--
+	if resolver.labelIps[name.label] <= 0 {
+		delete(resolver.labelIps, name.label)
+	}
+}
+
+// getLabel returns the queried name, or DNS_NAME_OTHER if there are too many distinct names
+func (resolver *ExternalResolver) getLabel(name string) string {
+	if resolver.maxNames > 0 && resolver.labelIps[name] == 0 && len(resolver.labelIps) >= resolver.maxNames {
+		if glog.V(2) {
+			glog.Infof("Too many dns names, %s is named %s", name, DNS_NAME_OTHER)
+		}
+		return DNS_NAME_OTHER
+	}
+	return name
+}
+
+func (resolver *ExternalResolver) purge(timestampNano int64) {
+	resolver.lastPurgeNano = timestampNano
+	for ip, name := range resolver.dnsNames {
+		if name.expireNano <= timestampNano {
+			resolver.deleteDNSName(ip)
+		}
+	}
+	if len(resolver.dnsNames) >= MAX_DNS_NAMES {
+		glog.Warningf("Too many dns names, drop all of them")
+		resolver.dnsNames = make(map[string]*dnsName)
+		resolver.labelIps = make(map[string]int)
+	}
+}
+
+// AddDNSResponse learns names of the ips in the answers
+func (resolver *ExternalResolver) AddDNSResponse(dns *layers.DNS, timestampNano int64) {
+	if !resolver.observeDNS || !dns.QR || dns.ResponseCode != layers.DNSResponseCodeNoErr || len(dns.Questions) == 0 {
+		return
+	}
+	//expired names release their places of maxNames
+	if timestampNano-resolver.lastPurgeNano >= DNS_NAME_MIN_TTL_NANO {
+		resolver.purge(timestampNano)
+	}
+	names := []string{strings.ToLower(string(dns.Questions[0].Name))}
+	for _, answer := range dns.Answers {
+		if answer.Type == layers.DNSTypeCNAME {
+			names = append(names, strings.ToLower(string(answer.CNAME)))
+		}
+	}
+	for _, answer := range dns.Answers {
+		if answer.Type != layers.DNSTypeA && answer.Type != layers.DNSTypeAAAA || answer.IP == nil {
+			continue
+		}
+		ttl := int64(answer.TTL) * 1e9
+		if ttl < DNS_NAME_MIN_TTL_NANO {
+			ttl = DNS_NAME_MIN_TTL_NANO
+		}
+		if len(resolver.dnsNames) >= MAX_DNS_NAMES {
+			resolver.purge(timestampNano)
+		}
+		ip := answer.IP.String()
+		resolver.deleteDNSName(ip)
+		label := resolver.getLabel(names[0])
+		resolver.dnsNames[ip] = &dnsName{names: names, expireNano: timestampNano + ttl, label: label}
+		resolver.labelIps[label]++
+		if glog.V(2) {
+			glog.Infof("DNS %s %s", ip, strings.Join(names, ","))
+		}
+	}
+}
+
+func (resolver *ExternalResolver) getExternalNameService(name string) *kubernetes.ServiceInfo {
+	if resolver.services == nil {
+		return nil
+	}
+	services := resolver.services.GetExternalNameServices(name)
+	if len(services) == 0 {
+		return nil
+	}
+	return services[0]
+}
+
+// Resolve returns name and namespace of an external ip, name is empty if unknown
+func (resolver *ExternalResolver) Resolve(ip string, timestampNano int64) (string, string) {
+	netIp := net.ParseIP(ip)
+	if netIp == nil {
+		return "", ""
+	}
+	for _, cidr := range resolver.cidrs {
+		if cidr.ipNet.Contains(netIp) {
+			return cidr.name, ""
+		}
+	}
+	//ExternalName of an ip
+	if service := resolver.getExternalNameService(ip); service != nil {
+		return service.Name(), service.Namespace()
+	}
+	name := resolver.dnsNames[ip]
+	if name == nil || name.expireNano <= timestampNano {
+		return "", ""
+	}
+	for _, item := range name.names {
+		if service := resolver.getExternalNameService(item); service != nil {
+			return service.Name(), service.Namespace()
+		}
+	}
+	return name.label, ""
+}
@@ -0,0 +1,111 @@
+package traffic
+
+import (
+	"github.com/google/gopacket/layers"
+	"github.com/luguoxiang/kubernetes-traffic-monitor/pkg/config"
+	"github.com/luguoxiang/kubernetes-traffic-monitor/pkg/kubernetes"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"net"
+	"testing"
+)
+
+type testExternalNameServices map[string][]*kubernetes.ServiceInfo
+
+func (services testExternalNameServices) GetExternalNameServices(name string) []*kubernetes.ServiceInfo {
+	return services[name]
+}
+
+func newTestDNSResponse(question string, ip string, cnames ...string) *layers.DNS {
+	result := &layers.DNS{
+		QR:        true,
+		Questions: []layers.DNSQuestion{{Name: []byte(question), Type: layers.DNSTypeA}},
+	}
+	name := question
+	for _, cname := range cnames {
+		result.Answers = append(result.Answers, layers.DNSResourceRecord{Name: []byte(name), Type: layers.DNSTypeCNAME, CNAME: []byte(cname)})
+		name = cname
+	}
+	result.Answers = append(result.Answers, layers.DNSResourceRecord{Name: []byte(name), Type: layers.DNSTypeA, TTL: 30, IP: net.ParseIP(ip)})
+	return result
+}
+
+func TestExternalResolver(t *testing.T) {
+	var service corev1.Service
+	service.Name = "partner-api"
+	service.Namespace = "test-ns"
+	service.Spec.Type = corev1.ServiceTypeExternalName
+	service.Spec.ExternalName = "api.partner.com"
+	services := testExternalNameServices{"api.partner.com": {kubernetes.NewServiceInfo(&service)}}
+
+	_, err := NewExternalResolver(&config.ExternalConfig{Names: []config.ExternalNameConfig{{CIDR: "10.0.0.0/33", Name: "bad"}}}, services)
+	assert.NotNil(t, err)
+
+	resolver, err := NewExternalResolver(&config.ExternalConfig{
+		Names: []config.ExternalNameConfig{
+			{CIDR: "10.0.0.0/8", Name: "office-vpn"},
+			{CIDR: "10.1.0.0/16", Name: "partner"},
+			{CIDR: "169.254.169.254", Name: "metadata"},
+		},
+		ObserveDNS: true,
+	}, services)
+	assert.Nil(t, err)
+
+	name, namespace := resolver.Resolve("10.2.3.4", 0)
+	assert.Equal(t, name, "office-vpn")
+	assert.Equal(t, namespace, "")
+	name, _ = resolver.Resolve("10.1.3.4", 0)
+	assert.Equal(t, name, "partner")
+	name, _ = resolver.Resolve("169.254.169.254", 0)
+	assert.Equal(t, name, "metadata")
+	name, _ = resolver.Resolve("20.1.1.1", 0)
+	assert.Equal(t, name, "")
+
+	resolver.AddDNSResponse(newTestDNSResponse("www.example.com", "20.1.1.1", "example.cdn.net"), 0)
+	name, _ = resolver.Resolve("20.1.1.1", 1e9)
+	assert.Equal(t, name, "www.example.com")
+	//expired
+	name, _ = resolver.Resolve("20.1.1.1", DNS_NAME_MIN_TTL_NANO)
+	assert.Equal(t, name, "")
+
+	//ExternalName service is resolved by CNAME
+	resolver.AddDNSResponse(newTestDNSResponse("partner-api.test-ns.svc.cluster.local", "20.1.1.2", "api.partner.com"), 0)
+	name, namespace = resolver.Resolve("20.1.1.2", 1e9)
+	assert.Equal(t, name, "partner-api")
+	assert.Equal(t, namespace, "test-ns")
+
+	//not a response
+	query := newTestDNSResponse("www.example.org", "20.1.1.3")
+	query.QR = false
+	resolver.AddDNSResponse(query, 0)
+	name, _ = resolver.Resolve("20.1.1.3", 0)
+	assert.Equal(t, name, "")
+
+	resolver.observeDNS = false
+	resolver.AddDNSResponse(newTestDNSResponse("www.example.org", "20.1.1.3"), 0)
+	name, _ = resolver.Resolve("20.1.1.3", 0)
+	assert.Equal(t, name, "")
+}
+
+func TestExternalResolverMaxNames(t *testing.T) {
+	resolver, err := NewExternalResolver(&config.ExternalConfig{ObserveDNS: true, MaxDNSNames: 2}, nil)
+	assert.Nil(t, err)
+
+	resolver.AddDNSResponse(newTestDNSResponse("a.example.com", "20.1.1.1"), 0)
+	resolver.AddDNSResponse(newTestDNSResponse("b.example.com", "20.1.1.2"), 0)
+	resolver.AddDNSResponse(newTestDNSResponse("c.example.com", "20.1.1.3"), 0)
+	//a known name is not limited
+	resolver.AddDNSResponse(newTestDNSResponse("a.example.com", "20.1.1.4"), 0)
+	name, _ := resolver.Resolve("20.1.1.2", 0)
+	assert.Equal(t, name, "b.example.com")
+	name, _ = resolver.Resolve("20.1.1.3", 0)
+	assert.Equal(t, name, DNS_NAME_OTHER)
+	name, _ = resolver.Resolve("20.1.1.4", 0)
+	assert.Equal(t, name, "a.example.com")
+
+	//names of expired ips are released
+	resolver.AddDNSResponse(newTestDNSResponse("c.example.com", "20.1.1.3"), DNS_NAME_MIN_TTL_NANO)
+	name, _ = resolver.Resolve("20.1.1.3", DNS_NAME_MIN_TTL_NANO)
+	assert.Equal(t, name, "c.example.com")
+	assert.Equal(t, len(resolver.labelIps), 1)
+}
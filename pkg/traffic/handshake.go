@@ -0,0 +1,60 @@
+package traffic
+
+import (
+	"fmt"
+)
+
+// handshakes of older connections are dropped when there are too many,
+// rtts of the previous MAX_HANDSHAKES connections are kept
+const MAX_HANDSHAKES = 100000
+
+// HandshakeManager measures network round trip time of connections by SYN and SYN-ACK.
+// On the client's node, the time between them is the network rtt since the server's kernel answers SYN at once.
+// Connections are keyed by client address, which is not changed by DNAT of the server address
+type HandshakeManager struct {
+	synNanos map[string]int64
+	rttNanos map[string]int64
+	//rtts before rttNanos was full, long lived connections are not lost at once
+	oldRttNanos map[string]int64
+}
+
+func getClientKey(ip string, port uint32) string {
+	return fmt.Sprintf("%s:%d", ip, port)
+}
+
+func (manager *HandshakeManager) Add(packet *PacketInfo) {
+	if manager.synNanos == nil || len(manager.synNanos) >= MAX_HANDSHAKES {
+		manager.synNanos = make(map[string]int64)
+	}
+	if manager.rttNanos == nil || len(manager.rttNanos) >= MAX_HANDSHAKES {
+		manager.oldRttNanos = manager.rttNanos
+		manager.rttNanos = make(map[string]int64)
+	}
+	if !packet.Ack {
+		//a new connection, or a retransmitted SYN
+		key := getClientKey(packet.SrcIp, packet.SrcPort)
+		manager.synNanos[key] = packet.TimestampNano
+		delete(manager.rttNanos, key)
+		delete(manager.oldRttNanos, key)
+		return
+	}
+	key := getClientKey(packet.DstIp, packet.DstPort)
+	synNano, ok := manager.synNanos[key]
+	if !ok {
+		return
+	}
+	delete(manager.synNanos, key)
+	if packet.TimestampNano > synNano {
+		manager.rttNanos[key] = packet.TimestampNano - synNano
+	}
+}
+
+// GetRttNano returns handshake rtt of the connection of a client address,
+// 0 if unknown, e.g. the connection was opened before the agent started
+func (manager *HandshakeManager) GetRttNano(ip string, port uint32) int64 {
+	key := getClientKey(ip, port)
+	if rtt, ok := manager.rttNanos[key]; ok {
+		return rtt
+	}
+	return manager.oldRttNanos[key]
+}
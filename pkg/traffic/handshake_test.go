@@ -0,0 +1,59 @@
+package traffic
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestHandshakeManager(t *testing.T) {
+	var manager HandshakeManager
+	assert.Equal(t, manager.GetRttNano("10.1.1.1", 40000), int64(0))
+
+	manager.Add(&PacketInfo{SrcIp: "10.1.1.1", SrcPort: 40000, DstIp: "10.96.0.10", DstPort: 80, Syn: true, TimestampNano: 1000000})
+	//SYN-ACK from the pod behind the service ip
+	manager.Add(&PacketInfo{SrcIp: "10.2.1.5", SrcPort: 8080, DstIp: "10.1.1.1", DstPort: 40000, Syn: true, Ack: true, TimestampNano: 1500000})
+	assert.Equal(t, manager.GetRttNano("10.1.1.1", 40000), int64(500000))
+
+	//retransmitted SYN-ACK is ignored
+	manager.Add(&PacketInfo{SrcIp: "10.2.1.5", SrcPort: 8080, DstIp: "10.1.1.1", DstPort: 40000, Syn: true, Ack: true, TimestampNano: 2500000})
+	assert.Equal(t, manager.GetRttNano("10.1.1.1", 40000), int64(500000))
+
+	//a new connection reusing the client port
+	manager.Add(&PacketInfo{SrcIp: "10.1.1.1", SrcPort: 40000, DstIp: "10.96.0.10", DstPort: 80, Syn: true, TimestampNano: 3000000})
+	assert.Equal(t, manager.GetRttNano("10.1.1.1", 40000), int64(0))
+
+	//SYN-ACK without SYN
+	manager.Add(&PacketInfo{SrcIp: "10.2.1.5", SrcPort: 8080, DstIp: "10.1.1.2", DstPort: 40000, Syn: true, Ack: true, TimestampNano: 3500000})
+	assert.Equal(t, manager.GetRttNano("10.1.1.2", 40000), int64(0))
+
+	//rtts are kept for the previous MAX_HANDSHAKES connections
+	manager.Add(&PacketInfo{SrcIp: "10.1.1.1", SrcPort: 40000, DstIp: "10.96.0.10", DstPort: 80, Syn: true, TimestampNano: 4000000})
+	manager.Add(&PacketInfo{SrcIp: "10.2.1.5", SrcPort: 8080, DstIp: "10.1.1.1", DstPort: 40000, Syn: true, Ack: true, TimestampNano: 4200000})
+	for len(manager.rttNanos) < MAX_HANDSHAKES {
+		manager.rttNanos[fmt.Sprintf("filler:%d", len(manager.rttNanos))] = 1
+	}
+	manager.Add(&PacketInfo{SrcIp: "10.1.1.3", SrcPort: 40000, DstIp: "10.96.0.10", DstPort: 80, Syn: true, TimestampNano: 5000000})
+	assert.Equal(t, len(manager.rttNanos), 0)
+	assert.Equal(t, manager.GetRttNano("10.1.1.1", 40000), int64(200000))
+}
+
+func TestServerDuration(t *testing.T) {
+	info := TrafficInfo{Observer: OBSERVER_CLIENT, requestTimestampNano: 1e9, responseTimestampNano: 1e9 + 30e6}
+	_, ok := info.GetServerDurationMiliSeconds()
+	assert.False(t, ok)
+
+	info.NetworkRttNano = 10e6
+	duration, ok := info.GetServerDurationMiliSeconds()
+	assert.True(t, ok)
+	assert.Equal(t, duration, float64(20))
+
+	info.NetworkRttNano = 40e6
+	duration, _ = info.GetServerDurationMiliSeconds()
+	assert.Equal(t, duration, float64(0))
+
+	info.Observer = OBSERVER_SERVER
+	duration, ok = info.GetServerDurationMiliSeconds()
+	assert.True(t, ok)
+	assert.Equal(t, duration, float64(30))
+}
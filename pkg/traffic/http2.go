@@ -0,0 +1,192 @@
+package traffic
+
+import (
+	"bytes"
+	"github.com/golang/glog"
+	"golang.org/x/net/http2/hpack"
+	"strconv"
+	"strings"
+)
+
+const (
+	HTTP2_FRAME_HEADER_LENGTH = 9
+	HTTP2_FRAME_HEADERS       = 0x1
+	HTTP2_FLAG_PADDED         = 0x8
+	HTTP2_FLAG_PRIORITY       = 0x20
+	//hpack tables of older flows are dropped when there are too many
+	MAX_HTTP2_FLOWS = 10000
+)
+
+var http2Preface = []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+
+type http2Flow struct {
+	decoder *hpack.Decoder
+	fields  []hpack.HeaderField
+}
+
+// http2Decoder parses HEADERS frames, it is best effort:
+// frames truncated by snap length are skipped, which may break the hpack dynamic table of the flow,
+// and streams multiplexed on one connection are not distinguished.
+// For grpc, the response is complete when grpc-status is received, usually in trailers
+type http2Decoder struct {
+	grpc  bool
+	flows map[string]*http2Flow
+}
+
+func newHttp2Decoder(grpc bool) *http2Decoder {
+	return &http2Decoder{
+		grpc:  grpc,
+		flows: make(map[string]*http2Flow),
+	}
+}
+
+func (decoder *http2Decoder) getFlow(flow string) *http2Flow {
+	result := decoder.flows[flow]
+	if result != nil {
+		return result
+	}
+	if len(decoder.flows) >= MAX_HTTP2_FLOWS {
+		decoder.flows = make(map[string]*http2Flow)
+	}
+	result = &http2Flow{}
+	result.decoder = hpack.NewDecoder(4096, func(field hpack.HeaderField) {
+		result.fields = append(result.fields, field)
+	})
+	decoder.flows[flow] = result
+	return result
+}
+
+// decodeHeaders returns header fields of all complete HEADERS frames in the payload
+func (decoder *http2Decoder) decodeHeaders(flow string, payload []byte) []hpack.HeaderField {
+	payload = bytes.TrimPrefix(payload, http2Preface)
+	state := decoder.getFlow(flow)
+	state.fields = nil
+	for len(payload) >= HTTP2_FRAME_HEADER_LENGTH {
+		length := int(payload[0])<<16 | int(payload[1])<<8 | int(payload[2])
+		frameType := payload[3]
+		flags := payload[4]
+		if len(payload) < HTTP2_FRAME_HEADER_LENGTH+length {
+			break
+		}
+		frame := payload[HTTP2_FRAME_HEADER_LENGTH : HTTP2_FRAME_HEADER_LENGTH+length]
+		payload = payload[HTTP2_FRAME_HEADER_LENGTH+length:]
+		if frameType != HTTP2_FRAME_HEADERS {
+			continue
+		}
+		if flags&HTTP2_FLAG_PADDED != 0 {
+			if len(frame) < 1 || int(frame[0]) >= len(frame) {
+				break
+			}
+			frame = frame[1 : len(frame)-int(frame[0])]
+		}
+		if flags&HTTP2_FLAG_PRIORITY != 0 {
+			if len(frame) < 5 {
+				break
+			}
+			frame = frame[5:]
+		}
+		if _, err := state.decoder.Write(frame); err != nil {
+			if glog.V(2) {
+				glog.Infof("Failed to decode http2 headers of %s: %s", flow, err.Error())
+			}
+			break
+		}
+		state.decoder.Close()
+	}
+	return state.fields
+}
+
+func getHeaderField(fields []hpack.HeaderField, name string) string {
+	for _, field := range fields {
+		if field.Name == name {
+			return field.Value
+		}
+	}
+	return ""
+}
+
+// getHeaderFields joins values of a repeated header field with comma
+func getHeaderFields(fields []hpack.HeaderField, name string) string {
+	var values []string
+	for _, field := range fields {
+		if field.Name == name {
+			values = append(values, field.Value)
+		}
+	}
+	return strings.Join(values, ",")
+}
+
+func (decoder *http2Decoder) DecodeRequest(flow string, payload []byte) (string, string, bool) {
+	//h2c may start with an HTTP/1.1 upgrade request
+	if method, url, ok := (httpDecoder{}).DecodeRequest(flow, payload); ok {
+		return method, url, true
+	}
+	fields := decoder.decodeHeaders(flow, payload)
+	method := getHeaderField(fields, ":method")
+	if method == "" {
+		return "", "", false
+	}
+	return method, getHeaderField(fields, ":path"), true
+}
+
+func (decoder *http2Decoder) DecodeHost(flow string, payload []byte) string {
+	if host := (httpDecoder{}).DecodeHost(flow, payload); host != "" {
+		return host
+	}
+	//header fields are kept since the last DecodeRequest of the flow
+	if state := decoder.flows[flow]; state != nil {
+		return getHeaderField(state.fields, ":authority")
+	}
+	return ""
+}
+
+func (decoder *http2Decoder) DecodeClientIP(flow string, payload []byte, trusted func(ip string) bool) string {
+	if ip := getHttpClientIP(payload, trusted); ip != "" {
+		return ip
+	}
+	state := decoder.flows[flow]
+	if state == nil {
+		return ""
+	}
+	return getClientIP(func(name string) string { return getHeaderFields(state.fields, name) }, trusted)
+}
+
+func (decoder *http2Decoder) DecodeTraceContext(flow string, payload []byte) *TraceContext {
+	if trace := getHttpTraceContext(payload); trace != nil {
+		return trace
+	}
+	state := decoder.flows[flow]
+	if state == nil {
+		return nil
+	}
+	return getTraceContext(func(name string) string { return getHeaderField(state.fields, name) })
+}
+
+// DecodeBodySize returns the content-length of the headers, bodies of DATA frames are not counted
+func (decoder *http2Decoder) DecodeBodySize(flow string, payload []byte) (int64, bool) {
+	if bytes.HasPrefix(payload, []byte("HTTP/")) || httpRequestRegexp.Match(payload) {
+		return getHttpBodySize(payload)
+	}
+	state := decoder.flows[flow]
+	if state == nil {
+		return 0, false
+	}
+	size, err := strconv.ParseInt(getHeaderField(state.fields, "content-length"), 10, 64)
+	if err != nil || size < 0 {
+		return 0, false
+	}
+	return size, true
+}
+
+func (decoder *http2Decoder) DecodeResponse(flow string, payload []byte) (string, bool) {
+	if status, ok := (httpDecoder{}).DecodeResponse(flow, payload); ok && status != "101" {
+		return status, true
+	}
+	fields := decoder.decodeHeaders(flow, payload)
+	if decoder.grpc {
+		status := getHeaderField(fields, "grpc-status")
+		return status, status != ""
+	}
+	status := getHeaderField(fields, ":status")
+	return status, status != ""
+}
@@ -0,0 +1,72 @@
+package traffic
+
+import (
+	"strconv"
+	"strings"
+)
+
+// https://dev.mysql.com/doc/internals/en/text-protocol.html
+var mysqlCommands = map[byte]string{
+	0x02: "INIT_DB",
+	0x03: "QUERY",
+	0x0e: "PING",
+	0x16: "STMT_PREPARE",
+	0x17: "STMT_EXECUTE",
+	0x19: "STMT_CLOSE",
+	0x1a: "STMT_RESET",
+}
+
+// mysqlDecoder parses the client/server protocol. method is the command name,
+// url is the statement type of a query like "SELECT", status is "OK" or the error code
+type mysqlDecoder struct{}
+
+// readMysqlPacket returns sequence id and payload of the first packet
+func readMysqlPacket(payload []byte) (byte, []byte, bool) {
+	if len(payload) < 5 {
+		return 0, nil, false
+	}
+	length := int(payload[0]) | int(payload[1])<<8 | int(payload[2])<<16
+	if length == 0 {
+		return 0, nil, false
+	}
+	body := payload[4:]
+	if len(body) > length {
+		body = body[:length]
+	}
+	return payload[3], body, true
+}
+
+func (decoder mysqlDecoder) DecodeRequest(flow string, payload []byte) (string, string, bool) {
+	sequence, body, ok := readMysqlPacket(payload)
+	//a command always starts a new sequence
+	if !ok || sequence != 0 {
+		return "", "", false
+	}
+	command, ok := mysqlCommands[body[0]]
+	if !ok {
+		return "", "", false
+	}
+	var url string
+	if body[0] == 0x03 || body[0] == 0x16 {
+		fields := strings.Fields(string(body[1:]))
+		if len(fields) > 0 {
+			url = strings.ToUpper(fields[0])
+		}
+	}
+	return command, url, true
+}
+
+func (decoder mysqlDecoder) DecodeResponse(flow string, payload []byte) (string, bool) {
+	sequence, body, ok := readMysqlPacket(payload)
+	if !ok || sequence != 1 {
+		return "", false
+	}
+	if body[0] == 0xff {
+		if len(body) < 3 {
+			return "ERR", true
+		}
+		return strconv.Itoa(int(body[1]) | int(body[2])<<8), true
+	}
+	//OK packet, or column count of a result set
+	return "OK", true
+}
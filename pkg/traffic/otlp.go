@@ -0,0 +1,565 @@
+package traffic
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/luguoxiang/kubernetes-traffic-monitor/pkg/config"
+	"github.com/luguoxiang/kubernetes-traffic-monitor/pkg/kubernetes"
+	collectormetrics "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	OTLP_PROTOCOL_GRPC = "grpc"
+	OTLP_PROTOCOL_HTTP = "http"
+	OTLP_REQUESTS_NAME = "traffic.requests"
+	OTLP_DURATION_NAME = "traffic.request.duration"
+	OTLP_SCOPE_NAME    = "github.com/luguoxiang/kubernetes-traffic-monitor"
+	//spans of more requests are dropped until the next export
+	MAX_OTLP_SPANS = 10000
+)
+
+var otlpDurationBounds = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// otlpWorkloadKeys are semantic convention attribute names of workload kinds
+var otlpWorkloadKeys = map[string]string{
+	"Deployment":  "k8s.deployment.name",
+	"StatefulSet": "k8s.statefulset.name",
+	"DaemonSet":   "k8s.daemonset.name",
+	"ReplicaSet":  "k8s.replicaset.name",
+	"Job":         "k8s.job.name",
+	"CronJob":     "k8s.cronjob.name",
+	"Node":        "k8s.node.name",
+	"Pod":         "k8s.pod.name",
+}
+
+type otlpExporter interface {
+	exportMetrics(ctx context.Context, request *collectormetrics.ExportMetricsServiceRequest) error
+	exportTraces(ctx context.Context, request *collectortrace.ExportTraceServiceRequest) error
+}
+
+type otlpGrpcExporter struct {
+	metrics collectormetrics.MetricsServiceClient
+	traces  collectortrace.TraceServiceClient
+	headers metadata.MD
+}
+
+func newOtlpGrpcExporter(otlpConfig *config.OTLPConfig) (*otlpGrpcExporter, error) {
+	transport := grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{}))
+	if otlpConfig.Insecure {
+		transport = grpc.WithTransportCredentials(insecure.NewCredentials())
+	}
+	//the connection is established lazily, and reconnected by grpc
+	conn, err := grpc.Dial(otlpConfig.Endpoint, transport)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect otlp endpoint %s: %s", otlpConfig.Endpoint, err.Error())
+	}
+	return &otlpGrpcExporter{
+		metrics: collectormetrics.NewMetricsServiceClient(conn),
+		traces:  collectortrace.NewTraceServiceClient(conn),
+		headers: metadata.New(otlpConfig.Headers),
+	}, nil
+}
+
+func (exporter *otlpGrpcExporter) exportMetrics(ctx context.Context, request *collectormetrics.ExportMetricsServiceRequest) error {
+	_, err := exporter.metrics.Export(metadata.NewOutgoingContext(ctx, exporter.headers), request)
+	return err
+}
+
+func (exporter *otlpGrpcExporter) exportTraces(ctx context.Context, request *collectortrace.ExportTraceServiceRequest) error {
+	_, err := exporter.traces.Export(metadata.NewOutgoingContext(ctx, exporter.headers), request)
+	return err
+}
+
+type otlpHttpExporter struct {
+	client   *http.Client
+	endpoint string
+	headers  map[string]string
+}
+
+func (exporter *otlpHttpExporter) post(ctx context.Context, path string, message proto.Message) error {
+	data, err := proto.Marshal(message)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest(http.MethodPost, exporter.endpoint+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/x-protobuf")
+	for name, value := range exporter.headers {
+		request.Header.Set(name, value)
+	}
+	response, err := exporter.client.Do(request.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(response.Body)
+		return fmt.Errorf("%s %s: %s", path, response.Status, string(body))
+	}
+	return nil
+}
+
+func (exporter *otlpHttpExporter) exportMetrics(ctx context.Context, request *collectormetrics.ExportMetricsServiceRequest) error {
+	return exporter.post(ctx, "/v1/metrics", request)
+}
+
+func (exporter *otlpHttpExporter) exportTraces(ctx context.Context, request *collectortrace.ExportTraceServiceRequest) error {
+	return exporter.post(ctx, "/v1/traces", request)
+}
+
+// otlpSeries is the cumulative counter and histogram of an attribute set
+type otlpSeries struct {
+	attributes   []*commonpb.KeyValue
+	count        uint64
+	sum          float64
+	bucketCounts []uint64
+	//peers described by the attributes, to delete series of deleted workloads and pods
+	src        otlpPeer
+	dst        otlpPeer
+	startNano  uint64
+	updateTime time.Time
+}
+
+type otlpPeer struct {
+	kind      string
+	name      string
+	namespace string
+}
+
+func (peer otlpPeer) match(kind string, name string, namespace string) bool {
+	return (kind == "" || peer.kind == kind) && peer.name == name && peer.namespace == namespace
+}
+
+// OTLPSink aggregates requests into cumulative OTLP metrics and creates a span for each request if enabled.
+// They are exported periodically by a background goroutine, so Save never waits for the collector.
+// Series are deleted after an export when they are idle for the ttl, or when the workload or pod they describe is deleted,
+// a series created again starts counting from zero with a new start time
+type OTLPSink struct {
+	exporter  otlpExporter
+	spans     bool
+	interval  time.Duration
+	resource  *resourcepb.Resource
+	maxSeries int
+	ttl       time.Duration
+
+	mutex         sync.Mutex
+	series        map[string]*otlpSeries
+	droppedSeries int
+	pendingSpans  []*tracepb.Span
+	droppedSpans  int
+}
+
+func NewOTLPSink(otlpConfig *config.OTLPConfig) (*OTLPSink, error) {
+	if otlpConfig.ExportIntervalSeconds <= 0 {
+		return nil, fmt.Errorf("Invalid otlp export interval %d", otlpConfig.ExportIntervalSeconds)
+	}
+	var exporter otlpExporter
+	switch otlpConfig.Protocol {
+	case OTLP_PROTOCOL_GRPC, "":
+		grpcExporter, err := newOtlpGrpcExporter(otlpConfig)
+		if err != nil {
+			return nil, err
+		}
+		exporter = grpcExporter
+	case OTLP_PROTOCOL_HTTP:
+		exporter = &otlpHttpExporter{
+			client:   &http.Client{Timeout: 10 * time.Second},
+			endpoint: strings.TrimSuffix(otlpConfig.Endpoint, "/"),
+			headers:  otlpConfig.Headers,
+		}
+	default:
+		return nil, fmt.Errorf("Unknown otlp protocol %s", otlpConfig.Protocol)
+	}
+	return newOTLPSink(exporter, otlpConfig), nil
+}
+
+func newOTLPSink(exporter otlpExporter, otlpConfig *config.OTLPConfig) *OTLPSink {
+	resource := &resourcepb.Resource{
+		Attributes: []*commonpb.KeyValue{stringAttribute("service.name", "traffic-monitor")},
+	}
+	if node := os.Getenv("NODE_NAME"); node != "" {
+		resource.Attributes = append(resource.Attributes, stringAttribute("k8s.node.name", node))
+	}
+	return &OTLPSink{
+		exporter:  exporter,
+		spans:     otlpConfig.Spans,
+		interval:  time.Duration(otlpConfig.ExportIntervalSeconds) * time.Second,
+		resource:  resource,
+		maxSeries: otlpConfig.MaxSeries,
+		ttl:       time.Duration(otlpConfig.SeriesTTLSeconds) * time.Second,
+		series:    make(map[string]*otlpSeries),
+	}
+}
+
+func stringAttribute(key string, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}}}
+}
+
+func intAttribute(key string, value int64) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: value}}}
+}
+
+// workloadAttributes names a peer by semantic convention attributes, prefix distinguishes the source
+func workloadAttributes(prefix string, kind string, name string, namespace string) []*commonpb.KeyValue {
+	if name == "" {
+		return nil
+	}
+	key, ok := otlpWorkloadKeys[kind]
+	if !ok {
+		//external peers and workloads of other kinds
+		key = "k8s.workload.name"
+	}
+	result := []*commonpb.KeyValue{stringAttribute(prefix+key, name)}
+	if namespace != "" {
+		result = append(result, stringAttribute(prefix+"k8s.namespace.name", namespace))
+	}
+	return result
+}
+
+// metricAttributes returns low cardinality attributes of a request, following semantic conventions of its protocol
+func metricAttributes(info *TrafficInfo) []*commonpb.KeyValue {
+	result := workloadAttributes("", info.DstKind, info.Dst, info.DstNS)
+	result = append(result, workloadAttributes("source.", info.SrcKind, info.Src, info.SrcNS)...)
+	result = append(result, intAttribute("server.port", int64(info.DstPort)))
+	switch info.Protocol {
+	case kubernetes.PROTOCOL_REDIS, kubernetes.PROTOCOL_MYSQL:
+		result = append(result, stringAttribute("db.system", info.Protocol))
+		result = append(result, stringAttribute("db.operation.name", info.Method))
+		result = append(result, stringAttribute("db.response.status_code", info.Status))
+	case kubernetes.PROTOCOL_GRPC:
+		result = append(result, stringAttribute("rpc.system", "grpc"))
+		result = append(result, stringAttribute("rpc.method", info.Path))
+		if code, err := strconv.Atoi(info.Status); err == nil {
+			result = append(result, intAttribute("rpc.grpc.status_code", int64(code)))
+		}
+	default:
+		result = append(result, stringAttribute("http.request.method", info.Method))
+		result = append(result, stringAttribute("http.route", info.Path))
+		if code, err := strconv.Atoi(info.Status); err == nil {
+			result = append(result, intAttribute("http.response.status_code", int64(code)))
+		}
+	}
+	if info.Observer != "" {
+		result = append(result, stringAttribute("traffic.observer", info.Observer))
+	}
+	return result
+}
+
+func attributesKey(attributes []*commonpb.KeyValue) string {
+	var buffer bytes.Buffer
+	for _, attribute := range attributes {
+		buffer.WriteString(attribute.Key)
+		buffer.WriteString("=")
+		buffer.WriteString(attribute.Value.String())
+		buffer.WriteString("\x00")
+	}
+	return buffer.String()
+}
+
+func randomId(length int) []byte {
+	result := make([]byte, length)
+	rand.Read(result)
+	return result
+}
+
+func isErrorStatus(info *TrafficInfo) bool {
+	switch info.Protocol {
+	case kubernetes.PROTOCOL_REDIS, kubernetes.PROTOCOL_MYSQL:
+		return info.Status == "ERR"
+	case kubernetes.PROTOCOL_GRPC:
+		return info.Status != "0"
+	}
+	code, err := strconv.Atoi(info.Status)
+	return err == nil && code >= 500
+}
+
+func (sink *OTLPSink) newSpan(info *TrafficInfo, attributes []*commonpb.KeyValue) *tracepb.Span {
+	name := info.Method
+	if info.Path != "" {
+		name = name + " " + info.Path
+	}
+	url := info.Url
+	if i := strings.IndexAny(url, "?#"); i >= 0 {
+		url = url[:i]
+	}
+	//attributes of the metric series are shared
+	attributes = append(append([]*commonpb.KeyValue(nil), attributes...), stringAttribute("url.path", url), stringAttribute("client.address", info.ClientIP))
+	if info.SrcPod != "" {
+		attributes = append(attributes, stringAttribute("source.k8s.pod.name", info.SrcPod))
+	}
+	if info.DstPod != "" {
+		attributes = append(attributes, stringAttribute("k8s.pod.name", info.DstPod))
+	}
+	kind := tracepb.Span_SPAN_KIND_CLIENT
+	if info.Observer == OBSERVER_SERVER {
+		kind = tracepb.Span_SPAN_KIND_SERVER
+	}
+	result := &tracepb.Span{
+		TraceId:           randomId(16),
+		SpanId:            randomId(8),
+		Name:              name,
+		Kind:              kind,
+		StartTimeUnixNano: uint64(info.requestTimestampNano),
+		EndTimeUnixNano:   uint64(info.responseTimestampNano),
+		Attributes:        attributes,
+	}
+	if info.Trace != nil {
+		//a child of the caller's span, since spans are not shared by client and server in OpenTelemetry
+		result.TraceId, _ = hex.DecodeString(strings.Repeat("0", 32-len(info.Trace.TraceID)) + info.Trace.TraceID)
+		result.ParentSpanId, _ = hex.DecodeString(info.Trace.SpanID)
+	}
+	if isErrorStatus(info) {
+		result.Status = &tracepb.Status{Code: tracepb.Status_STATUS_CODE_ERROR}
+	}
+	return result
+}
+
+func (sink *OTLPSink) Save(info *TrafficInfo) {
+	attributes := metricAttributes(info)
+	key := attributesKey(attributes)
+	duration := info.GetDurationTimeMiliSeconds() / 1000
+
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	if info.Observer == OBSERVER_SERVER {
+		//the request is counted by the client node's copy, the server node's copy is only a span
+		sink.addSpan(info, attributes)
+		return
+	}
+	now := time.Now()
+	series := sink.series[key]
+	if series == nil {
+		if sink.maxSeries > 0 && len(sink.series) >= sink.maxSeries {
+			sink.droppedSeries++
+			sink.addSpan(info, attributes)
+			return
+		}
+		series = &otlpSeries{
+			attributes:   attributes,
+			bucketCounts: make([]uint64, len(otlpDurationBounds)+1),
+			src:          otlpPeer{kind: info.SrcKind, name: info.Src, namespace: info.SrcNS},
+			dst:          otlpPeer{kind: info.DstKind, name: info.Dst, namespace: info.DstNS},
+			startNano:    uint64(now.UnixNano()),
+		}
+		sink.series[key] = series
+	}
+	series.updateTime = now
+	series.count++
+	series.sum += duration
+	series.bucketCounts[sort.SearchFloat64s(otlpDurationBounds, duration)]++
+	sink.addSpan(info, attributes)
+}
+
+func (sink *OTLPSink) addSpan(info *TrafficInfo, attributes []*commonpb.KeyValue) {
+	if !sink.spans {
+		return
+	}
+	if len(sink.pendingSpans) >= MAX_OTLP_SPANS {
+		sink.droppedSpans++
+		return
+	}
+	sink.pendingSpans = append(sink.pendingSpans, sink.newSpan(info, attributes))
+}
+
+func (sink *OTLPSink) metricsRequest(nowNano uint64) *collectormetrics.ExportMetricsServiceRequest {
+	counter := &metricspb.Sum{
+		AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+		IsMonotonic:            true,
+	}
+	histogram := &metricspb.Histogram{
+		AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+	}
+	for _, series := range sink.series {
+		counter.DataPoints = append(counter.DataPoints, &metricspb.NumberDataPoint{
+			Attributes:        series.attributes,
+			StartTimeUnixNano: series.startNano,
+			TimeUnixNano:      nowNano,
+			Value:             &metricspb.NumberDataPoint_AsInt{AsInt: int64(series.count)},
+		})
+		sum := series.sum
+		histogram.DataPoints = append(histogram.DataPoints, &metricspb.HistogramDataPoint{
+			Attributes:        series.attributes,
+			StartTimeUnixNano: series.startNano,
+			TimeUnixNano:      nowNano,
+			Count:             series.count,
+			Sum:               &sum,
+			BucketCounts:      append([]uint64(nil), series.bucketCounts...),
+			ExplicitBounds:    otlpDurationBounds,
+		})
+	}
+	return &collectormetrics.ExportMetricsServiceRequest{
+		ResourceMetrics: []*metricspb.ResourceMetrics{{
+			Resource: sink.resource,
+			ScopeMetrics: []*metricspb.ScopeMetrics{{
+				Scope: &commonpb.InstrumentationScope{Name: OTLP_SCOPE_NAME},
+				Metrics: []*metricspb.Metric{
+					{
+						Name:        OTLP_REQUESTS_NAME,
+						Description: "Request count.",
+						Unit:        "{request}",
+						Data:        &metricspb.Metric_Sum{Sum: counter},
+					},
+					{
+						Name:        OTLP_DURATION_NAME,
+						Description: "Request durations in seconds.",
+						Unit:        "s",
+						Data:        &metricspb.Metric_Histogram{Histogram: histogram},
+					},
+				},
+			}},
+		}},
+	}
+}
+
+// Export sends current metrics and pending spans
+func (sink *OTLPSink) Export(ctx context.Context) error {
+	sink.mutex.Lock()
+	if len(sink.series) == 0 && len(sink.pendingSpans) == 0 {
+		sink.mutex.Unlock()
+		return nil
+	}
+	now := time.Now()
+	metricsRequest := sink.metricsRequest(uint64(now.UnixNano()))
+	//the last values of stale series have been added to the request
+	sink.deleteStaleSeries(now)
+	spans := sink.pendingSpans
+	sink.pendingSpans = nil
+	if sink.droppedSpans > 0 {
+		glog.Warningf("Dropped %d otlp spans", sink.droppedSpans)
+		sink.droppedSpans = 0
+	}
+	if sink.droppedSeries > 0 {
+		glog.Warningf("Dropped %d requests of new otlp series beyond %d series", sink.droppedSeries, sink.maxSeries)
+		sink.droppedSeries = 0
+	}
+	sink.mutex.Unlock()
+
+	//spans are exported even if metrics fail, since they are not kept for the next export
+	var metricsErr error
+	if err := sink.exporter.exportMetrics(ctx, metricsRequest); err != nil {
+		metricsErr = fmt.Errorf("Failed to export otlp metrics: %s", err.Error())
+	}
+	if len(spans) == 0 {
+		return metricsErr
+	}
+	err := sink.exporter.exportTraces(ctx, &collectortrace.ExportTraceServiceRequest{
+		ResourceSpans: []*tracepb.ResourceSpans{{
+			Resource: sink.resource,
+			ScopeSpans: []*tracepb.ScopeSpans{{
+				Scope: &commonpb.InstrumentationScope{Name: OTLP_SCOPE_NAME},
+				Spans: spans,
+			}},
+		}},
+	})
+	if err != nil {
+		err = fmt.Errorf("Failed to export %d otlp spans: %s", len(spans), err.Error())
+		if metricsErr != nil {
+			return fmt.Errorf("%s, %s", metricsErr.Error(), err.Error())
+		}
+		return err
+	}
+	return metricsErr
+}
+
+func (sink *OTLPSink) deleteSeries(match func(series *otlpSeries) bool) int {
+	var result int
+	for key, series := range sink.series {
+		if match(series) {
+			delete(sink.series, key)
+			result++
+		}
+	}
+	return result
+}
+
+// deleteStaleSeries deletes series which are not updated for the ttl, series are kept without ttl
+func (sink *OTLPSink) deleteStaleSeries(now time.Time) {
+	if sink.ttl <= 0 {
+		return
+	}
+	count := sink.deleteSeries(func(series *otlpSeries) bool {
+		return now.Sub(series.updateTime) > sink.ttl
+	})
+	if count > 0 && glog.V(2) {
+		glog.Infof("Deleted %d stale otlp series", count)
+	}
+}
+
+// deleteResourceSeries deletes series whose source or destination is the resource, any kind matches if kind is empty
+func (sink *OTLPSink) deleteResourceSeries(kind string, name string, namespace string) {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	count := sink.deleteSeries(func(series *otlpSeries) bool {
+		return series.src.match(kind, name, namespace) || series.dst.match(kind, name, namespace)
+	})
+	if count > 0 && glog.V(2) {
+		glog.Infof("Deleted %d otlp series of %s@%s", count, name, namespace)
+	}
+}
+
+func (sink *OTLPSink) DeploymentValid(deployment *kubernetes.DeploymentInfo) bool {
+	return true
+}
+
+func (sink *OTLPSink) DeploymentAdded(deployment *kubernetes.DeploymentInfo) {
+}
+
+func (sink *OTLPSink) DeploymentDeleted(deployment *kubernetes.DeploymentInfo) {
+	sink.deleteResourceSeries("", deployment.Name(), deployment.Namespace())
+}
+
+func (sink *OTLPSink) DeploymentUpdated(oldDeployment, newDeployment *kubernetes.DeploymentInfo) {
+}
+
+func (sink *OTLPSink) PodValid(pod *kubernetes.PodInfo) bool {
+	return true
+}
+
+func (sink *OTLPSink) PodAdded(pod *kubernetes.PodInfo) {
+}
+
+// PodDeleted deletes series of peers named by the pod, which have no workload
+func (sink *OTLPSink) PodDeleted(pod *kubernetes.PodInfo) {
+	sink.deleteResourceSeries("Pod", pod.Name(), pod.Namespace())
+}
+
+func (sink *OTLPSink) PodUpdated(oldPod, newPod *kubernetes.PodInfo) {
+}
+
+// Start exports periodically in background
+func (sink *OTLPSink) Start() {
+	go func() {
+		for range time.Tick(sink.interval) {
+			ctx, cancel := context.WithTimeout(context.Background(), sink.interval)
+			if err := sink.Export(ctx); err != nil {
+				glog.Warning(err.Error())
+			}
+			cancel()
+		}
+	}()
+}
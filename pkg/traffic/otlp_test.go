@@ -0,0 +1,311 @@
+package traffic
+
+import (
+	"context"
+	"encoding/hex"
+	"github.com/luguoxiang/kubernetes-traffic-monitor/pkg/config"
+	"github.com/luguoxiang/kubernetes-traffic-monitor/pkg/kubernetes"
+	"github.com/stretchr/testify/assert"
+	collectormetrics "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+	"io/ioutil"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testOtlpReceiver is an in-process OTLP collector
+type testOtlpReceiver struct {
+	collectormetrics.UnimplementedMetricsServiceServer
+	collectortrace.UnimplementedTraceServiceServer
+	mutex   sync.Mutex
+	metrics []*collectormetrics.ExportMetricsServiceRequest
+	traces  []*collectortrace.ExportTraceServiceRequest
+	tokens  []string
+	//http metrics requests fail
+	failMetrics bool
+}
+
+func (receiver *testOtlpReceiver) addToken(token string) {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	receiver.tokens = append(receiver.tokens, token)
+}
+
+func (receiver *testOtlpReceiver) Export(ctx context.Context, request *collectormetrics.ExportMetricsServiceRequest) (*collectormetrics.ExportMetricsServiceResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	receiver.addToken(md.Get("x-token")[0])
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	receiver.metrics = append(receiver.metrics, request)
+	return &collectormetrics.ExportMetricsServiceResponse{}, nil
+}
+
+type testTraceService struct {
+	*testOtlpReceiver
+}
+
+func (service testTraceService) Export(ctx context.Context, request *collectortrace.ExportTraceServiceRequest) (*collectortrace.ExportTraceServiceResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	service.addToken(md.Get("x-token")[0])
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	service.traces = append(service.traces, request)
+	return &collectortrace.ExportTraceServiceResponse{}, nil
+}
+
+func (receiver *testOtlpReceiver) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	receiver.addToken(request.Header.Get("X-Token"))
+	data, _ := ioutil.ReadAll(request.Body)
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	switch request.URL.Path {
+	case "/v1/metrics":
+		if receiver.failMetrics {
+			writer.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		message := &collectormetrics.ExportMetricsServiceRequest{}
+		proto.Unmarshal(data, message)
+		receiver.metrics = append(receiver.metrics, message)
+	case "/v1/traces":
+		message := &collectortrace.ExportTraceServiceRequest{}
+		proto.Unmarshal(data, message)
+		receiver.traces = append(receiver.traces, message)
+	default:
+		writer.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func getTestAttribute(attributes []*commonpb.KeyValue, key string) *commonpb.AnyValue {
+	for _, attribute := range attributes {
+		if attribute.Key == key {
+			return attribute.Value
+		}
+	}
+	return nil
+}
+
+func newTestOtlpTraffic(status string) *TrafficInfo {
+	return &TrafficInfo{
+		Src:                   "a",
+		SrcNS:                 "test",
+		SrcKind:               "StatefulSet",
+		SrcPod:                "a-0",
+		Dst:                   "b",
+		DstNS:                 "test",
+		DstKind:               "Deployment",
+		DstPort:               8080,
+		Protocol:              kubernetes.PROTOCOL_HTTP,
+		Method:                "GET",
+		Url:                   "/users/1?q=a",
+		Path:                  "/users/{id}",
+		Status:                status,
+		Observer:              OBSERVER_CLIENT,
+		requestTimestampNano:  1e9,
+		responseTimestampNano: 1e9 + 20e6,
+	}
+}
+
+func checkOtlpReceiver(t *testing.T, receiver *testOtlpReceiver) {
+	assert.Equal(t, receiver.tokens, []string{"secret", "secret"})
+	assert.Equal(t, len(receiver.metrics), 1)
+	metrics := receiver.metrics[0].ResourceMetrics[0].ScopeMetrics[0].Metrics
+	assert.Equal(t, metrics[0].Name, OTLP_REQUESTS_NAME)
+	points := metrics[0].GetSum().DataPoints
+	assert.Equal(t, len(points), 2)
+
+	for _, point := range points {
+		attributes := point.Attributes
+		assert.Equal(t, getTestAttribute(attributes, "k8s.deployment.name").GetStringValue(), "b")
+		assert.Equal(t, getTestAttribute(attributes, "k8s.namespace.name").GetStringValue(), "test")
+		assert.Equal(t, getTestAttribute(attributes, "source.k8s.statefulset.name").GetStringValue(), "a")
+		assert.Equal(t, getTestAttribute(attributes, "http.request.method").GetStringValue(), "GET")
+		assert.Equal(t, getTestAttribute(attributes, "http.route").GetStringValue(), "/users/{id}")
+		if getTestAttribute(attributes, "http.response.status_code").GetIntValue() == 200 {
+			assert.Equal(t, point.GetAsInt(), int64(2))
+		} else {
+			assert.Equal(t, point.GetAsInt(), int64(1))
+		}
+	}
+	histogram := metrics[1].GetHistogram().DataPoints
+	assert.Equal(t, metrics[1].Name, OTLP_DURATION_NAME)
+	assert.Equal(t, len(histogram), 2)
+	for _, point := range histogram {
+		//0.02 seconds
+		assert.Equal(t, point.BucketCounts[2], point.Count)
+	}
+
+	assert.Equal(t, len(receiver.traces), 1)
+	spans := receiver.traces[0].ResourceSpans[0].ScopeSpans[0].Spans
+	assert.Equal(t, len(spans), 4)
+	assert.Equal(t, spans[3].Kind, tracepb.Span_SPAN_KIND_SERVER)
+	assert.Equal(t, spans[0].Name, "GET /users/{id}")
+	assert.Equal(t, spans[0].EndTimeUnixNano-spans[0].StartTimeUnixNano, uint64(20e6))
+	assert.Equal(t, getTestAttribute(spans[0].Attributes, "url.path").GetStringValue(), "/users/1")
+	assert.Equal(t, getTestAttribute(spans[0].Attributes, "source.k8s.pod.name").GetStringValue(), "a-0")
+	assert.Nil(t, spans[0].Status)
+	assert.Equal(t, spans[2].Status.Code, tracepb.Status_STATUS_CODE_ERROR)
+	assert.Equal(t, len(spans[0].TraceId), 16)
+	assert.NotEqual(t, spans[0].TraceId, spans[1].TraceId)
+	assert.Equal(t, spans[0].Kind, tracepb.Span_SPAN_KIND_CLIENT)
+
+	//child of the propagated span
+	assert.Equal(t, hex.EncodeToString(spans[1].TraceId), "00000000000000000000000000000abc")
+	assert.Equal(t, hex.EncodeToString(spans[1].ParentSpanId), "0000000000000def")
+	assert.Equal(t, len(spans[1].SpanId), 8)
+}
+
+func exportTestOtlp(t *testing.T, otlpConfig *config.OTLPConfig) {
+	sink, err := NewOTLPSink(otlpConfig)
+	assert.Nil(t, err)
+	//nothing to export
+	assert.Nil(t, sink.Export(context.Background()))
+
+	sink.Save(newTestOtlpTraffic("200"))
+	traced := newTestOtlpTraffic("200")
+	traced.Trace = &TraceContext{TraceID: "0000000000000abc", SpanID: "0000000000000def"}
+	sink.Save(traced)
+	sink.Save(newTestOtlpTraffic("503"))
+	//the server node's copy is only a span
+	server := newTestOtlpTraffic("200")
+	server.Observer = OBSERVER_SERVER
+	sink.Save(server)
+	assert.Nil(t, sink.Export(context.Background()))
+}
+
+func TestOTLPSinkGrpc(t *testing.T) {
+	receiver := &testOtlpReceiver{}
+	server := grpc.NewServer()
+	collectormetrics.RegisterMetricsServiceServer(server, receiver)
+	collectortrace.RegisterTraceServiceServer(server, testTraceService{receiver})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	exportTestOtlp(t, &config.OTLPConfig{
+		Protocol:              OTLP_PROTOCOL_GRPC,
+		Endpoint:              listener.Addr().String(),
+		Insecure:              true,
+		Headers:               map[string]string{"x-token": "secret"},
+		ExportIntervalSeconds: 30,
+		Spans:                 true,
+	})
+	checkOtlpReceiver(t, receiver)
+}
+
+func TestOTLPSinkHttp(t *testing.T) {
+	receiver := &testOtlpReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	exportTestOtlp(t, &config.OTLPConfig{
+		Protocol:              OTLP_PROTOCOL_HTTP,
+		Endpoint:              server.URL + "/",
+		Headers:               map[string]string{"X-Token": "secret"},
+		ExportIntervalSeconds: 30,
+		Spans:                 true,
+	})
+	checkOtlpReceiver(t, receiver)
+
+	_, err := NewOTLPSink(&config.OTLPConfig{Protocol: "thrift", ExportIntervalSeconds: 30})
+	assert.NotNil(t, err)
+	_, err = NewOTLPSink(&config.OTLPConfig{Protocol: OTLP_PROTOCOL_HTTP})
+	assert.NotNil(t, err)
+}
+
+func TestOTLPSinkCumulative(t *testing.T) {
+	receiver := &testOtlpReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	sink, err := NewOTLPSink(&config.OTLPConfig{Protocol: OTLP_PROTOCOL_HTTP, Endpoint: server.URL, ExportIntervalSeconds: 30, Spans: true})
+	assert.Nil(t, err)
+
+	//metrics are cumulative, spans are only exported once
+	sink.Save(newTestOtlpTraffic("200"))
+	assert.Nil(t, sink.Export(context.Background()))
+	sink.Save(newTestOtlpTraffic("200"))
+	assert.Nil(t, sink.Export(context.Background()))
+
+	assert.Equal(t, len(receiver.metrics), 2)
+	assert.Equal(t, receiver.metrics[1].ResourceMetrics[0].ScopeMetrics[0].Metrics[0].GetSum().DataPoints[0].GetAsInt(), int64(2))
+	assert.Equal(t, len(receiver.traces), 2)
+	assert.Equal(t, len(receiver.traces[1].ResourceSpans[0].ScopeSpans[0].Spans), 1)
+
+	//spans are exported when metrics fail
+	receiver.failMetrics = true
+	sink.Save(newTestOtlpTraffic("200"))
+	assert.NotNil(t, sink.Export(context.Background()))
+	assert.Equal(t, len(receiver.metrics), 2)
+	assert.Equal(t, len(receiver.traces), 3)
+
+	//spans are dropped when the collector is slow
+	for i := 0; i < MAX_OTLP_SPANS+1; i++ {
+		sink.Save(newTestOtlpTraffic("200"))
+	}
+	assert.Equal(t, len(sink.pendingSpans), MAX_OTLP_SPANS)
+	assert.Equal(t, sink.droppedSpans, 1)
+}
+
+func TestOTLPSinkSeries(t *testing.T) {
+	receiver := &testOtlpReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	sink, err := NewOTLPSink(&config.OTLPConfig{Protocol: OTLP_PROTOCOL_HTTP, Endpoint: server.URL, ExportIntervalSeconds: 30,
+		MaxSeries: 3, SeriesTTLSeconds: 60})
+	assert.Nil(t, err)
+
+	sink.Save(newTestOtlpTraffic("200"))
+	sink.Save(newTestOtlpTraffic("503"))
+	podTraffic := newTestOtlpTraffic("200")
+	podTraffic.Src = "a-0"
+	podTraffic.SrcKind = "Pod"
+	sink.Save(podTraffic)
+	//beyond the series budget
+	sink.Save(newTestOtlpTraffic("404"))
+	assert.Equal(t, len(sink.series), 3)
+	assert.Equal(t, sink.droppedSeries, 1)
+	assert.Nil(t, sink.Export(context.Background()))
+	assert.Equal(t, sink.droppedSeries, 0)
+	assert.Equal(t, len(sink.series), 3)
+
+	//a workload of the same name in another namespace
+	pod := corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "a-0", Namespace: "other"}, Status: corev1.PodStatus{PodIP: "10.1.1.1"}}
+	sink.PodDeleted(kubernetes.NewPodInfo(&pod))
+	assert.Equal(t, len(sink.series), 3)
+	pod.Namespace = "test"
+	sink.PodDeleted(kubernetes.NewPodInfo(&pod))
+	assert.Equal(t, len(sink.series), 2)
+
+	sink.deleteStaleSeries(time.Now())
+	assert.Equal(t, len(sink.series), 2)
+	sink.deleteStaleSeries(time.Now().Add(61 * time.Second))
+	assert.Equal(t, len(sink.series), 0)
+
+	//a series created again restarts
+	sink.Save(newTestOtlpTraffic("200"))
+	startNano := sink.series[attributesKey(metricAttributes(newTestOtlpTraffic("200")))].startNano
+	deployment := &appsv1.Deployment{}
+	deployment.Name = "b"
+	deployment.Namespace = "test"
+	deployment.Spec.Selector = &metav1.LabelSelector{}
+	sink.DeploymentDeleted(kubernetes.NewDeploymentInfo(deployment))
+	assert.Equal(t, len(sink.series), 0)
+	sink.Save(newTestOtlpTraffic("200"))
+	assert.Nil(t, sink.Export(context.Background()))
+	point := receiver.metrics[1].ResourceMetrics[0].ScopeMetrics[0].Metrics[0].GetSum().DataPoints[0]
+	assert.Equal(t, point.GetAsInt(), int64(1))
+	assert.True(t, point.StartTimeUnixNano >= startNano)
+}
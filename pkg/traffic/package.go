@@ -3,50 +3,233 @@ package traffic
 import (
 	"fmt"
 	"github.com/golang/glog"
+	"github.com/luguoxiang/kubernetes-traffic-monitor/pkg/geoip"
 	"github.com/luguoxiang/kubernetes-traffic-monitor/pkg/kubernetes"
+	"github.com/luguoxiang/kubernetes-traffic-monitor/pkg/procfs"
 	"net"
-	"regexp"
 	"time"
 )
 
-var (
-	httpRequestRegexp  = regexp.MustCompile(`^(GET|POST|PUT|DELETE|HEAD)\s+(.*)\sHTTP/[\d.]+`)
-	httpResponseRegexp = regexp.MustCompile(`^HTTP/[\d.]+\s+(\d+)`)
-)
-
 type PacketManager struct {
 	k8sManager     *kubernetes.K8sResourceManager
 	pCapManager    *PCapManager
 	trafficManager TrafficManager
+	entryManager   EntryManager
+	decoderManager *DecoderManager
+	proxyFlows     ProxyFlows
+	handshakes     HandshakeManager
+	socketResolver *procfs.SocketResolver
+	//names peers outside the cluster
+	externalResolver *ExternalResolver
+	geoResolver      *geoip.Resolver
+	pathTemplater    *PathTemplater
+	//proxies in front of the cluster whose forwarding headers are honoured, besides ingress controllers
+	trustedProxies []*net.IPNet
+	//keep the server node's copy of cross node pod to pod requests
+	serverObserver bool
+	sinks          []TrafficSink
 }
 
-func NewPacketManager(k8sManager *kubernetes.K8sResourceManager) (*PacketManager, error) {
+// NewPacketManager creates PacketManager, socketResolver, externalResolver and geoResolver are optional
+func NewPacketManager(k8sManager *kubernetes.K8sResourceManager, socketResolver *procfs.SocketResolver,
+	externalResolver *ExternalResolver, geoResolver *geoip.Resolver) (*PacketManager, error) {
 	k8sIp := k8sManager.GetK8sIP()
 	if k8sIp == "" {
 		glog.Warning("failed to get ip of 'kubernetes'")
 	}
 
-	var ip string
-	for {
-		ip = k8sManager.GetPodIpInThisNode()
-		if ip != "" {
-			break
-		}
-		glog.Warning("Failed to get a pod ip in this node, try again 10s later")
-		time.Sleep(10 * time.Second)
+	//kubernetes resources have been synced, so a pod ip is known unless there is no pod in this node
+	ip := k8sManager.GetPodIpInThisNode()
+	if ip == "" {
+		glog.Warning("Failed to get a pod ip in this node, use default device")
+	}
+	pCapManager := NewPCapManager(k8sIp, net.ParseIP(ip))
+	if externalResolver != nil {
+		pCapManager.SetCaptureDNS(externalResolver.ObserveDNS())
 	}
 	return &PacketManager{
-		k8sManager:  k8sManager,
-		pCapManager: NewPCapManager(k8sIp, net.ParseIP(ip)),
+		k8sManager:       k8sManager,
+		pCapManager:      pCapManager,
+		decoderManager:   NewDecoderManager(),
+		socketResolver:   socketResolver,
+		externalResolver: externalResolver,
+		geoResolver:      geoResolver,
 	}, nil
 
 }
 
+// SetPathTemplater sets templater of path label, path label is empty without it
+func (manager *PacketManager) SetPathTemplater(templater *PathTemplater) {
+	manager.pathTemplater = templater
+}
+
+// SetServerObserver keeps the server node's copy of cross node pod to pod requests tagged by OBSERVER_SERVER,
+// which is dropped by default. The copies are captured by the agents of different nodes and cannot be joined,
+// so sinks count requests by the client node's copy only and take the server duration from the server node's copy
+func (manager *PacketManager) SetServerObserver(serverObserver bool) {
+	manager.serverObserver = serverObserver
+}
+
+// SetTrustedProxies sets cidrs of proxies whose forwarding headers and PROXY protocol preambles give the client ip
+func (manager *PacketManager) SetTrustedProxies(cidrs []string) error {
+	manager.trustedProxies = nil
+	for _, cidr := range cidrs {
+		ipNet, err := parseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("Invalid cidr %s of trusted proxy: %s", cidr, err.Error())
+		}
+		manager.trustedProxies = append(manager.trustedProxies, ipNet)
+	}
+	return nil
+}
+
+// AddSink adds a receiver of completed requests
+func (manager *PacketManager) AddSink(sink TrafficSink) {
+	manager.sinks = append(manager.sinks, sink)
+}
+
+func (manager *PacketManager) save(trafficInfo *TrafficInfo) {
+	for _, sink := range manager.sinks {
+		sink.Save(trafficInfo)
+	}
+}
+
 func (manager *PacketManager) Run() {
+	manager.pCapManager.SetProtocolPorts(manager.k8sManager.GetProtocolPorts())
+	go func() {
+		//packets of non-http protocols are captured by port, which changes with pods and services
+		for range time.Tick(10 * time.Second) {
+			manager.pCapManager.SetProtocolPorts(manager.k8sManager.GetProtocolPorts())
+		}
+	}()
 	manager.pCapManager.Run(manager.Handle)
 }
 
-func (manager *PacketManager) checkResponse(packet *PacketInfo, srcPod *kubernetes.PodInfo, dstPod *kubernetes.PodInfo) (*TrafficInfo, bool) {
+// getEndpoint resolves an address, a local socket is resolved by the pod of its process if possible,
+// since several host network pods may listen on the same node ip
+func (manager *PacketManager) getEndpoint(ip string, port uint32, timestampNano int64) *kubernetes.EndpointInfo {
+	k8sManager := manager.k8sManager
+	if manager.socketResolver != nil && k8sManager.IsLocalIp(ip) {
+		process := manager.socketResolver.GetProcess(ip, port)
+		if process != nil && process.PodUID != "" {
+			//an unmonitored host network pod is resolved to the node by address
+			if endpoint := k8sManager.GetEndpointFromPodUID(process.PodUID); endpoint != nil && !endpoint.Skip {
+				return endpoint
+			}
+		}
+	}
+	return k8sManager.GetEndpointFromAddressAt(ip, port, timestampNano)
+}
+
+// resolveExternal names an ip outside the cluster, name is empty if unknown
+func (manager *PacketManager) resolveExternal(ip string, timestampNano int64) (string, string) {
+	if manager.externalResolver == nil {
+		return "", ""
+	}
+	return manager.externalResolver.Resolve(ip, timestampNano)
+}
+
+func isIngressController(endpoint *kubernetes.EndpointInfo) bool {
+	return endpoint != nil && endpoint.IngressController
+}
+
+func hasService(endpoint *kubernetes.EndpointInfo, namespace string, name string) bool {
+	if endpoint == nil {
+		return false
+	}
+	for _, service := range endpoint.Services {
+		if service.Name() == name && service.Namespace() == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// setIngress attributes a request sent to an ingress controller, or sent by it to a backend,
+// to the ingress rule matching its host and path. Ingress controllers keep the Host header when proxying
+func (manager *PacketManager) setIngress(trafficInfo *TrafficInfo, decoder Decoder, flow string, payload []byte, dstEndpoint *kubernetes.EndpointInfo) {
+	hostDecoder, ok := decoder.(HostDecoder)
+	if !ok {
+		return
+	}
+	ingress, rule, path := manager.k8sManager.GetIngress(hostDecoder.DecodeHost(flow, payload), trafficInfo.Url)
+	if ingress == nil {
+		return
+	}
+	if !isIngressController(dstEndpoint) && !hasService(dstEndpoint, ingress.Namespace(), path.ServiceName) {
+		//the backend request is not routed by this ingress
+		return
+	}
+	trafficInfo.Ingress = ingress.Name()
+	trafficInfo.IngressHost = rule.Host
+}
+
+func (manager *PacketManager) isTrustedProxyIp(ip string) bool {
+	parsed := net.ParseIP(ip)
+	for _, ipNet := range manager.trustedProxies {
+		if ipNet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// isTrustedProxy checks if forwarded hops of a proxy can be believed, ingress controllers are trusted
+func (manager *PacketManager) isTrustedProxy(ip string) bool {
+	return manager.isTrustedProxyIp(ip) || isIngressController(manager.k8sManager.GetEndpointFromIp(ip))
+}
+
+// getClientIP returns the original client ip from request headers or PROXY protocol preamble, empty if unknown.
+// They are only honoured when the peer is a trusted proxy, since any client can send them
+func (manager *PacketManager) getClientIP(decoder Decoder, flow string, payload []byte, srcIp string, srcEndpoint *kubernetes.EndpointInfo) string {
+	if !isIngressController(srcEndpoint) && !manager.isTrustedProxyIp(srcIp) {
+		return ""
+	}
+	if clientIPDecoder, ok := decoder.(ClientIPDecoder); ok {
+		if ip := clientIPDecoder.DecodeClientIP(flow, payload, manager.isTrustedProxy); ip != "" {
+			return ip
+		}
+	}
+	return manager.proxyFlows.GetClientIP(flow)
+}
+
+// decodeTraceContext returns the trace propagated by request headers, nil if unknown
+func decodeTraceContext(decoder Decoder, flow string, payload []byte) *TraceContext {
+	if traceDecoder, ok := decoder.(TraceContextDecoder); ok {
+		return traceDecoder.DecodeTraceContext(flow, payload)
+	}
+	return nil
+}
+
+// decodeBodySize returns the body size of a request or response, -1 if unknown
+func decodeBodySize(decoder Decoder, flow string, payload []byte) int64 {
+	if sizeDecoder, ok := decoder.(BodySizeDecoder); ok {
+		if size, ok := sizeDecoder.DecodeBodySize(flow, payload); ok {
+			return size
+		}
+	}
+	return -1
+}
+
+// setGeo looks up the client if it is outside the cluster, or behind a proxy, and the external destination
+func (manager *PacketManager) setGeo(trafficInfo *TrafficInfo, srcEndpoint *kubernetes.EndpointInfo) {
+	if manager.geoResolver == nil {
+		return
+	}
+	if srcEndpoint == nil || srcEndpoint.Deployment == nil || trafficInfo.ClientIP != trafficInfo.SrcIP {
+		trafficInfo.ClientGeo = manager.geoResolver.Lookup(trafficInfo.ClientIP)
+	}
+	if trafficInfo.DstExternal {
+		trafficInfo.DstGeo = manager.geoResolver.Lookup(trafficInfo.DstIP)
+	}
+}
+
+// isPodNetwork checks if the endpoint is a pod which has its own pod ip
+func isPodNetwork(endpoint *kubernetes.EndpointInfo) bool {
+	return endpoint != nil && endpoint.Pod != nil && !endpoint.Pod.HostNetwork
+}
+
+func (manager *PacketManager) checkResponse(packet *PacketInfo, srcEndpoint *kubernetes.EndpointInfo, dstEndpoint *kubernetes.EndpointInfo) (*TrafficInfo, bool) {
 	trafficManager := manager.trafficManager
 	pcapManager := manager.pCapManager
 	k8sManager := manager.k8sManager
@@ -54,7 +237,7 @@ func (manager *PacketManager) checkResponse(packet *PacketInfo, srcPod *kubernet
 	var trafficInfo *TrafficInfo
 	var duplicate bool
 	//check if there is a request from packet.Dst to packet.Src. If this is true, this packet is a response
-	if dstPod == nil {
+	if dstEndpoint == nil {
 		trafficInfo, duplicate = trafficManager.GetRequest("", packet.DstPort, packet.SrcIp, packet.SrcPort, packet.TcpTimestamp)
 	} else {
 		trafficInfo, duplicate = trafficManager.GetRequest(packet.DstIp, packet.DstPort, packet.SrcIp, packet.SrcPort, packet.TcpTimestamp)
@@ -63,20 +246,23 @@ func (manager *PacketManager) checkResponse(packet *PacketInfo, srcPod *kubernet
 		return nil, false
 	}
 	if trafficInfo != nil {
-		if dstPod != nil && srcPod != nil && !pcapManager.InsideLocalPodIPRange(packet.DstIp) {
+		if isPodNetwork(dstEndpoint) && isPodNetwork(srcEndpoint) && !pcapManager.InsideLocalPodIPRange(packet.DstIp) {
 			//Both SrcIp and DstIp are Pod IP
 			//A cross nodes Pod to Pod request&response will generate two pair of packages, one pair for each node
 			//The sender node's response package's source ip will be rewrite to service ip by kube-proxy iptable DNAT rule
-			//the receiver does not have this rewrite, so we reject recevier node's package pair to avoid duplicate package counting.
-			//Using sender side package pair can also make response time include the time spend in network
+			//the receiver does not have this rewrite, so the receiver node's package pair is rejected to avoid duplicate package counting,
+			//or tagged as server side observation, whose response time excludes the time spend in network, if serverObserver is set.
 
 			//For in-node Pod to Pod request&response(DstIp will not be InsideLocalPodIPRange for cross-node response in receiver side)
-			//there will only be one response package, so should not ignore(Because the cluster ip need to be DNAT,
+			//there will only be one response package(Because the cluster ip need to be DNAT,
 			//the request package go-through docker0 twice, therefore there will be two request packages. One of them will be timeout and ignored)
 			if glog.V(2) {
-				glog.Infof("Ignore cross node POD Response: %s", packet.String())
+				glog.Infof("Server side cross node POD Response: %s", packet.String())
+			}
+			if !manager.serverObserver {
+				return nil, false
 			}
-			return nil, false
+			trafficInfo.Observer = OBSERVER_SERVER
 		}
 
 		return trafficInfo, false
@@ -86,20 +272,14 @@ func (manager *PacketManager) checkResponse(packet *PacketInfo, srcPod *kubernet
 	//In sender node, when a request dst service ip is DNAT to pod ip,
 	//the corresponding response's source ip will be changed to service ip
 	//This happens before the package arrived at docker0
+	//The same happens to requests sent to a node port, load balancer ip or external ip of a service
 
-	serviceInfo := k8sManager.GetServiceFromClusterIp(packet.SrcIp)
+	serviceInfo, srcPortInfo := k8sManager.GetServiceFromAddress(packet.SrcIp, packet.SrcPort)
 
 	if serviceInfo == nil {
 		return nil, true
 	}
 
-	var srcPortInfo *kubernetes.ServicePortInfo
-	for _, port := range serviceInfo.Ports {
-		if packet.SrcPort == port.Port {
-			srcPortInfo = port
-			break
-		}
-	}
 	if srcPortInfo == nil {
 		if glog.V(2) {
 			glog.Infof("Found source service %s, but no port match %d", serviceInfo.Name(), packet.SrcPort)
@@ -115,7 +295,7 @@ func (manager *PacketManager) checkResponse(packet *PacketInfo, srcPod *kubernet
 		for _, port := range deployment.Ports {
 			if port == srcPortInfo.TargetPort {
 				var duplicate bool
-				if dstPod == nil {
+				if dstEndpoint == nil {
 					trafficInfo, duplicate = trafficManager.GetRequest("", packet.DstPort, pod.PodIP, srcPortInfo.TargetPort, packet.TcpTimestamp)
 				} else {
 					trafficInfo, duplicate = trafficManager.GetRequest(packet.DstIp, packet.DstPort, pod.PodIP, srcPortInfo.TargetPort, packet.TcpTimestamp)
@@ -127,10 +307,16 @@ func (manager *PacketManager) checkResponse(packet *PacketInfo, srcPod *kubernet
 					if glog.V(2) {
 						glog.Infof("Map Service IP %s to Pod IP %s", packet.SrcIp, pod.PodIP)
 					}
+					if packet.SrcIp != serviceInfo.ClusterIP && trafficInfo.EntryService == "" {
+						trafficInfo.EntryService = serviceInfo.Name()
+						trafficInfo.EntryServiceNS = serviceInfo.Namespace()
+					}
+					trafficInfo.DstService = serviceInfo.Name()
+					trafficInfo.DstServiceNS = serviceInfo.Namespace()
 					return trafficInfo, false
 				}
 				if glog.V(2) {
-					if dstPod == nil {
+					if dstEndpoint == nil {
 						glog.Infof("Could not found request from INTERNET:%d to %s:%d ", packet.DstPort, pod.PodIP, srcPortInfo.TargetPort)
 					} else {
 						glog.Infof("Could not found request from %s:%d to %s:%d ", packet.DstIp, packet.DstPort, pod.PodIP, srcPortInfo.TargetPort)
@@ -152,27 +338,39 @@ func (manager *PacketManager) Handle(packet *PacketInfo) {
 	//https://superuser.com/questions/925286/does-tcpdump-bypass-iptables
 	//For request, gopacket capture packages after iptable's process, so the DstIp has been DNAT to PodIP
 
-	srcPod := k8sManager.GetPodFromIp(packet.SrcIp)
+	if packet.DNS != nil {
+		if manager.externalResolver != nil {
+			manager.externalResolver.AddDNSResponse(packet.DNS, packet.TimestampNano)
+		}
+		return
+	}
+	if packet.Syn {
+		manager.handshakes.Add(packet)
+		return
+	}
 
-	if srcPod != nil && srcPod.IsSkip() {
+	srcEndpoint := manager.getEndpoint(packet.SrcIp, packet.SrcPort, packet.TimestampNano)
+	if srcEndpoint != nil && srcEndpoint.Skip {
 		return
 	}
 
-	dstPod := k8sManager.GetPodFromIp(packet.DstIp)
-	if dstPod != nil && dstPod.IsSkip() {
+	dstEndpoint := manager.getEndpoint(packet.DstIp, packet.DstPort, packet.TimestampNano)
+	if dstEndpoint != nil && dstEndpoint.Skip {
 		return
 	}
 
-	trafficInfo, mayBeRequest := manager.checkResponse(packet, srcPod, dstPod)
+	trafficInfo, mayBeRequest := manager.checkResponse(packet, srcEndpoint, dstEndpoint)
 	if trafficInfo != nil {
 		content := packet.GetApplicationPayload()
-		match := httpResponseRegexp.FindStringSubmatch(content)
-		if match != nil && len(match) > 1 {
-			trafficInfo.SetResponse(match[1], packet.TimestampNano, packet.TcpTimestamp)
+		decoder := manager.decoderManager.GetDecoder(trafficInfo.Protocol)
+		if status, ok := decoder.DecodeResponse(packet.String(), []byte(content)); ok {
+			trafficInfo.SetResponse(status, packet.TimestampNano, packet.TcpTimestamp)
+			trafficInfo.ResponseBytes = int64(len(content))
+			trafficInfo.ResponseBodyBytes = decodeBodySize(decoder, packet.String(), []byte(content))
 			if glog.V(2) {
 				glog.Infof("RESPONSE %s %d", trafficInfo.String(), len(content))
 			}
-			SavePacket(trafficInfo)
+			manager.save(trafficInfo)
 		} else {
 			if glog.V(2) {
 				glog.Infof("RESPONSE %s CONTINUE %d", trafficInfo.String(), len(content))
@@ -183,29 +381,96 @@ func (manager *PacketManager) Handle(packet *PacketInfo) {
 		return
 	}
 
-	dstDeployment := k8sManager.GetPodDeployment(dstPod)
-	if dstDeployment == nil {
-		if glog.V(2) {
-			glog.Info(fmt.Sprintf("SKIP FOR UNKNOWN DST %s:%d", packet.DstIp, packet.DstPort))
+	if dstEndpoint == nil || dstEndpoint.Pod == nil {
+		service, port := k8sManager.GetServiceFromAddress(packet.DstIp, packet.DstPort)
+		if port != nil && packet.DstIp != service.ClusterIP {
+			//request to a node port, load balancer ip or external ip, which will be DNATed to a pod ip later
+			if glog.V(2) {
+				glog.Infof("ENTRY %s for service %s", packet.String(), service.String())
+			}
+			manager.entryManager.AddEntry(packet, service)
+			return
 		}
-		return
 	}
-	srcDeployment := k8sManager.GetPodDeployment(srcPod)
-	for _, port := range dstDeployment.Ports {
-		if port == packet.DstPort {
-			content := packet.GetApplicationPayload()
-			match := httpRequestRegexp.FindStringSubmatch(content)
-			if match != nil && len(match) > 2 {
-				trafficInfo := NewTrafficInfo(packet, match[2], match[1])
-				trafficInfo.Dst = dstDeployment.Name()
-				trafficInfo.DstNS = dstPod.Namespace()
-				if srcPod != nil && srcDeployment != nil {
-					trafficInfo.Src = srcDeployment.Name()
-					trafficInfo.SrcNS = srcPod.Namespace()
+
+	var dstName, dstNamespace, dstKind, protocol string
+	var dstExternal bool
+	if dstEndpoint == nil || dstEndpoint.Deployment == nil {
+		if srcEndpoint != nil && srcEndpoint.Deployment != nil {
+			//request from inside the cluster to an external peer
+			dstName, dstNamespace = manager.resolveExternal(packet.DstIp, packet.TimestampNano)
+			dstExternal = dstName != ""
+		}
+		if !dstExternal {
+			if glog.V(2) {
+				glog.Info(fmt.Sprintf("SKIP FOR UNKNOWN DST %s:%d", packet.DstIp, packet.DstPort))
+			}
+			return
+		}
+	} else if dstEndpoint.HasPort(packet.DstPort) {
+		dstName = dstEndpoint.Deployment.Name()
+		dstNamespace = dstEndpoint.Deployment.Namespace()
+		dstKind = dstEndpoint.Deployment.Kind()
+		protocol = dstEndpoint.GetProtocol(packet.DstPort)
+	}
+	if dstName != "" {
+		decoder := manager.decoderManager.GetDecoder(protocol)
+		if decoder == nil {
+			if glog.V(2) {
+				glog.Infof("SKIP FOR UNSUPPORTED PROTOCOL %s %s", protocol, packet.String())
+			}
+			return
+		}
+		payload := manager.proxyFlows.Strip(packet.String(), []byte(packet.GetApplicationPayload()))
+		if method, url, ok := decoder.DecodeRequest(packet.String(), payload); ok {
+			trafficInfo := NewTrafficInfo(packet, url, method)
+			trafficInfo.Protocol = protocol
+			trafficInfo.Dst = dstName
+			trafficInfo.DstNS = dstNamespace
+			trafficInfo.DstExternal = dstExternal
+			trafficInfo.DstKind = dstKind
+			trafficInfo.RequestBytes = int64(len(payload))
+			trafficInfo.RequestBodyBytes = decodeBodySize(decoder, packet.String(), payload)
+			if dstEndpoint != nil && dstEndpoint.Pod != nil {
+				trafficInfo.DstPod = dstEndpoint.Pod.Name()
+			}
+			if srcEndpoint != nil && srcEndpoint.Pod != nil {
+				trafficInfo.SrcPod = srcEndpoint.Pod.Name()
+			}
+			if manager.pathTemplater != nil {
+				trafficInfo.Path = manager.pathTemplater.Template(dstNamespace, dstName, url)
+			}
+			if service := manager.entryManager.GetEntry(packet, dstEndpoint); service != nil {
+				trafficInfo.EntryService = service.Name()
+				trafficInfo.EntryServiceNS = service.Namespace()
+			}
+			if isIngressController(dstEndpoint) || isIngressController(srcEndpoint) {
+				manager.setIngress(trafficInfo, decoder, packet.String(), payload, dstEndpoint)
+			}
+			trafficInfo.ClientIP = manager.getClientIP(decoder, packet.String(), payload, packet.SrcIp, srcEndpoint)
+			if trafficInfo.ClientIP == "" {
+				trafficInfo.ClientIP = packet.SrcIp
+			}
+			trafficInfo.Trace = decodeTraceContext(decoder, packet.String(), payload)
+			if srcEndpoint != nil && srcEndpoint.Deployment != nil {
+				trafficInfo.Src = srcEndpoint.Deployment.Name()
+				trafficInfo.SrcNS = srcEndpoint.Deployment.Namespace()
+				trafficInfo.SrcKind = srcEndpoint.Deployment.Kind()
+			} else {
+				//a load balancer in front of the cluster is named by the client behind it if possible
+				trafficInfo.Src, trafficInfo.SrcNS = manager.resolveExternal(trafficInfo.ClientIP, packet.TimestampNano)
+				if trafficInfo.Src == "" && trafficInfo.ClientIP != packet.SrcIp {
+					trafficInfo.Src, trafficInfo.SrcNS = manager.resolveExternal(packet.SrcIp, packet.TimestampNano)
 				}
-				trafficManager.AddRequest(trafficInfo)
-				return
+				trafficInfo.SrcExternal = trafficInfo.Src != ""
+			}
+			manager.setGeo(trafficInfo, srcEndpoint)
+			if manager.pCapManager.InsideLocalPodIPRange(packet.SrcIp) || k8sManager.IsLocalIp(packet.SrcIp) {
+				//the server node's handshake rtt is only the time of its kernel answering SYN
+				trafficInfo.NetworkRttNano = manager.handshakes.GetRttNano(packet.SrcIp, packet.SrcPort)
 			}
+			trafficManager.AddRequest(trafficInfo)
+			return
 		}
 	}
 
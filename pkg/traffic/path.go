@@ -0,0 +1,143 @@
+package traffic
+
+import (
+	"fmt"
+	"github.com/luguoxiang/kubernetes-traffic-monitor/pkg/config"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	//path label of requests beyond the limit of distinct paths of a destination
+	PATH_OTHER = "other"
+	//hex strings of at least this length are treated as hashes, e.g. md5, sha1, object ids
+	MIN_HASH_LENGTH = 16
+)
+
+var (
+	numericSegmentRegexp = regexp.MustCompile(`^[0-9]+$`)
+	uuidSegmentRegexp    = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	hashSegmentRegexp    = regexp.MustCompile(`^[0-9a-fA-F]+$`)
+)
+
+type pathRule struct {
+	namespace string
+	match     *regexp.Regexp
+	template  string
+}
+
+// PathTemplater normalizes request urls into path templates with bounded cardinality for metric labels.
+// It is only used by the packet handling goroutine
+type PathTemplater struct {
+	//rules by destination workload name
+	rules    map[string][]pathRule
+	maxPaths int
+	ttl      time.Duration
+	//last request time of distinct paths of each destination
+	paths     map[string]map[string]time.Time
+	lastPurge time.Time
+	now       func() time.Time
+}
+
+func NewPathTemplater(pathConfig *config.PathConfig) (*PathTemplater, error) {
+	result := &PathTemplater{
+		rules:    make(map[string][]pathRule),
+		maxPaths: pathConfig.MaxPaths,
+		ttl:      time.Duration(pathConfig.TTLSeconds) * time.Second,
+		paths:    make(map[string]map[string]time.Time),
+		now:      time.Now,
+	}
+	for _, rule := range pathConfig.Rules {
+		if rule.Destination == "" {
+			return nil, fmt.Errorf("Missing destination of path rule %s", rule.Match)
+		}
+		match, err := regexp.Compile(rule.Match)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid path rule %s: %s", rule.Match, err.Error())
+		}
+		result.rules[rule.Destination] = append(result.rules[rule.Destination], pathRule{
+			namespace: rule.Namespace,
+			match:     match,
+			template:  rule.Template,
+		})
+	}
+	return result, nil
+}
+
+func templateSegment(segment string) string {
+	switch {
+	case numericSegmentRegexp.MatchString(segment):
+		return "{id}"
+	case uuidSegmentRegexp.MatchString(segment):
+		return "{uuid}"
+	case len(segment) >= MIN_HASH_LENGTH && hashSegmentRegexp.MatchString(segment):
+		return "{hash}"
+	}
+	return segment
+}
+
+// templatePath strips query string and fragment of the url, and applies the first matching rule,
+// or the default templates of path segments
+func (templater *PathTemplater) templatePath(namespace string, name string, url string) string {
+	if i := strings.IndexAny(url, "?#"); i >= 0 {
+		url = url[:i]
+	}
+	for _, rule := range templater.rules[name] {
+		if rule.namespace != "" && rule.namespace != namespace {
+			continue
+		}
+		if rule.match.MatchString(url) {
+			return rule.match.ReplaceAllString(url, rule.template)
+		}
+	}
+	segments := strings.Split(url, "/")
+	for i, segment := range segments {
+		segments[i] = templateSegment(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// purge forgets paths which are not requested for the ttl, at most once a minute
+func (templater *PathTemplater) purge(now time.Time) {
+	interval := time.Minute
+	if templater.ttl < interval {
+		interval = templater.ttl
+	}
+	if templater.ttl <= 0 || now.Sub(templater.lastPurge) < interval {
+		return
+	}
+	templater.lastPurge = now
+	for destination, paths := range templater.paths {
+		for path, updateTime := range paths {
+			if now.Sub(updateTime) > templater.ttl {
+				delete(paths, path)
+			}
+		}
+		if len(paths) == 0 {
+			delete(templater.paths, destination)
+		}
+	}
+}
+
+// Template returns the path label of a request url sent to a destination
+func (templater *PathTemplater) Template(namespace string, name string, url string) string {
+	path := templater.templatePath(namespace, name, url)
+	now := templater.now()
+	templater.purge(now)
+	destination := namespace + "/" + name
+	paths := templater.paths[destination]
+	if paths == nil {
+		paths = make(map[string]time.Time)
+		templater.paths[destination] = paths
+	}
+	if _, ok := paths[path]; ok {
+		paths[path] = now
+		return path
+	}
+	if templater.maxPaths > 0 && len(paths) >= templater.maxPaths {
+		return PATH_OTHER
+	}
+	paths[path] = now
+	return path
+}
@@ -0,0 +1,74 @@
+package traffic
+
+import (
+	"github.com/luguoxiang/kubernetes-traffic-monitor/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestPathTemplater(t *testing.T) {
+	_, err := NewPathTemplater(&config.PathConfig{Rules: []config.PathRuleConfig{{Destination: "a", Match: "("}}})
+	assert.NotNil(t, err)
+	_, err = NewPathTemplater(&config.PathConfig{Rules: []config.PathRuleConfig{{Match: "^/"}}})
+	assert.NotNil(t, err)
+
+	templater, err := NewPathTemplater(&config.PathConfig{
+		Rules: []config.PathRuleConfig{
+			{Destination: "files", Match: "^/files/.*", Template: "/files/{path}"},
+			{Destination: "users", Namespace: "prod", Match: "^/users/([^/]+)/avatar$", Template: "/users/{name}/avatar"},
+		},
+		MaxPaths: 3,
+	})
+	assert.Nil(t, err)
+
+	for _, request := range []struct {
+		url  string
+		path string
+	}{
+		{"/login?next=/home", "/login"},
+		{"/orders/12345/items/7#top", "/orders/{id}/items/{id}"},
+		{"/objects/3f2504e0-4f89-11d3-9a0c-0305e82c3301", "/objects/{uuid}"},
+		{"/blobs/da39a3ee5e6b4b0d3255bfef95601890afd80709/raw", "/blobs/{hash}/raw"},
+		{"/users/alice/avatar", "/users/alice/avatar"},
+		{"/cafe", "/cafe"},
+		{"", ""},
+	} {
+		assert.Equal(t, templater.templatePath("test", "app", request.url), request.path, request.url)
+	}
+
+	assert.Equal(t, templater.templatePath("test", "files", "/files/a/b.txt?download=1"), "/files/{path}")
+	assert.Equal(t, templater.templatePath("prod", "users", "/users/alice/avatar"), "/users/{name}/avatar")
+	//rule of another namespace
+	assert.Equal(t, templater.templatePath("test", "users", "/users/alice/avatar"), "/users/alice/avatar")
+
+	assert.Equal(t, templater.Template("test", "app", "/a/1"), "/a/{id}")
+	assert.Equal(t, templater.Template("test", "app", "/b"), "/b")
+	assert.Equal(t, templater.Template("test", "app", "/c"), "/c")
+	assert.Equal(t, templater.Template("test", "app", "/d"), PATH_OTHER)
+	//known paths are kept
+	assert.Equal(t, templater.Template("test", "app", "/a/2"), "/a/{id}")
+	//limit is per destination
+	assert.Equal(t, templater.Template("prod", "app", "/d"), "/d")
+}
+
+func TestPathTemplaterTTL(t *testing.T) {
+	templater, err := NewPathTemplater(&config.PathConfig{MaxPaths: 2, TTLSeconds: 60})
+	assert.Nil(t, err)
+	now := time.Now()
+	templater.now = func() time.Time { return now }
+
+	assert.Equal(t, templater.Template("test", "app", "/a"), "/a")
+	assert.Equal(t, templater.Template("test", "app", "/b"), "/b")
+	assert.Equal(t, templater.Template("test", "app", "/c"), PATH_OTHER)
+	assert.Equal(t, templater.Template("test", "other", "/a"), "/a")
+
+	now = now.Add(40 * time.Second)
+	assert.Equal(t, templater.Template("test", "app", "/a"), "/a")
+	//paths not requested for the ttl are forgotten
+	now = now.Add(40 * time.Second)
+	assert.Equal(t, templater.Template("test", "app", "/c"), "/c")
+	assert.Equal(t, templater.Template("test", "app", "/b"), PATH_OTHER)
+	_, ok := templater.paths["test/other"]
+	assert.False(t, ok)
+}
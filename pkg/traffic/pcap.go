@@ -12,16 +12,25 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"reflect"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 )
 
 type PCapManager struct {
 	dockerNetIP   net.IP
 	dockerNetMask net.IPMask
-	pcapFilter    string
+	httpFilter    string
+	excludedHosts []string
+	//ports of protocols which could not be matched by payload heads
+	protocolPorts []uint32
+	//capture dns responses for names of external ips
+	captureDNS bool
+	handle     *pcap.Handle
+	mutex      sync.Mutex
 }
 
 func (manager *PCapManager) InsideLocalPodIPRange(dstIp string) bool {
@@ -36,7 +45,12 @@ type PacketInfo struct {
 	DstIp         string
 	TimestampNano int64
 	TcpTimestamp  []byte
-	packet        gopacket.Packet
+	//SYN or SYN-ACK of tcp handshake, which has no payload
+	Syn bool
+	Ack bool
+	//dns response, other fields except TimestampNano are not set
+	DNS    *layers.DNS
+	packet gopacket.Packet
 }
 
 func (packet *PacketInfo) GetApplicationPayload() string {
@@ -59,6 +73,14 @@ func (info *PacketInfo) String() string {
 }
 func NewPacket(packet gopacket.Packet) *PacketInfo {
 	ipLayer := packet.Layer(layers.LayerTypeIPv4)
+	if dnsLayer := packet.Layer(layers.LayerTypeDNS); ipLayer != nil && dnsLayer != nil {
+		dns, _ := dnsLayer.(*layers.DNS)
+		return &PacketInfo{
+			TimestampNano: packet.Metadata().Timestamp.UnixNano(),
+			DNS:           dns,
+			packet:        packet,
+		}
+	}
 	tcpLayer := packet.Layer(layers.LayerTypeTCP)
 	if ipLayer == nil || tcpLayer == nil {
 		glog.Warning("Unexpected packet, only IPv4 and TCP packet can be handled")
@@ -72,6 +94,8 @@ func NewPacket(packet gopacket.Packet) *PacketInfo {
 	result.packet = packet
 	result.TimestampNano = packet.Metadata().Timestamp.UnixNano()
 	tcp, _ := tcpLayer.(*layers.TCP)
+	result.Syn = tcp.SYN
+	result.Ack = tcp.ACK
 	if len(tcp.Options) > 2 {
 		result.TcpTimestamp = tcp.Options[2].OptionData
 	}
@@ -175,7 +199,8 @@ func NewPCapManager(k8sIp string, aPodIp net.IP) *PCapManager {
 
 	var filters []string
 	//pcap is only able to match data size of either 1, 2 or 4 bytes
-	HTTP_HEADS := []string{"GET ", "PUT ", "POST", "DELE" /*DELETE*/, "HEAD", "HTTP"}
+	HTTP_HEADS := []string{"GET ", "PUT ", "POST", "DELE" /*DELETE*/, "HEAD", "HTTP",
+		"PROX" /*PROXY protocol v1*/, "\r\n\r\n" /*PROXY protocol v2*/}
 
 	for _, head := range HTTP_HEADS {
 		hex := fmt.Sprintf("%x", []byte(head))
@@ -183,12 +208,12 @@ func NewPCapManager(k8sIp string, aPodIp net.IP) *PCapManager {
 		filters = append(filters, filter)
 	}
 
-	pcapFilter := strings.Join(filters, " or ")
+	var excludedHosts []string
 	var dockerNetIP net.IP
 	var dockerNetMask net.IPMask
 
 	if k8sIp != "" {
-		pcapFilter = fmt.Sprintf("%s and not host %s", pcapFilter, k8sIp)
+		excludedHosts = append(excludedHosts, k8sIp)
 	}
 	ifaces, err := net.Interfaces()
 	if err != nil {
@@ -207,7 +232,7 @@ func NewPCapManager(k8sIp string, aPodIp net.IP) *PCapManager {
 					if iface.Name == "flannel0" {
 						//Per https://github.com/coreos/flannel/issues/434, packet's source ip in receiver node
 						//may be rewrite to flannel0's ip if docker's ip-masq is true, we need to ignore these packages
-						pcapFilter = fmt.Sprintf("%s and not host %s", pcapFilter, ip.String())
+						excludedHosts = append(excludedHosts, ip.String())
 						continue
 					}
 					if iface.Name == device {
@@ -223,12 +248,61 @@ func NewPCapManager(k8sIp string, aPodIp net.IP) *PCapManager {
 
 	glog.Infof("docker ip: %s, mask: %s", dockerNetIP.String(), dockerNetMask.String())
 	return &PCapManager{
-		pcapFilter:    pcapFilter,
+		httpFilter:    strings.Join(filters, " or "),
+		excludedHosts: excludedHosts,
 		dockerNetIP:   dockerNetIP,
 		dockerNetMask: dockerNetMask,
 	}
 }
 
+func (manager *PCapManager) getFilter() string {
+	filter := manager.httpFilter
+	if len(manager.protocolPorts) > 0 {
+		var portFilters []string
+		for _, port := range manager.protocolPorts {
+			portFilters = append(portFilters, fmt.Sprintf("tcp port %d", port))
+		}
+		//only packets with tcp payload
+		filter = fmt.Sprintf("(%s) or ((%s) and (((ip[2:2] - ((ip[0]&0xf)<<2)) - ((tcp[12]&0xf0)>>2)) != 0))",
+			filter, strings.Join(portFilters, " or "))
+	}
+	if manager.captureDNS {
+		filter = fmt.Sprintf("(%s) or (udp src port 53)", filter)
+	}
+	//handshake rtt of connections
+	filter = fmt.Sprintf("(%s) or (tcp[tcpflags] & tcp-syn != 0)", filter)
+	for _, host := range manager.excludedHosts {
+		filter = fmt.Sprintf("%s and not host %s", filter, host)
+	}
+	return filter
+}
+
+// SetCaptureDNS decides whether dns responses are captured, it should be called before Run
+func (manager *PCapManager) SetCaptureDNS(captureDNS bool) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	manager.captureDNS = captureDNS
+}
+
+// SetProtocolPorts updates the ports captured regardless of payload, the filter of a running capture is replaced
+func (manager *PCapManager) SetProtocolPorts(ports []uint32) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	if reflect.DeepEqual(ports, manager.protocolPorts) {
+		return
+	}
+	manager.protocolPorts = ports
+	if manager.handle == nil {
+		return
+	}
+	filter := manager.getFilter()
+	if err := manager.handle.SetBPFFilter(filter); err != nil {
+		glog.Errorf("Failed to set filter %s: %s", filter, err.Error())
+		return
+	}
+	glog.Infof("pcap filter = %s", filter)
+}
+
 func (manager *PCapManager) Run(handler PacketHandler) {
 
 	handle, err := pcap.OpenLive("any", 1024, false, pcap.BlockForever)
@@ -237,20 +311,28 @@ func (manager *PCapManager) Run(handler PacketHandler) {
 	}
 	defer handle.Close()
 
-	err = handle.SetBPFFilter(manager.pcapFilter)
+	manager.mutex.Lock()
+	pcapFilter := manager.getFilter()
+	err = handle.SetBPFFilter(pcapFilter)
 	if err != nil {
+		manager.mutex.Unlock()
 		panic(err)
 	}
+	manager.handle = handle
+	manager.mutex.Unlock()
 
 	sigc := make(chan os.Signal, 1)
 	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		_ = <-sigc
 		glog.Warning("SIGTERM|SIGINT received, prepare to terminate")
+		manager.mutex.Lock()
+		manager.handle = nil
+		manager.mutex.Unlock()
 		handle.Close()
 	}()
 
-	glog.Infof("pcap.OpenLive device=any, filter = %s",manager.pcapFilter)
+	glog.Infof("pcap.OpenLive device=any, filter = %s",pcapFilter)
 
 	packetCh := make(chan *PacketInfo, 1000)
 	go func() {
@@ -1,61 +1,553 @@
 package traffic
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/golang/glog"
+	"github.com/luguoxiang/kubernetes-traffic-monitor/pkg/config"
+	"github.com/luguoxiang/kubernetes-traffic-monitor/pkg/kubernetes"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"net/http"
 	"os"
+	"sort"
+	"sync"
+	"time"
 )
 
 const (
 	PROMETHEUS_DURATION_NAME = "request_duration_seconds"
 	PROMETHEUS_COUNT_NAME    = "requests_total"
-	SOURCE                   = "source"
-	DESTINATION              = "destination"
-	SOURCE_NAMESPACE         = "source_ns"
-	DESTINATION_NAMESPACE    = "destination_ns"
-	HTTP_METHOD              = "method"
-	HTTP_STATUS              = "response_code"
-	DESTINATION_PORT         = "destination_port"
+	PROMETHEUS_SERVER_NAME   = "request_server_duration_seconds"
+	PROMETHEUS_NETWORK_NAME  = "request_network_rtt_seconds"
+	//body sizes of requests and responses whose size is known
+	PROMETHEUS_REQUEST_SIZE_NAME   = "request_size_bytes"
+	PROMETHEUS_RESPONSE_SIZE_NAME  = "response_size_bytes"
+	PROMETHEUS_REQUEST_BYTES_NAME  = "request_bytes_total"
+	PROMETHEUS_RESPONSE_BYTES_NAME = "response_bytes_total"
+	SOURCE                         = "source"
+	DESTINATION                    = "destination"
+	SOURCE_NAMESPACE               = "source_ns"
+	DESTINATION_NAMESPACE          = "destination_ns"
+	HTTP_METHOD                    = "method"
+	HTTP_STATUS                    = "response_code"
+	DESTINATION_PORT               = "destination_port"
+	ENTRY_SERVICE                  = "entry_service"
+	ENTRY_SERVICE_NAMESPACE        = "entry_service_ns"
+	INGRESS                        = "ingress"
+	INGRESS_HOST                   = "ingress_host"
+	CLIENT_COUNTRY                 = "client_country"
+	CLIENT_ASN                     = "client_asn"
+	OBSERVER                       = "observer"
+	PATH                           = "path"
+	SOURCE_POD                     = "source_pod"
+	DESTINATION_POD                = "destination_pod"
+	DESTINATION_SERVICE            = "destination_service"
+	DESTINATION_SERVICE_NAMESPACE  = "destination_service_ns"
+	NODE                           = "node"
+	//pod labels of requests beyond the limit of distinct pod pairs
+	POD_OTHER = "other"
 )
 
-var (
-	requestHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
-		Name:    PROMETHEUS_DURATION_NAME,
-		Help:    "A histogram of the API HTTP request durations in seconds.",
-		Buckets: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
-	}, []string{SOURCE, SOURCE_NAMESPACE, DESTINATION, DESTINATION_NAMESPACE, HTTP_METHOD, HTTP_STATUS, DESTINATION_PORT})
+// histogramRule is the histogram of destination workloads of a HistogramRuleConfig
+type histogramRule struct {
+	namespace string
+	histogram *prometheus.HistogramVec
+}
+
+// workloadHistogramVec is a histogram vector whose buckets are chosen by destination workload,
+// series of a destination are all kept in the histogram of its first matching rule
+type workloadHistogramVec struct {
+	defaultHistogram *prometheus.HistogramVec
+	//rules by destination workload name
+	rules map[string][]histogramRule
+}
+
+func (vec *workloadHistogramVec) get(namespace string, name string) *prometheus.HistogramVec {
+	for _, rule := range vec.rules[name] {
+		if rule.namespace == "" || rule.namespace == namespace {
+			return rule.histogram
+		}
+	}
+	return vec.defaultHistogram
+}
 
-	requestCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+func (vec *workloadHistogramVec) histograms() []*prometheus.HistogramVec {
+	result := []*prometheus.HistogramVec{vec.defaultHistogram}
+	for _, rules := range vec.rules {
+		for _, rule := range rules {
+			result = append(result, rule.histogram)
+		}
+	}
+	return result
+}
+
+// Delete deletes the series from all histograms
+func (vec *workloadHistogramVec) Delete(labels prometheus.Labels) bool {
+	var result bool
+	for _, histogram := range vec.histograms() {
+		if histogram.Delete(labels) {
+			result = true
+		}
+	}
+	return result
+}
+
+// Describe implements prometheus.Collector, all histograms share the same descriptor
+func (vec *workloadHistogramVec) Describe(ch chan<- *prometheus.Desc) {
+	vec.defaultHistogram.Describe(ch)
+}
+
+func (vec *workloadHistogramVec) Collect(ch chan<- prometheus.Metric) {
+	for _, histogram := range vec.histograms() {
+		histogram.Collect(ch)
+	}
+}
+
+// seriesVec is a metric vector whose series could be deleted
+type seriesVec interface {
+	Delete(labels prometheus.Labels) bool
+}
+
+// metricSeries is a label set of metric vectors, with its last update time
+type metricSeries struct {
+	labels prometheus.Labels
+	vecs   []seriesVec
+	//pair of source and destination pods counted by the pod series budget, empty if not counted
+	podPair    string
+	updateTime time.Time
+}
+
+func getSeriesKey(labels prometheus.Labels) string {
+	var names []string
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buffer bytes.Buffer
+	for _, name := range names {
+		buffer.WriteString(name)
+		buffer.WriteString("=")
+		buffer.WriteString(labels[name])
+		buffer.WriteString("\xff")
+	}
+	return buffer.String()
+}
+
+// PrometheusSink exports requests as prometheus metrics.
+// Series are deleted when they are idle for the ttl, or when the workload or pod they describe is deleted,
+// so it is a DeploymentEventHandler and a PodEventHandler
+type PrometheusSink struct {
+	requestHistogram *workloadHistogramVec
+	requestCount     *prometheus.CounterVec
+	serverHistogram  *workloadHistogramVec
+	networkHistogram *prometheus.HistogramVec
+	requestSize      *prometheus.HistogramVec
+	responseSize     *prometheus.HistogramVec
+	requestBytes     *prometheus.CounterVec
+	responseBytes    *prometheus.CounterVec
+	//labels switched off by config
+	disabledLabels []string
+	//node of the agent
+	node         string
+	maxPodSeries int
+	ttl          time.Duration
+
+	mutex  sync.Mutex
+	series map[string]*metricSeries
+	//series of each pair of source and destination pods
+	podSeries map[string]int
+}
+
+func checkBuckets(buckets []float64) error {
+	if len(buckets) == 0 {
+		return fmt.Errorf("Missing histogram buckets")
+	}
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i] <= buckets[i-1] {
+			return fmt.Errorf("Histogram buckets %v are not in increasing order", buckets)
+		}
+	}
+	return nil
+}
+
+// NewPrometheusSink creates metrics and registers them to registerer, e.g. prometheus.DefaultRegisterer
+func NewPrometheusSink(registerer prometheus.Registerer, prometheusConfig *config.PrometheusConfig) (*PrometheusSink, error) {
+	result := &PrometheusSink{
+		node:         os.Getenv("NODE_NAME"),
+		maxPodSeries: prometheusConfig.MaxPodSeries,
+		ttl:          time.Duration(prometheusConfig.SeriesTTLSeconds) * time.Second,
+		series:       make(map[string]*metricSeries),
+		podSeries:    make(map[string]int),
+	}
+	if !prometheusConfig.Labels.Namespace {
+		result.disabledLabels = append(result.disabledLabels, SOURCE_NAMESPACE, DESTINATION_NAMESPACE, ENTRY_SERVICE_NAMESPACE)
+	}
+	if !prometheusConfig.Labels.Method {
+		result.disabledLabels = append(result.disabledLabels, HTTP_METHOD)
+	}
+	if !prometheusConfig.Labels.DestinationPort {
+		result.disabledLabels = append(result.disabledLabels, DESTINATION_PORT)
+	}
+	if !prometheusConfig.Labels.SourcePod {
+		result.disabledLabels = append(result.disabledLabels, SOURCE_POD)
+	}
+	if !prometheusConfig.Labels.DestinationPod {
+		result.disabledLabels = append(result.disabledLabels, DESTINATION_POD)
+	}
+	if !prometheusConfig.Labels.DestinationService {
+		result.disabledLabels = append(result.disabledLabels, DESTINATION_SERVICE, DESTINATION_SERVICE_NAMESPACE)
+	}
+	if !prometheusConfig.Labels.Node {
+		result.disabledLabels = append(result.disabledLabels, NODE)
+	}
+	if !prometheusConfig.Labels.ClientCountry {
+		result.disabledLabels = append(result.disabledLabels, CLIENT_COUNTRY)
+	}
+	if !prometheusConfig.Labels.ClientASN {
+		result.disabledLabels = append(result.disabledLabels, CLIENT_ASN)
+	}
+	requestLabels := result.labelNames(SOURCE, SOURCE_NAMESPACE, DESTINATION, DESTINATION_NAMESPACE, HTTP_METHOD, HTTP_STATUS, DESTINATION_PORT, ENTRY_SERVICE, ENTRY_SERVICE_NAMESPACE, INGRESS, INGRESS_HOST, CLIENT_COUNTRY, CLIENT_ASN, OBSERVER, PATH,
+		SOURCE_POD, DESTINATION_POD, DESTINATION_SERVICE, DESTINATION_SERVICE_NAMESPACE, NODE)
+	edgeLabels := result.labelNames(SOURCE, SOURCE_NAMESPACE, DESTINATION, DESTINATION_NAMESPACE)
+
+	newHistogram := func(opts prometheus.HistogramOpts, labels []string) *prometheus.HistogramVec {
+		if prometheusConfig.NativeHistogramBucketFactor > 1 {
+			opts.NativeHistogramBucketFactor = prometheusConfig.NativeHistogramBucketFactor
+			opts.NativeHistogramMaxBucketNumber = prometheusConfig.NativeHistogramMaxBuckets
+		}
+		return prometheus.NewHistogramVec(opts, labels)
+	}
+	newWorkloadHistogram := func(opts prometheus.HistogramOpts, labels []string) (*workloadHistogramVec, error) {
+		if err := checkBuckets(prometheusConfig.Buckets); err != nil {
+			return nil, err
+		}
+		opts.Buckets = prometheusConfig.Buckets
+		vec := &workloadHistogramVec{
+			defaultHistogram: newHistogram(opts, labels),
+			rules:            make(map[string][]histogramRule),
+		}
+		for _, rule := range prometheusConfig.Rules {
+			if rule.Destination == "" {
+				return nil, fmt.Errorf("Missing destination of histogram rule")
+			}
+			//series of a destination in different namespaces would be the same without namespace labels
+			if rule.Namespace != "" && !prometheusConfig.Labels.Namespace {
+				return nil, fmt.Errorf("Namespace of histogram rule %s needs namespace labels", rule.Destination)
+			}
+			if err := checkBuckets(rule.Buckets); err != nil {
+				return nil, fmt.Errorf("Invalid histogram rule %s: %s", rule.Destination, err.Error())
+			}
+			opts.Buckets = rule.Buckets
+			vec.rules[rule.Destination] = append(vec.rules[rule.Destination], histogramRule{
+				namespace: rule.Namespace,
+				histogram: newHistogram(opts, labels),
+			})
+		}
+		return vec, nil
+	}
+
+	var err error
+	result.requestHistogram, err = newWorkloadHistogram(prometheus.HistogramOpts{
+		Name: PROMETHEUS_DURATION_NAME,
+		Help: "A histogram of the API HTTP request durations in seconds.",
+	}, requestLabels)
+	if err != nil {
+		return nil, err
+	}
+	result.serverHistogram, err = newWorkloadHistogram(prometheus.HistogramOpts{
+		Name: PROMETHEUS_SERVER_NAME,
+		Help: "A histogram of the request durations spent in the server in seconds, excluding network round trip time.",
+	}, result.labelNames(SOURCE, SOURCE_NAMESPACE, DESTINATION, DESTINATION_NAMESPACE, OBSERVER))
+	if err != nil {
+		return nil, err
+	}
+	result.requestCount = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: PROMETHEUS_COUNT_NAME,
 		Help: "API HTTP request count.",
-	}, []string{SOURCE, SOURCE_NAMESPACE, DESTINATION, DESTINATION_NAMESPACE, HTTP_METHOD, HTTP_STATUS, DESTINATION_PORT})
-)
+	}, requestLabels)
+	result.networkHistogram = newHistogram(prometheus.HistogramOpts{
+		Name:    PROMETHEUS_NETWORK_NAME,
+		Help:    "A histogram of the tcp handshake round trip time of connections in seconds.",
+		Buckets: []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25},
+	}, edgeLabels)
+	sizeBuckets := []float64{100, 1000, 10000, 100000, 1e6, 1e7, 1e8}
+	//only the first 1024 bytes of the first packet of a message are captured, so sizes come from Content-Length,
+	//or from a chunked body which ends in them. Requests of unknown sizes are not counted by the size metrics
+	sizeHelp := " Only requests whose size is given by Content-Length or by a chunked body within the first 1024 captured bytes are counted."
+	result.requestSize = newHistogram(prometheus.HistogramOpts{
+		Name:    PROMETHEUS_REQUEST_SIZE_NAME,
+		Help:    "A histogram of the request body sizes in bytes." + sizeHelp,
+		Buckets: sizeBuckets,
+	}, requestLabels)
+	result.responseSize = newHistogram(prometheus.HistogramOpts{
+		Name:    PROMETHEUS_RESPONSE_SIZE_NAME,
+		Help:    "A histogram of the response body sizes in bytes." + sizeHelp,
+		Buckets: sizeBuckets,
+	}, requestLabels)
+	result.requestBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: PROMETHEUS_REQUEST_BYTES_NAME,
+		Help: "Request body bytes." + sizeHelp,
+	}, requestLabels)
+	result.responseBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: PROMETHEUS_RESPONSE_BYTES_NAME,
+		Help: "Response body bytes." + sizeHelp,
+	}, requestLabels)
+
+	for _, collector := range []prometheus.Collector{result.requestHistogram, result.requestCount, result.serverHistogram, result.networkHistogram,
+		result.requestSize, result.responseSize, result.requestBytes, result.responseBytes} {
+		if err := registerer.Register(collector); err != nil {
+			return nil, fmt.Errorf("Failed to register prometheus metrics: %s", err.Error())
+		}
+	}
+	return result, nil
+}
+
+// labelNames returns the enabled labels of names
+func (sink *PrometheusSink) labelNames(names ...string) []string {
+	var result []string
+	for _, name := range names {
+		if !sink.isDisabled(name) {
+			result = append(result, name)
+		}
+	}
+	return result
+}
+
+func (sink *PrometheusSink) isDisabled(name string) bool {
+	for _, disabled := range sink.disabledLabels {
+		if disabled == name {
+			return true
+		}
+	}
+	return false
+}
 
-func init() {
-	prometheus.MustRegister(requestHistogram)
-	prometheus.MustRegister(requestCount)
+// ServePrometheus serves metrics of prometheus.DefaultGatherer at /metrics in background
+func ServePrometheus(address string) {
 	go func() {
-		address := ":" + os.Getenv("VIZ_METRICS_PORT")
 		glog.Infof("Running prometheus server on %s", address)
-		glog.Infof("metrics: %s, %s", PROMETHEUS_COUNT_NAME, PROMETHEUS_DURATION_NAME)
+		glog.Infof("metrics: %s, %s, %s, %s, %s, %s, %s, %s", PROMETHEUS_COUNT_NAME, PROMETHEUS_DURATION_NAME, PROMETHEUS_SERVER_NAME, PROMETHEUS_NETWORK_NAME,
+			PROMETHEUS_REQUEST_SIZE_NAME, PROMETHEUS_RESPONSE_SIZE_NAME, PROMETHEUS_REQUEST_BYTES_NAME, PROMETHEUS_RESPONSE_BYTES_NAME)
 		http.Handle("/metrics", promhttp.Handler())
 		glog.Fatal(http.ListenAndServe(address, nil))
 	}()
 }
 
-func SavePacket(info *TrafficInfo) {
+// limitPodLabels replaces pod labels by POD_OTHER when there are too many distinct pairs of source and destination pods,
+// returns the pair counted by the budget, empty if it is not counted
+func (sink *PrometheusSink) limitPodLabels(labels prometheus.Labels) string {
+	//disabled labels are empty
+	srcPod := labels[SOURCE_POD]
+	dstPod := labels[DESTINATION_POD]
+	if srcPod == "" && dstPod == "" {
+		return ""
+	}
+	key := srcPod + "/" + dstPod
+	if sink.podSeries[key] > 0 {
+		return key
+	}
+	if sink.maxPodSeries > 0 && len(sink.podSeries) >= sink.maxPodSeries {
+		if srcPod != "" {
+			labels[SOURCE_POD] = POD_OTHER
+		}
+		if dstPod != "" {
+			labels[DESTINATION_POD] = POD_OTHER
+		}
+		return ""
+	}
+	return key
+}
+
+// touch updates the time of a series, podPair is counted when the series is new
+func (sink *PrometheusSink) touch(labels prometheus.Labels, podPair string, vecs ...seriesVec) {
+	key := getSeriesKey(labels)
+	if series := sink.series[key]; series != nil {
+		series.updateTime = time.Now()
+		return
+	}
+	sink.series[key] = &metricSeries{labels: labels, vecs: vecs, podPair: podPair, updateTime: time.Now()}
+	if podPair != "" {
+		sink.podSeries[podPair]++
+	}
+}
+
+// deleteSeries deletes matched series from metrics, returns the number of deleted series
+func (sink *PrometheusSink) deleteSeries(match func(series *metricSeries) bool) int {
+	var result int
+	for key, series := range sink.series {
+		if !match(series) {
+			continue
+		}
+		for _, vec := range series.vecs {
+			vec.Delete(series.labels)
+		}
+		if series.podPair != "" {
+			sink.podSeries[series.podPair]--
+			if sink.podSeries[series.podPair] <= 0 {
+				delete(sink.podSeries, series.podPair)
+			}
+		}
+		delete(sink.series, key)
+		result++
+	}
+	return result
+}
+
+// deleteStaleSeries deletes series which are not updated for the ttl
+func (sink *PrometheusSink) deleteStaleSeries(now time.Time) {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	count := sink.deleteSeries(func(series *metricSeries) bool {
+		return now.Sub(series.updateTime) > sink.ttl
+	})
+	if count > 0 && glog.V(2) {
+		glog.Infof("Deleted %d stale prometheus series", count)
+	}
+}
+
+// Start deletes stale series periodically in background, series are kept without ttl
+func (sink *PrometheusSink) Start() {
+	if sink.ttl <= 0 {
+		return
+	}
+	interval := time.Minute
+	if sink.ttl < interval {
+		interval = sink.ttl
+	}
+	go func() {
+		for now := range time.Tick(interval) {
+			sink.deleteStaleSeries(now)
+		}
+	}()
+}
+
+// matchSeries checks the name label and namespace label of a series, series without namespace label match any namespace
+func matchSeries(labels prometheus.Labels, nameLabel string, namespaceLabel string, name string, namespace string) bool {
+	if labels[nameLabel] != name {
+		return false
+	}
+	value, ok := labels[namespaceLabel]
+	return !ok || value == namespace
+}
+
+func (sink *PrometheusSink) deleteResourceSeries(resource string, sourceLabel string, destinationLabel string, name string, namespace string) {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	count := sink.deleteSeries(func(series *metricSeries) bool {
+		return matchSeries(series.labels, sourceLabel, SOURCE_NAMESPACE, name, namespace) ||
+			matchSeries(series.labels, destinationLabel, DESTINATION_NAMESPACE, name, namespace)
+	})
+	if count > 0 && glog.V(2) {
+		glog.Infof("Deleted %d prometheus series of %s %s@%s", count, resource, name, namespace)
+	}
+}
+
+func (sink *PrometheusSink) DeploymentValid(deployment *kubernetes.DeploymentInfo) bool {
+	return true
+}
+
+func (sink *PrometheusSink) DeploymentAdded(deployment *kubernetes.DeploymentInfo) {
+}
+
+func (sink *PrometheusSink) DeploymentDeleted(deployment *kubernetes.DeploymentInfo) {
+	sink.deleteResourceSeries(deployment.Kind(), SOURCE, DESTINATION, deployment.Name(), deployment.Namespace())
+}
+
+func (sink *PrometheusSink) DeploymentUpdated(oldDeployment, newDeployment *kubernetes.DeploymentInfo) {
+}
+
+func (sink *PrometheusSink) PodValid(pod *kubernetes.PodInfo) bool {
+	return true
+}
+
+func (sink *PrometheusSink) PodAdded(pod *kubernetes.PodInfo) {
+}
+
+// PodDeleted deletes series of pod labels
+func (sink *PrometheusSink) PodDeleted(pod *kubernetes.PodInfo) {
+	sink.deleteResourceSeries("Pod", SOURCE_POD, DESTINATION_POD, pod.Name(), pod.Namespace())
+}
+
+func (sink *PrometheusSink) PodUpdated(oldPod, newPod *kubernetes.PodInfo) {
+}
+
+func (sink *PrometheusSink) Save(info *TrafficInfo) {
 	labels := prometheus.Labels{
+		SOURCE:                        info.Src,
+		SOURCE_NAMESPACE:              info.SrcNS,
+		DESTINATION:                   info.Dst,
+		DESTINATION_NAMESPACE:         info.DstNS,
+		HTTP_METHOD:                   info.Method,
+		HTTP_STATUS:                   info.Status,
+		DESTINATION_PORT:              fmt.Sprintf("%d", info.DstPort),
+		ENTRY_SERVICE:                 info.EntryService,
+		ENTRY_SERVICE_NAMESPACE:       info.EntryServiceNS,
+		INGRESS:                       info.Ingress,
+		INGRESS_HOST:                  info.IngressHost,
+		CLIENT_COUNTRY:                "",
+		CLIENT_ASN:                    "",
+		OBSERVER:                      info.Observer,
+		PATH:                          info.Path,
+		SOURCE_POD:                    info.SrcPod,
+		DESTINATION_POD:               info.DstPod,
+		DESTINATION_SERVICE:           info.DstService,
+		DESTINATION_SERVICE_NAMESPACE: info.DstServiceNS,
+		NODE:                          sink.node,
+	}
+	if info.ClientGeo != nil {
+		labels[CLIENT_COUNTRY] = info.ClientGeo.Country
+		labels[CLIENT_ASN] = info.ClientGeo.ASN
+	}
+	for _, name := range sink.disabledLabels {
+		delete(labels, name)
+	}
+	edgeLabels := prometheus.Labels{
 		SOURCE:                info.Src,
 		SOURCE_NAMESPACE:      info.SrcNS,
 		DESTINATION:           info.Dst,
 		DESTINATION_NAMESPACE: info.DstNS,
-		HTTP_METHOD:           info.Method,
-		HTTP_STATUS:           info.Status,
-		DESTINATION_PORT:      fmt.Sprintf("%d", info.DstPort),
 	}
-	requestCount.With(labels).Inc()
-	requestHistogram.With(labels).Observe(info.GetDurationTimeMiliSeconds() / 1000)
+	for _, name := range sink.disabledLabels {
+		delete(edgeLabels, name)
+	}
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	if info.Observer == OBSERVER_SERVER {
+		//the client node's copy of the request is counted, the server node's copy only gives the server duration
+		sink.observeServerDuration(info, edgeLabels)
+		return
+	}
+	podPair := sink.limitPodLabels(labels)
+	sink.touch(labels, podPair, sink.requestCount, sink.requestHistogram, sink.requestSize, sink.responseSize, sink.requestBytes, sink.responseBytes)
+	sink.requestCount.With(labels).Inc()
+	sink.requestHistogram.get(info.DstNS, info.Dst).With(labels).Observe(info.GetDurationTimeMiliSeconds() / 1000)
+	if info.RequestBodyBytes >= 0 {
+		sink.requestSize.With(labels).Observe(float64(info.RequestBodyBytes))
+		sink.requestBytes.With(labels).Add(float64(info.RequestBodyBytes))
+	}
+	if info.ResponseBodyBytes >= 0 {
+		sink.responseSize.With(labels).Observe(float64(info.ResponseBodyBytes))
+		sink.responseBytes.With(labels).Add(float64(info.ResponseBodyBytes))
+	}
+
+	if info.NetworkRttNano > 0 {
+		sink.touch(edgeLabels, "", sink.networkHistogram)
+		sink.networkHistogram.With(edgeLabels).Observe(float64(info.NetworkRttNano) / 1e9)
+	}
+	sink.observeServerDuration(info, edgeLabels)
+}
+
+func (sink *PrometheusSink) observeServerDuration(info *TrafficInfo, edgeLabels prometheus.Labels) {
+	duration, ok := info.GetServerDurationMiliSeconds()
+	if !ok {
+		return
+	}
+	//edgeLabels is kept by the network series
+	serverLabels := prometheus.Labels{OBSERVER: info.Observer}
+	for name, value := range edgeLabels {
+		serverLabels[name] = value
+	}
+	sink.touch(serverLabels, "", sink.serverHistogram)
+	sink.serverHistogram.get(info.DstNS, info.Dst).With(serverLabels).Observe(duration / 1000)
 }
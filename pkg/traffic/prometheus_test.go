@@ -0,0 +1,316 @@
+package traffic
+
+import (
+	"github.com/luguoxiang/kubernetes-traffic-monitor/pkg/config"
+	"github.com/luguoxiang/kubernetes-traffic-monitor/pkg/geoip"
+	"github.com/luguoxiang/kubernetes-traffic-monitor/pkg/kubernetes"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPrometheusSink(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	sink, err := NewPrometheusSink(registry, &config.NewConfig().Sinks.Prometheus)
+	assert.Nil(t, err)
+	//metrics could only be registered once
+	_, err = NewPrometheusSink(registry, &config.NewConfig().Sinks.Prometheus)
+	assert.NotNil(t, err)
+
+	manager := PacketManager{}
+	manager.AddSink(sink)
+	info := &TrafficInfo{
+		Src:                   "a",
+		SrcNS:                 "test",
+		Dst:                   "b",
+		DstNS:                 "test",
+		DstPort:               8080,
+		Method:                "GET",
+		Status:                "200",
+		Observer:              OBSERVER_CLIENT,
+		Path:                  "/users/{id}",
+		NetworkRttNano:        1e6,
+		RequestBodyBytes:      100,
+		ResponseBodyBytes:     -1,
+		requestTimestampNano:  1e9,
+		responseTimestampNano: 1e9 + 20e6,
+	}
+	manager.save(info)
+	manager.save(info)
+	//the server node's copy of a request only gives the server duration
+	serverInfo := *info
+	serverInfo.Observer = OBSERVER_SERVER
+	serverInfo.NetworkRttNano = 0
+	manager.save(&serverInfo)
+
+	labels := prometheus.Labels{
+		SOURCE:                  "a",
+		SOURCE_NAMESPACE:        "test",
+		DESTINATION:             "b",
+		DESTINATION_NAMESPACE:   "test",
+		HTTP_METHOD:             "GET",
+		HTTP_STATUS:             "200",
+		DESTINATION_PORT:        "8080",
+		ENTRY_SERVICE:           "",
+		ENTRY_SERVICE_NAMESPACE: "",
+		INGRESS:                 "",
+		INGRESS_HOST:            "",
+		OBSERVER:                OBSERVER_CLIENT,
+		PATH:                    "/users/{id}",
+	}
+	assert.Equal(t, testutil.ToFloat64(sink.requestCount.With(labels)), float64(2))
+	assert.Equal(t, testutil.ToFloat64(sink.requestBytes.With(labels)), float64(200))
+	//response size is unknown
+	assert.Equal(t, testutil.CollectAndCount(sink.responseBytes), 0)
+
+	families, err := registry.Gather()
+	assert.Nil(t, err)
+	names := make(map[string]uint64)
+	for _, family := range families {
+		if histogram := family.GetMetric()[0].GetHistogram(); histogram != nil {
+			names[family.GetName()] = histogram.GetSampleCount()
+		}
+	}
+	assert.Equal(t, names, map[string]uint64{
+		PROMETHEUS_DURATION_NAME:     2,
+		PROMETHEUS_SERVER_NAME:       2,
+		PROMETHEUS_NETWORK_NAME:      2,
+		PROMETHEUS_REQUEST_SIZE_NAME: 2,
+	})
+	assert.Equal(t, testutil.CollectAndCount(sink.requestCount), 1)
+	//observer="client" and observer="server"
+	assert.Equal(t, testutil.CollectAndCount(sink.serverHistogram), 2)
+}
+
+func TestPrometheusConfig(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	prometheusConfig := config.NewConfig().Sinks.Prometheus
+	prometheusConfig.Rules = []config.HistogramRuleConfig{
+		{Destination: "batch", Buckets: []float64{1, 60, 600}},
+		{Destination: "cache", Namespace: "test", Buckets: []float64{0.0001, 0.001}},
+	}
+	prometheusConfig.Labels.DestinationPort = false
+	prometheusConfig.Labels.Method = false
+	prometheusConfig.Labels.ClientCountry = true
+	prometheusConfig.NativeHistogramBucketFactor = 1.1
+	sink, err := NewPrometheusSink(registry, &prometheusConfig)
+	assert.Nil(t, err)
+
+	for _, destination := range []string{"batch", "cache", "b"} {
+		sink.Save(&TrafficInfo{
+			Src:                   "a",
+			SrcNS:                 "test",
+			Dst:                   destination,
+			DstNS:                 "test",
+			DstPort:               8080,
+			Method:                "GET",
+			Status:                "200",
+			Observer:              OBSERVER_CLIENT,
+			ClientGeo:             &geoip.GeoInfo{Country: "DE", ASN: "AS3320"},
+			requestTimestampNano:  1e9,
+			responseTimestampNano: 1e9 + 20e6,
+		})
+	}
+
+	families, err := registry.Gather()
+	assert.Nil(t, err)
+	for _, family := range families {
+		if family.GetName() != PROMETHEUS_DURATION_NAME {
+			continue
+		}
+		assert.Equal(t, len(family.GetMetric()), 3)
+		for _, metric := range family.GetMetric() {
+			labels := make(map[string]string)
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			_, ok := labels[HTTP_METHOD]
+			assert.False(t, ok)
+			_, ok = labels[DESTINATION_PORT]
+			assert.False(t, ok)
+			assert.Equal(t, labels[CLIENT_COUNTRY], "DE")
+			_, ok = labels[CLIENT_ASN]
+			assert.False(t, ok)
+
+			histogram := metric.GetHistogram()
+			assert.NotNil(t, histogram.Schema)
+			buckets := histogram.GetBucket()
+			switch labels[DESTINATION] {
+			case "batch":
+				assert.Equal(t, len(buckets), 3)
+				assert.Equal(t, buckets[0].GetCumulativeCount(), uint64(1))
+			case "cache":
+				assert.Equal(t, len(buckets), 2)
+				assert.Equal(t, buckets[1].GetCumulativeCount(), uint64(0))
+			default:
+				assert.Equal(t, len(buckets), len(prometheusConfig.Buckets))
+			}
+		}
+	}
+
+	for _, rule := range []config.HistogramRuleConfig{
+		{Buckets: []float64{1}},
+		{Destination: "batch", Buckets: []float64{2, 1}},
+		{Destination: "batch"},
+	} {
+		prometheusConfig.Rules = []config.HistogramRuleConfig{rule}
+		_, err = NewPrometheusSink(prometheus.NewRegistry(), &prometheusConfig)
+		assert.NotNil(t, err)
+	}
+	//series of a namespace could not be told apart without namespace labels
+	prometheusConfig.Rules = []config.HistogramRuleConfig{{Destination: "cache", Namespace: "test", Buckets: []float64{1}}}
+	prometheusConfig.Labels.Namespace = false
+	_, err = NewPrometheusSink(prometheus.NewRegistry(), &prometheusConfig)
+	assert.NotNil(t, err)
+}
+
+func TestPrometheusPodLabels(t *testing.T) {
+	os.Setenv("NODE_NAME", "node-1")
+	defer os.Unsetenv("NODE_NAME")
+	registry := prometheus.NewRegistry()
+	prometheusConfig := config.NewConfig().Sinks.Prometheus
+	prometheusConfig.Labels.SourcePod = true
+	prometheusConfig.Labels.DestinationPod = true
+	prometheusConfig.Labels.DestinationService = true
+	prometheusConfig.Labels.Node = true
+	prometheusConfig.MaxPodSeries = 2
+	sink, err := NewPrometheusSink(registry, &prometheusConfig)
+	assert.Nil(t, err)
+
+	for _, pods := range [][]string{{"a-0", "b-0"}, {"a-0", "b-1"}, {"a-0", "b-0"}, {"a-0", "b-2"}, {"", "b-3"}, {"", ""}} {
+		sink.Save(&TrafficInfo{
+			Src:                   "a",
+			SrcNS:                 "test",
+			SrcPod:                pods[0],
+			Dst:                   "b",
+			DstNS:                 "test",
+			DstPod:                pods[1],
+			DstService:            "b-svc",
+			DstServiceNS:          "test",
+			Status:                "200",
+			Observer:              OBSERVER_CLIENT,
+			RequestBodyBytes:      -1,
+			ResponseBodyBytes:     -1,
+			requestTimestampNano:  1e9,
+			responseTimestampNano: 1e9 + 20e6,
+		})
+	}
+
+	families, err := registry.Gather()
+	assert.Nil(t, err)
+	counts := make(map[string]float64)
+	for _, family := range families {
+		if family.GetName() != PROMETHEUS_COUNT_NAME {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			labels := make(map[string]string)
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			assert.Equal(t, labels[DESTINATION_SERVICE], "b-svc")
+			assert.Equal(t, labels[DESTINATION_SERVICE_NAMESPACE], "test")
+			assert.Equal(t, labels[NODE], "node-1")
+			counts[labels[SOURCE_POD]+"=>"+labels[DESTINATION_POD]] = metric.GetCounter().GetValue()
+		}
+	}
+	assert.Equal(t, counts, map[string]float64{
+		"a-0=>b-0": 2,
+		"a-0=>b-1": 1,
+		//beyond the budget
+		"other=>other": 1,
+		"=>other":      1,
+		"=>":           1,
+	})
+}
+
+func newTestPodTraffic(src string, srcPod string, dst string, dstPod string) *TrafficInfo {
+	return &TrafficInfo{
+		Src:                   src,
+		SrcNS:                 "test",
+		SrcPod:                srcPod,
+		Dst:                   dst,
+		DstNS:                 "test",
+		DstPod:                dstPod,
+		Status:                "200",
+		Observer:              OBSERVER_CLIENT,
+		NetworkRttNano:        1e6,
+		RequestBodyBytes:      -1,
+		ResponseBodyBytes:     -1,
+		requestTimestampNano:  1e9,
+		responseTimestampNano: 1e9 + 20e6,
+	}
+}
+
+func TestPrometheusStaleSeries(t *testing.T) {
+	prometheusConfig := config.NewConfig().Sinks.Prometheus
+	prometheusConfig.Labels.SourcePod = true
+	prometheusConfig.Labels.DestinationPod = true
+	prometheusConfig.MaxPodSeries = 2
+	prometheusConfig.SeriesTTLSeconds = 60
+	sink, err := NewPrometheusSink(prometheus.NewRegistry(), &prometheusConfig)
+	assert.Nil(t, err)
+
+	sink.Save(newTestPodTraffic("a", "a-0", "b", "b-0"))
+	sink.Save(newTestPodTraffic("c", "c-0", "b", "b-1"))
+	assert.Equal(t, testutil.CollectAndCount(sink.requestCount), 2)
+	assert.Equal(t, testutil.CollectAndCount(sink.networkHistogram), 2)
+	assert.Equal(t, testutil.CollectAndCount(sink.serverHistogram), 2)
+
+	//the budget is freed by deleted pods
+	var pod corev1.Pod
+	pod.Name = "b-0"
+	pod.Namespace = "test"
+	pod.Status.PodIP = "10.1.1.1"
+	sink.PodDeleted(kubernetes.NewPodInfo(&pod))
+	assert.Equal(t, testutil.CollectAndCount(sink.requestCount), 1)
+	assert.Equal(t, testutil.CollectAndCount(sink.networkHistogram), 2)
+	sink.Save(newTestPodTraffic("a", "a-0", "b", "b-2"))
+	assert.Equal(t, len(sink.podSeries), 2)
+	assert.Equal(t, testutil.ToFloat64(sink.requestCount.With(prometheus.Labels{
+		SOURCE:                  "a",
+		SOURCE_NAMESPACE:        "test",
+		DESTINATION:             "b",
+		DESTINATION_NAMESPACE:   "test",
+		HTTP_METHOD:             "",
+		HTTP_STATUS:             "200",
+		DESTINATION_PORT:        "0",
+		ENTRY_SERVICE:           "",
+		ENTRY_SERVICE_NAMESPACE: "",
+		INGRESS:                 "",
+		INGRESS_HOST:            "",
+		OBSERVER:                OBSERVER_CLIENT,
+		PATH:                    "",
+		SOURCE_POD:              "a-0",
+		DESTINATION_POD:         "b-2",
+	})), float64(1))
+
+	//series of the workload as source or destination, in another namespace they are kept
+	deployment := &appsv1.Deployment{}
+	deployment.Name = "c"
+	deployment.Namespace = "other"
+	deployment.Spec.Selector = &metav1.LabelSelector{}
+	sink.DeploymentDeleted(kubernetes.NewDeploymentInfo(deployment))
+	assert.Equal(t, testutil.CollectAndCount(sink.requestCount), 2)
+	deployment.Namespace = "test"
+	sink.DeploymentDeleted(kubernetes.NewDeploymentInfo(deployment))
+	assert.Equal(t, testutil.CollectAndCount(sink.requestCount), 1)
+	assert.Equal(t, testutil.CollectAndCount(sink.networkHistogram), 1)
+	assert.Equal(t, testutil.CollectAndCount(sink.serverHistogram), 1)
+
+	sink.deleteStaleSeries(time.Now())
+	assert.Equal(t, testutil.CollectAndCount(sink.requestCount), 1)
+	sink.deleteStaleSeries(time.Now().Add(61 * time.Second))
+	assert.Equal(t, testutil.CollectAndCount(sink.requestCount), 0)
+	assert.Equal(t, testutil.CollectAndCount(sink.requestHistogram), 0)
+	assert.Equal(t, testutil.CollectAndCount(sink.networkHistogram), 0)
+	assert.Equal(t, testutil.CollectAndCount(sink.serverHistogram), 0)
+	assert.Equal(t, len(sink.series), 0)
+	assert.Equal(t, len(sink.podSeries), 0)
+}
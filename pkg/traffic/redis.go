@@ -0,0 +1,74 @@
+package traffic
+
+import (
+	"bytes"
+	"strings"
+)
+
+// redisDecoder parses RESP, see https://redis.io/topics/protocol
+// method is the command name, status is "OK" or the error prefix like "ERR", "WRONGTYPE"
+type redisDecoder struct{}
+
+func readRedisLine(payload []byte) ([]byte, []byte, bool) {
+	index := bytes.Index(payload, []byte("\r\n"))
+	if index < 0 {
+		return nil, nil, false
+	}
+	return payload[:index], payload[index+2:], true
+}
+
+func (decoder redisDecoder) DecodeRequest(flow string, payload []byte) (string, string, bool) {
+	line, rest, ok := readRedisLine(payload)
+	if !ok || len(line) == 0 {
+		return "", "", false
+	}
+	if line[0] != '*' {
+		//inline command, e.g. "PING\r\n"
+		fields := strings.Fields(string(line))
+		if len(fields) == 0 || !isRedisCommand(fields[0]) {
+			return "", "", false
+		}
+		return strings.ToUpper(fields[0]), "", true
+	}
+	//array of bulk strings, the first one is the command
+	line, rest, ok = readRedisLine(rest)
+	if !ok || len(line) < 2 || line[0] != '$' {
+		return "", "", false
+	}
+	command, _, ok := readRedisLine(rest)
+	if !ok || !isRedisCommand(string(command)) {
+		return "", "", false
+	}
+	return strings.ToUpper(string(command)), "", true
+}
+
+func isRedisCommand(command string) bool {
+	if command == "" || len(command) > 32 {
+		return false
+	}
+	for _, c := range command {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+func (decoder redisDecoder) DecodeResponse(flow string, payload []byte) (string, bool) {
+	line, _, ok := readRedisLine(payload)
+	if !ok || len(line) == 0 {
+		return "", false
+	}
+	switch line[0] {
+	case '-':
+		fields := strings.Fields(string(line[1:]))
+		if len(fields) == 0 {
+			return "ERR", true
+		}
+		return fields[0], true
+	case '+', ':', '$', '*', '_', ',', '#', '%', '~', '(', '=', '|', '>':
+		return "OK", true
+	default:
+		return "", false
+	}
+}
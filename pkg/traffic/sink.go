@@ -0,0 +1,7 @@
+package traffic
+
+// TrafficSink receives completed requests with their responses.
+// Save is called by the packet handling goroutine, so it should not block
+type TrafficSink interface {
+	Save(info *TrafficInfo)
+}
@@ -0,0 +1,116 @@
+package traffic
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var (
+	traceHeaderRegexp = regexp.MustCompile(`(?im)^(traceparent|b3|x-b3-traceid|x-b3-spanid|x-b3-parentspanid|uber-trace-id):[ \t]*([^\r\n]*)`)
+	hexRegexp         = regexp.MustCompile(`^[0-9a-f]+$`)
+)
+
+// TraceContext is the trace propagated by headers of a request, ids are lower case hex.
+// SpanID is the span of the caller which sends the request, ParentSpanID is empty if unknown
+type TraceContext struct {
+	TraceID      string
+	SpanID       string
+	ParentSpanID string
+}
+
+// TraceContextDecoder is implemented by decoders of protocols which propagate traces in headers.
+// Like DecodeHost, DecodeTraceContext is called for a request which has been decoded by DecodeRequest
+type TraceContextDecoder interface {
+	DecodeTraceContext(flow string, payload []byte) *TraceContext
+}
+
+// normalizeTraceId pads an id to 16 or 32 hex digits, empty if it is invalid or all zeros
+func normalizeTraceId(id string, lengths ...int) string {
+	id = strings.ToLower(strings.TrimSpace(id))
+	if !hexRegexp.MatchString(id) || strings.Trim(id, "0") == "" {
+		return ""
+	}
+	for _, length := range lengths {
+		if len(id) <= length {
+			return strings.Repeat("0", length-len(id)) + id
+		}
+	}
+	return ""
+}
+
+func newTraceContext(traceID string, spanID string, parentSpanID string) *TraceContext {
+	traceID = normalizeTraceId(traceID, 16, 32)
+	spanID = normalizeTraceId(spanID, 16)
+	if traceID == "" || spanID == "" {
+		return nil
+	}
+	return &TraceContext{TraceID: traceID, SpanID: spanID, ParentSpanID: normalizeTraceId(parentSpanID, 16)}
+}
+
+// parseTraceparent parses W3C traceparent, e.g. 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+func parseTraceparent(value string) *TraceContext {
+	fields := strings.Split(strings.TrimSpace(value), "-")
+	if len(fields) < 4 || len(fields[0]) != 2 || fields[0] == "ff" || len(fields[1]) != 32 || len(fields[2]) != 16 {
+		return nil
+	}
+	return newTraceContext(fields[1], fields[2], "")
+}
+
+// parseB3 parses single b3 header, e.g. 80f198ee56343ba864fe8b2a57d3eff7-e457b5a2e4d86bd1-1-05e3ac9a4f6e3b90
+func parseB3(value string) *TraceContext {
+	fields := strings.Split(strings.TrimSpace(value), "-")
+	//sampling decision only
+	if len(fields) < 2 {
+		return nil
+	}
+	var parentSpanID string
+	if len(fields) >= 4 {
+		parentSpanID = fields[3]
+	}
+	return newTraceContext(fields[0], fields[1], parentSpanID)
+}
+
+// parseUberTraceId parses jaeger header {trace-id}:{span-id}:{parent-span-id}:{flags}, which may be url encoded
+func parseUberTraceId(value string) *TraceContext {
+	if unescaped, err := url.QueryUnescape(value); err == nil {
+		value = unescaped
+	}
+	fields := strings.Split(strings.TrimSpace(value), ":")
+	if len(fields) != 4 {
+		return nil
+	}
+	//parent span id 0 means root span
+	return newTraceContext(fields[0], fields[1], fields[2])
+}
+
+// getTraceContext returns the trace of W3C traceparent, B3 or jaeger headers, in that order, nil if unknown
+func getTraceContext(header func(name string) string) *TraceContext {
+	if value := header("traceparent"); value != "" {
+		if result := parseTraceparent(value); result != nil {
+			return result
+		}
+	}
+	if value := header("b3"); value != "" {
+		if result := parseB3(value); result != nil {
+			return result
+		}
+	}
+	if traceID := header("x-b3-traceid"); traceID != "" {
+		if result := newTraceContext(traceID, header("x-b3-spanid"), header("x-b3-parentspanid")); result != nil {
+			return result
+		}
+	}
+	if value := header("uber-trace-id"); value != "" {
+		return parseUberTraceId(value)
+	}
+	return nil
+}
+
+func getHttpTraceContext(payload []byte) *TraceContext {
+	headers := getHttpHeaders(payload, traceHeaderRegexp)
+	if len(headers) == 0 {
+		return nil
+	}
+	return getTraceContext(func(name string) string { return headers[name] })
+}
@@ -0,0 +1,29 @@
+package traffic
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestTraceContext(t *testing.T) {
+	for _, request := range []struct {
+		headers string
+		trace   *TraceContext
+	}{
+		{"traceparent: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01\r\n",
+			&TraceContext{TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", SpanID: "00f067aa0ba902b7"}},
+		{"traceparent: 00-00000000000000000000000000000000-00f067aa0ba902b7-01\r\nb3: 80f198ee56343ba864fe8b2a57d3eff7-e457b5a2e4d86bd1-1-05e3ac9a4f6e3b90\r\n",
+			&TraceContext{TraceID: "80f198ee56343ba864fe8b2a57d3eff7", SpanID: "e457b5a2e4d86bd1", ParentSpanID: "05e3ac9a4f6e3b90"}},
+		{"b3: 1\r\nX-B3-TraceId: 463AC35C9F6413AD\r\nX-B3-SpanId: a2fb4a1d1a96d312\r\nX-B3-ParentSpanId: 0020000000000001\r\n",
+			&TraceContext{TraceID: "463ac35c9f6413ad", SpanID: "a2fb4a1d1a96d312", ParentSpanID: "0020000000000001"}},
+		{"uber-trace-id: 5b8aa5a2d2c872e8321cf37308d69df2:51b9a0a5c7f6f3e1:0:1\r\n",
+			&TraceContext{TraceID: "5b8aa5a2d2c872e8321cf37308d69df2", SpanID: "51b9a0a5c7f6f3e1"}},
+		{"Uber-Trace-Id: abc%3Adef%3A123%3A1\r\n",
+			&TraceContext{TraceID: "0000000000000abc", SpanID: "0000000000000def", ParentSpanID: "0000000000000123"}},
+		{"X-B3-TraceId: not-hex\r\nX-B3-SpanId: a2fb4a1d1a96d312\r\n", nil},
+		{"Accept: */*\r\n", nil},
+	} {
+		payload := []byte("GET / HTTP/1.1\r\nHost: test\r\n" + request.headers + "\r\n")
+		assert.Equal(t, httpDecoder{}.DecodeTraceContext("", payload), request.trace, request.headers)
+	}
+}
@@ -3,6 +3,7 @@ package traffic
 import (
 	"bytes"
 	"github.com/golang/glog"
+	"github.com/luguoxiang/kubernetes-traffic-monitor/pkg/geoip"
 	"strconv"
 )
 
@@ -15,6 +16,9 @@ type TrafficInfo struct {
 	Dst                   string
 	SrcNS                 string
 	DstNS                 string
+	EntryService          string
+	EntryServiceNS        string
+	Protocol              string
 	Url                   string
 	Method                string
 	Status                string
@@ -23,8 +27,50 @@ type TrafficInfo struct {
 	requestTimestampNano  int64
 	responseTimestampNano int64
 	Next                  *TrafficInfo
+
+	//Src or Dst is named by ExternalResolver instead of a kubernetes workload
+	SrcExternal bool
+	DstExternal bool
+	//ingress which routes the request, and host of its rule
+	Ingress     string
+	IngressHost string
+	//original client ip given by X-Forwarded-For, Forwarded, X-Real-IP or PROXY protocol, SrcIP if unknown
+	ClientIP string
+	//geo of an external client, and of an external destination
+	ClientGeo *geoip.GeoInfo
+	DstGeo    *geoip.GeoInfo
+	//node side which captured the response, OBSERVER_CLIENT or OBSERVER_SERVER
+	Observer string
+	//tcp handshake rtt of the connection, only known on the client's node
+	NetworkRttNano int64
+	//template of Url with bounded cardinality for metric labels
+	Path string
+	//pod names, empty if the peer is not a pod
+	SrcPod string
+	DstPod string
+	//workload kinds of Src and Dst, e.g. Deployment, StatefulSet, Node, empty for external peers
+	SrcKind string
+	DstKind string
+	//trace propagated by request headers, nil if unknown
+	Trace *TraceContext
+	//application payload bytes of the first packet of the request and of the response
+	RequestBytes  int64
+	ResponseBytes int64
+	//body sizes of the request and of the response, -1 if unknown
+	RequestBodyBytes  int64
+	ResponseBodyBytes int64
+	//service whose cluster ip the request is sent to, only known on the client's node
+	DstService   string
+	DstServiceNS string
 }
 
+const (
+	//the response is captured on the client's node, the duration includes network time
+	OBSERVER_CLIENT = "client"
+	//the response is captured on the server's node of a cross node pod to pod request
+	OBSERVER_SERVER = "server"
+)
+
 func (info *TrafficInfo) GetDurationTimeMiliSeconds() float64 {
 	a := info.responseTimestampNano / 1000
 	b := info.requestTimestampNano / 1000
@@ -34,6 +80,23 @@ func (info *TrafficInfo) GetDurationTimeMiliSeconds() float64 {
 	return float64(a-b) / 1000
 }
 
+// GetServerDurationMiliSeconds returns the duration spent in the server,
+// which is the duration minus network rtt on the client side, false if the rtt is unknown
+func (info *TrafficInfo) GetServerDurationMiliSeconds() (float64, bool) {
+	duration := info.GetDurationTimeMiliSeconds()
+	if info.Observer == OBSERVER_SERVER {
+		return duration, true
+	}
+	if info.NetworkRttNano <= 0 {
+		return 0, false
+	}
+	duration -= float64(info.NetworkRttNano/1000) / 1000
+	if duration < 0 {
+		return 0, true
+	}
+	return duration, true
+}
+
 func (info *TrafficInfo) getRequestTimestampMiliSeconds() int64 {
 	return info.requestTimestampNano / 1e6
 }
@@ -46,12 +109,22 @@ func (info *TrafficInfo) String() string {
 		buffer.WriteString(")")
 	} else {
 		buffer.WriteString(info.Src)
+		if info.SrcExternal {
+			buffer.WriteString("(")
+			buffer.WriteString(info.SrcIP)
+			buffer.WriteString(")")
+		}
 	}
 
 	buffer.WriteString(":")
 	buffer.WriteString(strconv.FormatInt(int64(info.SrcPort), 10))
 	buffer.WriteString("=>")
 	buffer.WriteString(info.Dst)
+	if info.DstExternal {
+		buffer.WriteString("(")
+		buffer.WriteString(info.DstIP)
+		buffer.WriteString(")")
+	}
 	buffer.WriteString(":")
 	buffer.WriteString(strconv.FormatInt(int64(info.DstPort), 10))
 	buffer.WriteString(" ")
@@ -75,6 +148,9 @@ func NewTrafficInfo(packet *PacketInfo, url string, method string) *TrafficInfo
 		DstPort:              packet.DstPort,
 		Url:                  url,
 		Method:               method,
+		Observer:             OBSERVER_CLIENT,
+		RequestBodyBytes:     -1,
+		ResponseBodyBytes:    -1,
 		requestTimestampNano: packet.TimestampNano,
 		TcpRequestTimestamp:  packet.TcpTimestamp}
 }
@@ -107,7 +183,7 @@ func (manager *TrafficManager) GetRequest(srcIp string, srcPort uint32, dstIp st
 				if firstMatch == nil {
 					firstMatch = request
 				}
-			} else if srcIp == "" && request.Src == "" {
+			} else if srcIp == "" && (request.Src == "" || request.SrcExternal) {
 				return request, false
 			} else if srcIp == request.SrcIP {
 				return request, false
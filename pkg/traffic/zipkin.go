@@ -0,0 +1,239 @@
+package traffic
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/luguoxiang/kubernetes-traffic-monitor/pkg/config"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ZIPKIN_KIND_CLIENT = "CLIENT"
+	ZIPKIN_KIND_SERVER = "SERVER"
+	//spans of more requests are dropped until the next export
+	MAX_ZIPKIN_SPANS = 10000
+)
+
+type zipkinEndpoint struct {
+	ServiceName string `json:"serviceName,omitempty"`
+	IPv4        string `json:"ipv4,omitempty"`
+	IPv6        string `json:"ipv6,omitempty"`
+	Port        uint32 `json:"port,omitempty"`
+}
+
+// zipkinSpan is a span of zipkin v2 json api
+type zipkinSpan struct {
+	TraceID        string            `json:"traceId"`
+	ID             string            `json:"id"`
+	ParentID       string            `json:"parentId,omitempty"`
+	Name           string            `json:"name,omitempty"`
+	Kind           string            `json:"kind,omitempty"`
+	Timestamp      int64             `json:"timestamp"`
+	Duration       int64             `json:"duration"`
+	Shared         bool              `json:"shared,omitempty"`
+	LocalEndpoint  *zipkinEndpoint   `json:"localEndpoint,omitempty"`
+	RemoteEndpoint *zipkinEndpoint   `json:"remoteEndpoint,omitempty"`
+	Tags           map[string]string `json:"tags,omitempty"`
+}
+
+func newZipkinEndpoint(name string, ip string, port uint32) *zipkinEndpoint {
+	result := &zipkinEndpoint{ServiceName: name, Port: port}
+	netIp := net.ParseIP(ip)
+	if netIp.To4() != nil {
+		result.IPv4 = ip
+	} else if netIp != nil {
+		result.IPv6 = ip
+	}
+	return result
+}
+
+// ZipkinSink exports a span for each request which carries trace headers by zipkin v2 api,
+// which is also accepted by jaeger collector with zipkin endpoint enabled.
+// Call trees of other requests are inferred if enabled, their spans are tagged by inferred and inferred.confidence.
+// Spans are exported periodically by a background goroutine, so Save never waits for the collector
+type ZipkinSink struct {
+	client   *http.Client
+	endpoint string
+	interval time.Duration
+
+	mutex        sync.Mutex
+	pendingSpans []*zipkinSpan
+	droppedSpans int
+	//infers call trees of requests without trace headers, nil if disabled
+	inferrer *CallTreeInferrer
+}
+
+func NewZipkinSink(zipkinConfig *config.ZipkinConfig) (*ZipkinSink, error) {
+	if zipkinConfig.ExportIntervalSeconds <= 0 {
+		return nil, fmt.Errorf("Invalid zipkin export interval %d", zipkinConfig.ExportIntervalSeconds)
+	}
+	result := &ZipkinSink{
+		client:   &http.Client{Timeout: 10 * time.Second},
+		endpoint: zipkinConfig.Endpoint,
+		interval: time.Duration(zipkinConfig.ExportIntervalSeconds) * time.Second,
+	}
+	if zipkinConfig.InferCallTrees {
+		result.inferrer = NewCallTreeInferrer(int64(zipkinConfig.InferenceDelaySeconds) * 1e9)
+	}
+	return result, nil
+}
+
+func newZipkinSpan(info *TrafficInfo, traceID string, spanID string, parentSpanID string) *zipkinSpan {
+	url := info.Url
+	if i := strings.IndexAny(url, "?#"); i >= 0 {
+		url = url[:i]
+	}
+	name := info.Method
+	if info.Path != "" {
+		name = name + " " + info.Path
+	}
+	result := &zipkinSpan{
+		TraceID:   traceID,
+		ID:        spanID,
+		ParentID:  parentSpanID,
+		Name:      name,
+		Timestamp: info.requestTimestampNano / 1000,
+		Duration:  int64(info.GetDurationTimeMiliSeconds() * 1000),
+		Tags: map[string]string{
+			"http.method": info.Method,
+			"http.path":   url,
+		},
+	}
+	client := newZipkinEndpoint(info.Src, info.SrcIP, 0)
+	server := newZipkinEndpoint(info.Dst, info.DstIP, info.DstPort)
+	if info.Observer == OBSERVER_SERVER {
+		result.Kind = ZIPKIN_KIND_SERVER
+		result.Shared = true
+		result.LocalEndpoint = server
+		result.RemoteEndpoint = client
+	} else {
+		result.Kind = ZIPKIN_KIND_CLIENT
+		result.LocalEndpoint = client
+		result.RemoteEndpoint = server
+	}
+	for name, value := range map[string]string{
+		"http.route":           info.Path,
+		"http.status_code":     info.Status,
+		"k8s.namespace":        info.DstNS,
+		"k8s.pod":              info.DstPod,
+		"source.k8s.namespace": info.SrcNS,
+		"source.k8s.pod":       info.SrcPod,
+	} {
+		if value != "" {
+			result.Tags[name] = value
+		}
+	}
+	if isErrorStatus(info) {
+		result.Tags["error"] = info.Status
+	}
+	return result
+}
+
+// newInferredSpans creates spans of a call tree inferred by CallTreeInferrer
+func newInferredSpans(tree []*callRecord) []*zipkinSpan {
+	traceID := hex.EncodeToString(randomId(16))
+	var result []*zipkinSpan
+	for _, record := range tree {
+		var span *zipkinSpan
+		if record.parent == nil {
+			span = newZipkinSpan(record.info, traceID, record.spanID, "")
+		} else {
+			span = newZipkinSpan(record.info, traceID, record.spanID, record.parent.spanID)
+			span.Tags["inferred.confidence"] = strconv.FormatFloat(record.confidence, 'f', 2, 64)
+		}
+		span.Tags["inferred"] = "true"
+		result = append(result, span)
+	}
+	return result
+}
+
+func (sink *ZipkinSink) Save(info *TrafficInfo) {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	if info.Trace == nil {
+		if sink.inferrer != nil {
+			sink.inferrer.Add(info)
+		}
+		return
+	}
+	var span *zipkinSpan
+	if info.Trace.ParentSpanID != "" {
+		//b3 shares the span id between client and server, so the span is shared with the client's span if it is instrumented
+		span = newZipkinSpan(info, info.Trace.TraceID, info.Trace.SpanID, info.Trace.ParentSpanID)
+	} else {
+		//traceparent only gives the caller's span, which becomes the parent of a new span
+		span = newZipkinSpan(info, info.Trace.TraceID, hex.EncodeToString(randomId(8)), info.Trace.SpanID)
+		span.Shared = false
+	}
+	if len(sink.pendingSpans) >= MAX_ZIPKIN_SPANS {
+		sink.droppedSpans++
+		return
+	}
+	sink.pendingSpans = append(sink.pendingSpans, span)
+}
+
+// Export sends pending spans
+func (sink *ZipkinSink) Export(ctx context.Context) error {
+	sink.mutex.Lock()
+	spans := sink.pendingSpans
+	sink.pendingSpans = nil
+	var trees [][]*callRecord
+	if sink.inferrer != nil {
+		trees = sink.inferrer.Flush(time.Now().UnixNano())
+	}
+	if sink.droppedSpans > 0 {
+		glog.Warningf("Dropped %d zipkin spans", sink.droppedSpans)
+		sink.droppedSpans = 0
+	}
+	sink.mutex.Unlock()
+	//emitted records are not changed by the inferrer any more
+	for _, tree := range trees {
+		spans = append(spans, newInferredSpans(tree)...)
+	}
+	if len(spans) == 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(spans)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest(http.MethodPost, sink.endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := sink.client.Do(request.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("Failed to export %d zipkin spans: %s", len(spans), err.Error())
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(response.Body)
+		return fmt.Errorf("Failed to export %d zipkin spans: %s %s", len(spans), response.Status, string(body))
+	}
+	return nil
+}
+
+// Start exports periodically in background
+func (sink *ZipkinSink) Start() {
+	go func() {
+		for range time.Tick(sink.interval) {
+			ctx, cancel := context.WithTimeout(context.Background(), sink.interval)
+			if err := sink.Export(ctx); err != nil {
+				glog.Warning(err.Error())
+			}
+			cancel()
+		}
+	}()
+}
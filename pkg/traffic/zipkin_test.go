@@ -0,0 +1,117 @@
+package traffic
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/luguoxiang/kubernetes-traffic-monitor/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestZipkinSink(t *testing.T) {
+	var received [][]map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		assert.Equal(t, request.URL.Path, "/api/v2/spans")
+		data, _ := ioutil.ReadAll(request.Body)
+		var spans []map[string]interface{}
+		assert.Nil(t, json.Unmarshal(data, &spans))
+		received = append(received, spans)
+		writer.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	_, err := NewZipkinSink(&config.ZipkinConfig{Endpoint: server.URL + "/api/v2/spans"})
+	assert.NotNil(t, err)
+	sink, err := NewZipkinSink(&config.ZipkinConfig{Endpoint: server.URL + "/api/v2/spans", ExportIntervalSeconds: 10})
+	assert.Nil(t, err)
+
+	info := &TrafficInfo{
+		Src:                   "a",
+		SrcIP:                 "10.1.1.1",
+		SrcNS:                 "test",
+		Dst:                   "b",
+		DstIP:                 "10.2.1.1",
+		DstNS:                 "test",
+		DstPod:                "b-7c9f-x2",
+		DstPort:               8080,
+		Method:                "GET",
+		Url:                   "/users/1?q=a",
+		Path:                  "/users/{id}",
+		Status:                "503",
+		Observer:              OBSERVER_SERVER,
+		requestTimestampNano:  1500000000123456789,
+		responseTimestampNano: 1500000000123456789 + 2500000,
+	}
+	//no trace headers
+	sink.Save(info)
+	assert.Nil(t, sink.Export(context.Background()))
+	assert.Equal(t, len(received), 0)
+
+	info.Trace = &TraceContext{TraceID: "463ac35c9f6413ad", SpanID: "a2fb4a1d1a96d312", ParentSpanID: "0020000000000001"}
+	sink.Save(info)
+	assert.Nil(t, sink.Export(context.Background()))
+	assert.Equal(t, len(received), 1)
+
+	var expected []map[string]interface{}
+	assert.Nil(t, json.Unmarshal([]byte(`[{
+		"traceId": "463ac35c9f6413ad",
+		"id": "a2fb4a1d1a96d312",
+		"parentId": "0020000000000001",
+		"name": "GET /users/{id}",
+		"kind": "SERVER",
+		"shared": true,
+		"timestamp": 1500000000123456,
+		"duration": 2500,
+		"localEndpoint": {"serviceName": "b", "ipv4": "10.2.1.1", "port": 8080},
+		"remoteEndpoint": {"serviceName": "a", "ipv4": "10.1.1.1"},
+		"tags": {
+			"http.method": "GET",
+			"http.path": "/users/1",
+			"http.route": "/users/{id}",
+			"http.status_code": "503",
+			"k8s.namespace": "test",
+			"k8s.pod": "b-7c9f-x2",
+			"source.k8s.namespace": "test",
+			"error": "503"
+		}
+	}]`), &expected))
+	assert.Equal(t, received[0], expected)
+
+	//traceparent without parent span id, the span is a child of the caller's span
+	info.Trace = &TraceContext{TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", SpanID: "00f067aa0ba902b7"}
+	sink.Save(info)
+	assert.Nil(t, sink.Export(context.Background()))
+	assert.Equal(t, len(received), 2)
+	child := received[1][0]
+	assert.Equal(t, child["traceId"], "4bf92f3577b34da6a3ce929d0e0e4736")
+	assert.Equal(t, child["parentId"], "00f067aa0ba902b7")
+	assert.Equal(t, len(child["id"].(string)), 16)
+	assert.NotEqual(t, child["id"], "00f067aa0ba902b7")
+	_, shared := child["shared"]
+	assert.False(t, shared)
+
+	server.Close()
+	sink.Save(info)
+	assert.NotNil(t, sink.Export(context.Background()))
+}
+
+func TestZipkinInferredSpans(t *testing.T) {
+	sink, err := NewZipkinSink(&config.ZipkinConfig{ExportIntervalSeconds: 10, InferCallTrees: true})
+	assert.Nil(t, err)
+	parent := newTestCall("a", "b", 0, 100)
+	sink.Save(parent)
+	sink.Save(newTestCall("b", "c", 10, 30))
+
+	spans := newInferredSpans(sink.inferrer.Flush(1000 * 1e6)[0])
+	assert.Equal(t, len(spans), 2)
+	assert.Equal(t, spans[0].TraceID, spans[1].TraceID)
+	assert.Equal(t, len(spans[0].TraceID), 32)
+	assert.Equal(t, spans[0].ParentID, "")
+	assert.Equal(t, spans[1].ParentID, spans[0].ID)
+	assert.Equal(t, spans[0].Tags["inferred"], "true")
+	assert.Equal(t, spans[1].Tags["inferred.confidence"], "1.00")
+	assert.Equal(t, len(sink.pendingSpans), 0)
+}
@@ -13,7 +13,7 @@ requests.packages.urllib3.disable_warnings(requests.packages.urllib3.exceptions.
 
 PROMETHEUS_HOST = os.getenv("VIZ_PROMETHEUS_HOST", "localhost")
 PROMETHEUS_PORT = os.getenv("VIZ_PROMETHEUS_PORT", "9090")
-PROMETHEUS_METRIC = "request_duration_seconds_bucket"
+PROMETHEUS_METRIC = "request_duration_seconds_bucket{observer=\"client\"}"
 
 app = Flask(__name__, static_url_path='/static')
 